@@ -0,0 +1,302 @@
+package dialog
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"strings"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+var (
+	ErrAuthNotDigest          = errors.New("authentication challenge is not a digest challenge")
+	ErrAuthUnsupportedAlg     = errors.New("unsupported digest authentication algorithm")
+	ErrAuthUnsupportedQOP     = errors.New("unsupported digest authentication quality of protection")
+	ErrAuthNoCredentials      = errors.New("no credentials available for authentication realm")
+	ErrAuthCredentialsInvalid = errors.New("credentials were rejected by the remote side")
+)
+
+// Credentials are used to answer digest authentication challenges (RFC 2617, RFC 7616)
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialProvider returns the credentials to use for a challenge from `realm`,
+// or nil if the challenge should not be answered.
+type CredentialProvider func(realm string) *Credentials
+
+// StaticCredentials returns a CredentialProvider that uses the same credentials for every realm
+func StaticCredentials(username, password string) CredentialProvider {
+	creds := &Credentials{
+		Username: username,
+		Password: password,
+	}
+	return func(realm string) *Credentials {
+		return creds
+	}
+}
+
+// DigestChallenge is a parsed `WWW-Authenticate` or `Proxy-Authenticate` header
+type DigestChallenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm string   // `MD5` if not specified
+	QOP       []string // Empty if the server uses RFC 2069 compatibility mode
+	Stale     bool
+}
+
+// ParseDigestChallenge parses the value of a `WWW-Authenticate` or `Proxy-Authenticate` header
+func ParseDigestChallenge(header string) (*DigestChallenge, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, ErrAuthNotDigest
+	}
+
+	chal := &DigestChallenge{
+		Algorithm: "MD5",
+	}
+	for _, param := range splitAuthParams(rest) {
+		name, value, _ := strings.Cut(param, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch name {
+		case "realm":
+			chal.Realm = value
+		case "nonce":
+			chal.Nonce = value
+		case "opaque":
+			chal.Opaque = value
+		case "algorithm":
+			chal.Algorithm = value
+		case "qop":
+			for _, qop := range strings.Split(value, ",") {
+				if qop = strings.TrimSpace(qop); qop != "" {
+					chal.QOP = append(chal.QOP, qop)
+				}
+			}
+		case "stale":
+			chal.Stale = strings.EqualFold(value, "true")
+		}
+	}
+
+	if chal.Nonce == "" {
+		return nil, fmt.Errorf("digest challenge without nonce: %q", header)
+	}
+
+	return chal, nil
+}
+
+// Split the comma-separated parameters of an auth header, ignoring commas in quoted strings
+func splitAuthParams(s string) []string {
+	var params []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if inQuote {
+				i++
+			}
+		case '"':
+			inQuote = !inQuote
+		case ',':
+			if !inQuote {
+				params = append(params, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	params = append(params, s[start:])
+	return params
+}
+
+// DigestResponse holds everything needed to build an `Authorization` or `Proxy-Authorization` header
+type DigestResponse struct {
+	Challenge  *DigestChallenge
+	Username   string
+	URI        string
+	QOP        string // Empty if no quality of protection was requested
+	NonceCount int
+	CNonce     string
+	Response   string
+}
+
+// ComputeDigest answers a challenge for the given request method, request URI, and body
+func ComputeDigest(chal *DigestChallenge, creds *Credentials, method, uri string, body []byte, nc int, cnonce string) (*DigestResponse, error) {
+	alg := strings.ToUpper(chal.Algorithm)
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(alg, "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrAuthUnsupportedAlg, chal.Algorithm)
+	}
+	h := func(s string) string {
+		hh := newHash()
+		hh.Write([]byte(s))
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	qop := ""
+	if len(chal.QOP) > 0 {
+		for _, q := range chal.QOP {
+			if q == "auth" {
+				qop = q
+				break
+			} else if q == "auth-int" {
+				qop = q
+			}
+		}
+		if qop == "" {
+			return nil, fmt.Errorf("%w: %v", ErrAuthUnsupportedQOP, chal.QOP)
+		}
+	}
+
+	ha1 := h(creds.Username + ":" + chal.Realm + ":" + creds.Password)
+	if strings.HasSuffix(alg, "-SESS") {
+		ha1 = h(ha1 + ":" + chal.Nonce + ":" + cnonce)
+	}
+
+	ha2 := h(method + ":" + uri)
+	if qop == "auth-int" {
+		ha2 = h(method + ":" + uri + ":" + h(string(body)))
+	}
+
+	res := &DigestResponse{
+		Challenge: chal,
+		Username:  creds.Username,
+		URI:       uri,
+		QOP:       qop,
+	}
+	if qop == "" {
+		res.Response = h(ha1 + ":" + chal.Nonce + ":" + ha2)
+	} else {
+		res.NonceCount = nc
+		res.CNonce = cnonce
+		res.Response = h(fmt.Sprintf("%s:%s:%08x:%s:%s:%s", ha1, chal.Nonce, nc, cnonce, qop, ha2))
+	}
+
+	return res, nil
+}
+
+// String formats the response as the value of an `Authorization` or `Proxy-Authorization` header
+func (r *DigestResponse) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s", algorithm=%s`,
+		r.Username, r.Challenge.Realm, r.Challenge.Nonce, r.URI, r.Response, r.Challenge.Algorithm)
+	if r.Challenge.Opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, r.Challenge.Opaque)
+	}
+	if r.QOP != "" {
+		fmt.Fprintf(&b, `, qop=%s, nc=%08x, cnonce="%s"`, r.QOP, r.NonceCount, r.CNonce)
+	}
+	return b.String()
+}
+
+// Answer a `401 Unauthorized` or `407 Proxy Authentication Required` response to one of
+// our requests by re-sending it with credentials.
+// Returns false if the challenge could not be answered and the dialog should end.
+func (dls *dialogState) handleAuthChallenge(tx *transaction.Client, msg *sip.Msg) bool {
+	provider := dls.credentials
+	if provider == nil {
+		provider = dls.manager.credentials
+	}
+	if dls.nonceCounts == nil {
+		dls.nonceCounts = make(map[string]int)
+	}
+	request, err := dls.manager.authorize(tx.Request(), msg, provider, dls.nonceCounts)
+	if err != nil {
+		dls.reportError(err)
+		return false
+	}
+
+	// The new request is a new transaction, so it needs a new CSeq and branch.
+	request.Via = nil
+	dls.lSeq++
+	request.CSeq = dls.lSeq
+	request.CSeqMethod = request.Method
+	switch tx.Request() {
+	case dls.invite:
+		dls.invite = request
+	case dls.reinvite:
+		dls.reinvite = request
+	case dls.update:
+		dls.update = request
+		return dls.sendUpdateRequest(request)
+	case dls.pendingRefer():
+		dls.transfer.refer = request
+		return dls.sendRefer()
+	case dls.pendingInfo():
+		dls.info.request = request
+		return dls.sendInfo()
+	}
+	return dls.sendRequest(request)
+}
+
+// Build a copy of `request` with credentials that answer the challenge in `msg`.
+// The caller must give the copy a new CSeq and Via branch before sending it.
+func (m *Manager) authorize(request, msg *sip.Msg, provider CredentialProvider, nonceCounts map[string]int) (*sip.Msg, error) {
+	header := msg.WWWAuthenticate
+	if msg.Status == sip.StatusProxyAuthenticationRequired {
+		header = msg.ProxyAuthenticate
+	}
+
+	chal, err := ParseDigestChallenge(header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", err, &sip.ResponseError{Msg: msg})
+	}
+
+	// If we already answered a challenge for this realm and the server did not
+	// just tell us that our nonce is stale, the credentials must be wrong.
+	previous := request.Authorization
+	if msg.Status == sip.StatusProxyAuthenticationRequired {
+		previous = request.ProxyAuthorization
+	}
+	if previous != "" && !chal.Stale && strings.Contains(previous, `realm="`+chal.Realm+`"`) {
+		return nil, fmt.Errorf("%w: %w", ErrAuthCredentialsInvalid, &sip.ResponseError{Msg: msg})
+	}
+
+	var creds *Credentials
+	if provider != nil {
+		creds = provider(chal.Realm)
+	}
+	if creds == nil {
+		return nil, fmt.Errorf("%w %q: %w", ErrAuthNoCredentials, chal.Realm, &sip.ResponseError{Msg: msg})
+	}
+
+	nonceCounts[chal.Nonce]++
+
+	request = request.Copy()
+	var body []byte
+	if request.Payload != nil {
+		body = request.Payload.Data()
+	}
+	res, err := ComputeDigest(chal, creds, request.Method, request.Request.String(), body, nonceCounts[chal.Nonce], util.GenerateTag())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", err, &sip.ResponseError{Msg: msg})
+	}
+	if msg.Status == sip.StatusProxyAuthenticationRequired {
+		request.ProxyAuthorization = res.String()
+	} else {
+		request.Authorization = res.String()
+	}
+
+	m.logger.Debug(
+		"answering authentication challenge",
+		slog.Int("status", msg.Status),
+		slog.String("realm", chal.Realm),
+		slog.String("method", request.Method),
+	)
+	return request, nil
+}
@@ -0,0 +1,101 @@
+package dialog_test
+
+import (
+	"testing"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDigestChallenge(t *testing.T) {
+	chal, err := dialog.ParseDigestChallenge(`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`)
+	require.NoError(t, err)
+	assert.Equal(t, &dialog.DigestChallenge{
+		Realm:     "testrealm@host.com",
+		Nonce:     "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		Opaque:    "5ccc069c403ebaf9f0171e9517f40e41",
+		Algorithm: "MD5",
+		QOP:       []string{"auth", "auth-int"},
+	}, chal)
+
+	_, err = dialog.ParseDigestChallenge(`Basic realm="example"`)
+	assert.ErrorIs(t, err, dialog.ErrAuthNotDigest)
+}
+
+func TestComputeDigest(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge string
+		creds     dialog.Credentials
+		cnonce    string
+		response  string
+	}{
+		{
+			// RFC 2617 section 3.5
+			name:      "MD5",
+			challenge: `Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+			creds:     dialog.Credentials{Username: "Mufasa", Password: "Circle Of Life"},
+			cnonce:    "0a4f113b",
+			response:  "6629fae49393a05397450978507c4ef1",
+		},
+		{
+			// RFC 7616 section 3.9.1
+			name:      "SHA-256",
+			challenge: `Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+			creds:     dialog.Credentials{Username: "Mufasa", Password: "Circle of Life"},
+			cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			response:  "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chal, err := dialog.ParseDigestChallenge(test.challenge)
+			require.NoError(t, err)
+			res, err := dialog.ComputeDigest(chal, &test.creds, "GET", "/dir/index.html", nil, 1, test.cnonce)
+			require.NoError(t, err)
+			assert.Equal(t, test.response, res.Response)
+			assert.Contains(t, res.String(), "nc=00000001")
+			assert.Contains(t, res.String(), "qop=auth,")
+		})
+	}
+}
+
+// A challenged BYE is sent again with credentials, rather than ending the call locally
+func TestByeChallenged(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t, dialog.WithCredentials("alice", "secret"))
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	callee.respond(t, addr, invite, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = invite.To.Copy().Tag()
+		msg.Contact = &sip.Addr{Uri: callee.uri()}
+		msg.Payload = newTestSDP(5000)
+	})
+	w.waitState(t, dialog.StatusAnswered)
+	ack, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodAck, ack.Method)
+
+	d.Hangup()
+	bye, addr := callee.receive(t, seen)
+	require.Equal(t, sip.MethodBye, bye.Method)
+	callee.respond(t, addr, bye, sip.StatusUnauthorized, func(msg *sip.Msg) {
+		msg.WWWAuthenticate = `Digest realm="example.test", nonce="abc", qop="auth"`
+	})
+
+	retry, addr := callee.receive(t, seen)
+	require.Equal(t, sip.MethodBye, retry.Method)
+	assert.Greater(t, retry.CSeq, bye.CSeq)
+	assert.Contains(t, retry.Authorization, `username="alice"`)
+	callee.respond(t, addr, retry, sip.StatusOK, nil)
+	w.waitState(t, dialog.StatusHangup)
+}
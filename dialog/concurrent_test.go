@@ -0,0 +1,66 @@
+package dialog_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Set up and tear down many calls at once, hung up by either side,
+// so that `go test -race` can catch unsynchronized state
+func TestConcurrentCalls(t *testing.T) {
+	callee := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		watch(call.Dialog)
+		if !assert.NoError(t, call.Accept(call.RemoteSDP)) {
+			return
+		}
+		if call.Invite.Request.User == "callee-hangs-up" {
+			if _, err := call.Wait(context.Background()); err == nil {
+				call.Hangup()
+			}
+		}
+	}))
+	caller := newTestManager(t)
+
+	for i := 0; i < 20; i++ {
+		user := "caller-hangs-up"
+		if i%2 == 1 {
+			user = "callee-hangs-up"
+		}
+		t.Run(fmt.Sprintf("%s-%d", user, i), func(t *testing.T) {
+			t.Parallel()
+			invite := newTestInvite(callee)
+			invite.Request.User = user
+			d, err := caller.NewDialog(invite)
+			require.NoError(t, err)
+			w := watch(d)
+
+			w.waitState(t, dialog.StatusAnswered)
+			if user == "caller-hangs-up" {
+				// Hanging up twice at once is harmless
+				go d.Hangup()
+				d.Hangup()
+			}
+			w.waitState(t, dialog.StatusHangup)
+		})
+	}
+}
+
+func TestDialogCallIDInUse(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	invite := &sip.Msg{Method: sip.MethodInvite, Request: callee.uri(), CallID: "in-use", Payload: newTestSDP(4000)}
+	d, err := caller.NewDialog(invite)
+	require.NoError(t, err)
+	watch(d)
+	defer d.Hangup()
+
+	_, err = caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: callee.uri(), CallID: "in-use", Payload: newTestSDP(4002)})
+	assert.ErrorIs(t, err, dialog.ErrDialogExists)
+}
@@ -0,0 +1,93 @@
+package dialog
+
+import (
+	"context"
+	"errors"
+
+	"github.com/safermobility/sipmanager/sip"
+)
+
+var ErrCallCancelled = errors.New("the call was hung up before it was answered")
+
+// DialResult is the outcome of setting up a call, returned by `Dialog.Wait`
+type DialResult struct {
+	Status   Status   // `StatusAnswered`, or the state the call ended in
+	Response *sip.Msg // The final response to our INVITE, if one was received (nil for incoming calls)
+}
+
+// Dial sends the INVITE like `NewDialog`, and ties the call to `ctx`: if it is
+// cancelled before the call is answered the INVITE is cancelled, and if it is
+// cancelled afterwards the call is hung up. As with `NewDialog`, the dialog's
+// `OnEvent` queue must be read.
+func (m *Manager) Dial(ctx context.Context, invite *sip.Msg, opts ...DialogOption) (*Dialog, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, err := m.NewDialog(invite, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.Hangup()
+		case <-d.done:
+		}
+	}()
+	return d, nil
+}
+
+// Wait blocks until the call is answered or fails, or `ctx` is done.
+// The error is nil once the call is answered; otherwise it is `ctx.Err()`,
+// a `*sip.ResponseError` if the call was refused, `ErrCallCancelled` if it was
+// hung up first, or `ErrCallEnded`.
+func (d *Dialog) Wait(ctx context.Context) (*DialResult, error) {
+	select {
+	case <-d.answered:
+	case <-d.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.result, d.resultErr
+}
+
+// Record the outcome of the call setup for `Wait`, once the call is answered
+func (dls *dialogState) recordAnswer() {
+	d := dls.dialog
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.result != nil {
+		return
+	}
+	d.result = &DialResult{Status: StatusAnswered}
+	if !dls.incoming {
+		d.result.Response = dls.remote
+	}
+	close(d.answered)
+}
+
+// Record the outcome of the call setup for `Wait`, if the call ended without being answered
+func (dls *dialogState) recordFailure() {
+	d := dls.dialog
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.result != nil {
+		return
+	}
+	d.result = &DialResult{Status: dls.state}
+	if !dls.incoming {
+		d.result.Response = dls.inviteResponse
+	}
+	switch {
+	case dls.hangupCause == CauseNoAnswer:
+		d.resultErr = ErrNoAnswer
+	case dls.hangupChan == nil:
+		d.resultErr = ErrCallCancelled
+	case d.result.Response != nil && d.result.Response.Status >= sip.StatusMultipleChoices:
+		d.resultErr = &sip.ResponseError{Msg: d.result.Response}
+	default:
+		d.resultErr = ErrCallEnded
+	}
+}
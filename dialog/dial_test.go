@@ -0,0 +1,103 @@
+package dialog_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialAndWait(t *testing.T) {
+	callee := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		watch(call.Dialog)
+		assert.NoError(t, call.Accept(call.RemoteSDP))
+	}))
+	caller := newTestManager(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := caller.Dial(ctx, newTestInvite(callee))
+	require.NoError(t, err)
+	w := watch(d)
+
+	result, err := d.Wait(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, dialog.StatusAnswered, result.Status)
+	assert.Equal(t, sip.StatusOK, result.Response.Status)
+
+	// Once answered, cancelling the context hangs up
+	cancel()
+	w.waitState(t, dialog.StatusHangup)
+}
+
+func TestDialCancelled(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	ctx, cancel := context.WithCancel(context.Background())
+	d, err := caller.Dial(ctx, &sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	watch(d)
+
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	to := invite.To.Copy().Tag()
+	callee.respond(t, addr, invite, sip.StatusRinging, func(msg *sip.Msg) { msg.To = to })
+
+	cancel()
+	request, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodCancel, request.Method)
+	callee.respond(t, addr, request, sip.StatusOK, nil)
+	callee.respond(t, addr, invite, sip.StatusRequestTerminated, func(msg *sip.Msg) { msg.To = to })
+
+	result, err := d.Wait(context.Background())
+	assert.ErrorIs(t, err, dialog.ErrCallCancelled)
+	assert.Equal(t, dialog.StatusHangup, result.Status)
+	assert.Equal(t, sip.StatusRequestTerminated, result.Response.Status)
+}
+
+func TestDialCancelledBeforeProvisional(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	ctx, cancel := context.WithCancel(context.Background())
+	d, err := caller.Dial(ctx, &sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	// CANCEL has to wait for a provisional response (RFC 3261 section 9.1)
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	cancel()
+	waitCtx, stop := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer stop()
+	_, err = d.Wait(waitCtx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	to := invite.To.Copy().Tag()
+	callee.respond(t, addr, invite, sip.StatusRinging, func(msg *sip.Msg) { msg.To = to })
+	request, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodCancel, request.Method)
+
+	// The callee answers anyway, so the call is hung up
+	callee.respond(t, addr, request, sip.StatusOK, nil)
+	callee.respond(t, addr, invite, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = to
+		msg.Contact = &sip.Addr{Uri: callee.uri()}
+		msg.Payload = newTestSDP(5000)
+	})
+	ack, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodAck, ack.Method)
+	bye, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodBye, bye.Method)
+	callee.respond(t, addr, bye, sip.StatusOK, nil)
+	w.waitState(t, dialog.StatusHangup)
+}
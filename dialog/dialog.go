@@ -4,68 +4,174 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/safermobility/sipmanager/sdp"
 	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
 	"github.com/safermobility/sipmanager/util"
 )
 
 type Status int
 
+var ErrDialogExists = errors.New("a dialog with this Call-ID already exists")
+
 const (
-	StatusProceeding Status = iota + 1
-	StatusRinging
-	StatusAnswered
-	StatusHangup
-	StatusFailed
+	StatusProceeding  Status = iota + 1 // The INVITE is being handled
+	StatusRinging                       // The called UA is alerting the user
+	StatusEarlyMedia                    // A provisional response came with an SDP answer, for ringback or announcements
+	StatusRedirected                    // The call is being sent to a new target, after a 3xx response
+	StatusCancelling                    // We sent CANCEL for our INVITE, and are waiting for its final response
+	StatusAnswered                      // The call is established
+	StatusTerminating                   // We sent BYE, and are waiting for its response
+	StatusHangup                        // The call was answered, or cancelled, and is over; see `Event.Cause`
+	StatusFailed                        // The call ended without being answered; see `Event.Cause`
 )
 
 // The "public" interface of a SIP dialog
 type Dialog struct {
-	OnErr   <-chan error
-	OnState <-chan Status
-	OnPeer  <-chan *SDPWithContext
+	OnEvent <-chan *Event // Everything that happens to the dialog, in order; closed when it ends
 
 	doHangup   chan<- struct{}
-	hangupDone bool
+	doReinvite chan<- *reinviteRequest
+	doUpdate   chan<- *updateRequest
+	doTransfer chan<- *transferRequest
+	doInfo     chan<- *infoRequest
+	done       <-chan struct{}
+	answered   chan struct{} // Closed once the call is answered.
+	callID     sip.CallID
+	incoming   bool
+
+	mu           sync.Mutex  // Guards the fields below, which are mostly set by the dialog's goroutine
+	hangupDone   bool        // Whether the application has hung up.
+	id           DialogID    // Set once the dialog is established.
+	remoteTarget *sip.URI    // Set once the dialog is established.
+	result       *DialResult // Set once the call is answered, or ends without being answered.
+	resultErr    error       // Why the call was not answered.
+	endErr       error       // Set if the call ended without the remote UA confirming it.
+	state        Status      // The fields below are published by the dialog's goroutine, for `Snapshot`.
+	routeSet     *sip.Addr
+	localSeq     int
+	remoteSeq    int
+	localSDP     *sdp.SDP
+	remoteSDP    *sdp.SDP
 }
 
 type SDPWithContext struct {
-	Payload *sdp.SDP
-	Msg     *sip.Msg
+	Payload   *sdp.SDP
+	Msg       *sip.Msg
+	RemoteTag string // The tag of the remote UA that sent it, which tells forks of our INVITE apart
 }
 
 // The "internal" interface of a SIP dialog
 type dialogState struct {
-	manager         *Manager
-	errChan         chan<- error
-	stateChan       chan<- Status
-	peerChan        chan<- *SDPWithContext
-	hangupChan      <-chan struct{}
-	state           Status           // Current state of the dialog.
-	callID          sip.CallID       // The Call-ID header value to use for this dialog
-	dest            string           // Destination hostname (or IP).
-	addr            string           // Destination ip:port.
-	routes          *AddressRoute    // List of SRV addresses to attempt contacting, if not using a proxy.
-	invite          *sip.Msg         // Our INVITE that established the dialog.
-	remote          *sip.Msg         // Message from remote UA that established dialog.
-	request         *sip.Msg         // Current outbound request message.
-	requestResends  int              // Number of resends of message so far.
-	requestTimer    <-chan time.Time // Resend timer for message.
-	response        *sip.Msg         // Current outbound request message.
-	responseResends int              // Number of resends of message so far.
-	responseTimer   <-chan time.Time // Resend timer for message.
-	lSeq            int              // Local CSeq value.
-	rSeq            int              // Remote CSeq value.
+	manager          *Manager
+	events           chan<- *Event
+	droppedEvents    int      // Events dropped since the last one that was queued.
+	eventBacklog     []*Event // Events that are kept, waiting for room in the queue
+	hangupChan       <-chan struct{}
+	respondChan      <-chan *uasResponse     // Responses to an incoming INVITE requested by the application.
+	reinviteChan     <-chan *reinviteRequest // Re-INVITEs requested by the application.
+	updateChan       <-chan *updateRequest   // UPDATEs requested by the application.
+	transferChan     <-chan *transferRequest // Transfers requested by the application.
+	sendInfoChan     <-chan *infoRequest     // INFOs requested by the application.
+	responseChan     chan *clientResponse    // Responses received by our client transactions.
+	requestChan      chan *serverRequest     // Requests received from the remote UA.
+	doneChan         chan struct{}           // Closed when the dialog ends.
+	incoming         bool                    // Whether the remote UA sent the INVITE that established the dialog.
+	state            Status                  // Current state of the dialog.
+	callID           sip.CallID              // The Call-ID header value to use for this dialog
+	localTag         string                  // Our tag, which tells apart the dialogs that share a Call-ID.
+	dest             string                  // Destination hostname (or IP).
+	addr             string                  // Destination ip:port.
+	routes           *AddressRoute           // List of SRV addresses to attempt contacting, if not using a proxy.
+	invite           *sip.Msg                // The INVITE that established the dialog (sent by us, unless incoming).
+	inviteTx         *transaction.Client     // The client transaction of our INVITE.
+	inviteResponse   *sip.Msg                // The latest final response to our INVITE.
+	inviteServer     *transaction.Server     // The server transaction of the remote UA's INVITE, if incoming.
+	reinvite         *sip.Msg                // Our re-INVITE that is waiting for a final response.
+	reinviteOffer    *sdp.SDP                // The offer in our re-INVITE, kept until it is answered or rejected.
+	reinviteTimer    <-chan time.Time        // Fires when it is time to retry a re-INVITE after a 491.
+	reinviteServer   *transaction.Server     // The server transaction of the remote UA's re-INVITE, until it is answered.
+	reinviteRespond  <-chan *uasResponse     // The application's answer to the remote UA's re-INVITE.
+	update           *sip.Msg                // Our UPDATE that is waiting for a final response.
+	updateOffer      *sdp.SDP                // The offer in our UPDATE, if any.
+	updateServer     *transaction.Server     // The server transaction of the remote UA's UPDATE, until the application answers it.
+	updateRespond    <-chan *uasResponse     // The application's answer to the remote UA's UPDATE.
+	early            *sip.Msg                // The latest provisional response that created an early dialog for our INVITE.
+	earlyDialogs     map[string]*sip.Msg     // The latest provisional response of each early dialog, by To tag.
+	transfer         *transferState          // Our transfer of the remote UA that is in progress, if any.
+	replaces         *Dialog                 // The dialog to hang up once this one is established (RFC 3891).
+	referServer      *transaction.Server     // The server transaction of the remote UA's REFER, until the application answers it.
+	referRespond     <-chan *referAnswer     // The application's decision about the remote UA's REFER.
+	referProgress    <-chan *sip.Msg         // The progress of the call we placed for the remote UA's REFER, to NOTIFY it of.
+	referrer         *referSubscription      // Where to report the progress of this call, if it was placed for a REFER.
+	referFailure     *sip.Msg                // The last failure response to this call, if it was placed for a REFER.
+	info             *infoRequest            // Our INFO that is waiting for a final response, if any.
+	dialog           *Dialog                 // The public interface of this dialog, passed to handlers.
+	provisionalRSeqs map[string]int          // The RSeq of the last reliable provisional response, by To tag.
+	localSDP         *sdp.SDP                // The most recent SDP offer or answer that we sent.
+	remoteSDP        *sdp.SDP                // The most recent SDP offer or answer that the remote UA sent.
+	remote           *sip.Msg                // Message from remote UA that established dialog.
+	localAddr        *sip.Addr               // Our address in this dialog, including our tag.
+	remoteAddr       *sip.Addr               // The remote address in this dialog, including the remote tag.
+	remoteTarget     *sip.URI                // Where to send requests within this dialog (the remote Contact).
+	routeSet         *sip.Addr               // The Route headers for requests within this dialog.
+	request          *sip.Msg                // Outbound request being sent to the next route.
+	response         *sip.Msg                // 2xx response to an INVITE, resent until it is ACK'ed.
+	responseInterval time.Duration           // Current resend interval for the 2xx response.
+	responseDeadline time.Time               // When to give up on receiving an ACK for the 2xx response.
+	responseTimer    <-chan time.Time        // Resend timer for the 2xx response.
+	lSeq             int                     // Local CSeq value.
+	rSeq             int                     // Remote CSeq value.
+	cancelled        bool                    // Whether the remote UA sent CANCEL for its INVITE.
+	cancelling       bool                    // Whether we sent CANCEL for our INVITE.
+	cancelPending    bool                    // Whether to send CANCEL for our INVITE once it gets a provisional response.
+	hangupCause      Cause                   // Why we are ending the call, once we have decided to.
+	lastError        error                   // The last error reported to the application.
+	endError         error                   // Why our BYE or CANCEL failed, so the remote UA may not know the call ended.
+	hangupPending    bool                    // Whether to hang up as soon as our 200 to the remote's INVITE is ACK'ed.
+	credentials      CredentialProvider      // Overrides the manager's credentials for this dialog, if set.
+	nonceCounts      map[string]int          // Digest authentication nonce counts, by nonce.
+	sessionRequest   time.Duration           // The session interval we ask for in our INVITEs.
+	sessionInterval  time.Duration           // The negotiated session interval, or zero if there is no session timer.
+	sessionRefresher bool                    // Whether we are the one refreshing the session.
+	minSE            time.Duration           // The smallest session interval we accept.
+	sessionRefresh   <-chan time.Time        // Fires when it is time for us to refresh the session.
+	sessionExpire    <-chan time.Time        // Fires when the session expires without being refreshed.
+	redirectHandler  RedirectHandler         // Vets the targets of 3xx responses to our INVITE; if nil, they are all tried.
+	maxRedirects     int                     // How many 3xx responses to our INVITE to follow.
+	redirects        int                     // How many 3xx responses to our INVITE were followed.
+	redirectTargets  []*redirectTarget       // Targets from 3xx responses that were not tried yet, most preferred first.
+	triedTargets     map[string]bool         // Every target our INVITE was sent to, to detect redirect loops.
+	ringTimeout      time.Duration           // How long to wait for our INVITE to be answered; zero to wait forever.
+	maxDuration      time.Duration           // How long the call may last once answered; zero for no limit.
+	ringTimer        <-chan time.Time        // Fires when our INVITE has not been answered in time.
+	durationTimer    <-chan time.Time        // Fires when the call has lasted as long as it may.
+}
+
+// A response received by one of this dialog's client transactions
+type clientResponse struct {
+	tx  *transaction.Client
+	msg *sip.Msg
+}
+
+// A request received from the remote UA, with its server transaction (nil for ACK)
+type serverRequest struct {
+	tx  *transaction.Server
+	msg *sip.Msg
 }
 
 // Create a new SIP dialog record and send the INVITE
-func (m *Manager) NewDialog(invite *sip.Msg) (*Dialog, error) {
-	errChan := make(chan error)
-	stateChan := make(chan Status)
-	peerChan := make(chan *SDPWithContext)
+func (m *Manager) NewDialog(invite *sip.Msg, opts ...DialogOption) (*Dialog, error) {
+	events := make(chan *Event, m.eventQueue+eventReserve)
 	hangupChan := make(chan struct{})
+	reinviteChan := make(chan *reinviteRequest)
+	updateChan := make(chan *updateRequest)
+	transferChan := make(chan *transferRequest)
+	sendInfoChan := make(chan *infoRequest)
+	doneChan := make(chan struct{})
 
 	var callID sip.CallID
 	if invite.CallID == "" {
@@ -74,51 +180,146 @@ func (m *Manager) NewDialog(invite *sip.Msg) (*Dialog, error) {
 	} else {
 		callID = invite.CallID
 	}
+	// Our tag is needed from the start, in case the INVITE comes back to us (a hairpin)
+	m.populateFrom(invite)
 
 	dls := &dialogState{
-		manager:    m,
-		errChan:    errChan,
-		stateChan:  stateChan,
-		peerChan:   peerChan,
+		manager:      m,
+		events:       events,
+		responseChan: make(chan *clientResponse),
+		requestChan:  make(chan *serverRequest),
+		doneChan:     doneChan,
+		callID:       callID,
+		localTag:     tagOf(invite.From),
+		invite:       invite,
+		hangupChan:   hangupChan,
+		reinviteChan: reinviteChan,
+		updateChan:   updateChan,
+		transferChan: transferChan,
+		sendInfoChan: sendInfoChan,
+	}
+	dls.initSessionTimer()
+	dls.initLimits()
+	dls.initRedirects()
+	if payload, ok := invite.Payload.(*sdp.SDP); ok {
+		dls.localSDP = payload
+	}
+	for _, opt := range opts {
+		if err := opt(dls); err != nil {
+			return nil, err
+		}
+	}
+	dls.dialog = &Dialog{
+		OnEvent:    events,
+		doHangup:   hangupChan,
+		doReinvite: reinviteChan,
+		doUpdate:   updateChan,
+		doTransfer: transferChan,
+		doInfo:     sendInfoChan,
+		done:       doneChan,
+		answered:   make(chan struct{}),
 		callID:     callID,
-		invite:     invite,
-		hangupChan: hangupChan,
+	}
+	dls.publish()
+	if err := m.addDialog(dls); err != nil {
+		return nil, err
 	}
 	go dls.run()
 
-	m.dialogs[callID] = dls
-
-	return &Dialog{
-		OnErr:    errChan,
-		OnState:  stateChan,
-		OnPeer:   peerChan,
-		doHangup: hangupChan,
-	}, nil
+	return dls.dialog, nil
 }
 
-// Handle a SIP response message that was received from the remote side
-func (dls *dialogState) handleResponse(msg *sip.Msg) bool {
-	if !ResponseMatch(dls.request, msg) {
-		dls.manager.logger.Warn(
-			"received response doesn't match transaction",
-			slog.String("original_request", dls.request.String()),
+// Pass a response from one of our client transactions to the dialog's goroutine
+func (dls *dialogState) receiveResponse(tx *transaction.Client, msg *sip.Msg) {
+	select {
+	case dls.responseChan <- &clientResponse{tx, msg}:
+	case <-dls.doneChan:
+		if tx.Request().Method == sip.MethodInvite && msg.Status >= sip.StatusOK && msg.Status < sip.StatusMultipleChoices {
+			dls.handleLateAnswer(tx.Request(), msg)
+			return
+		}
+		dls.manager.logger.Debug(
+			"dropping response for a dialog that has ended",
 			slog.String("msg", msg.String()),
 		)
-		return true
+	}
+}
+
+// Pass a request from the remote UA to the dialog's goroutine
+func (dls *dialogState) receiveRequest(tx *transaction.Server, msg *sip.Msg) {
+	select {
+	case dls.requestChan <- &serverRequest{tx, msg}:
+	case <-dls.doneChan:
+		if tx == nil {
+			return
+		}
+		if err := tx.Respond(dls.manager.NewResponse(msg, sip.StatusCallTransactionDoesNotExist)); err != nil {
+			dls.manager.logger.Error(
+				"unable to send '481 Call Transaction Does Not Exist' reply to incoming message",
+				util.SlogError(err),
+				slog.String("packet", msg.String()),
+			)
+		}
+	}
+}
+
+// Handle a SIP response message that was received from the remote side
+func (dls *dialogState) handleResponse(tx *transaction.Client, msg *sip.Msg) bool {
+	request := tx.Request()
+	if request.Method == sip.MethodInvite && request != dls.invite {
+		return dls.handleReinviteResponse(tx, msg)
+	}
+	if request.Method == sip.MethodPrack {
+		return dls.handlePrackResponse(tx, msg)
+	}
+	if request.Method == sip.MethodUpdate {
+		return dls.handleUpdateResponse(tx, msg)
+	}
+	if request.Method == sip.MethodRefer {
+		return dls.handleReferResponse(tx, msg)
+	}
+	if request.Method == sip.MethodNotify {
+		return dls.handleNotifyResponse(tx, msg)
+	}
+	if request.Method == sip.MethodInfo {
+		return dls.handleInfoResponse(tx, msg)
+	}
+	if request == dls.invite && dls.remote != nil && msg.Status >= sip.StatusOK && msg.Status < sip.StatusMultipleChoices {
+		return dls.handleExtraAnswer(request, msg)
+	}
+	if request == dls.invite && msg.Status >= sip.StatusOK {
+		dls.inviteResponse = msg
+	}
+	if request == dls.invite && dls.referrer != nil {
+		dls.reportReferProgress(msg)
+	}
+	if request == dls.invite && msg.Status > sip.StatusTrying && msg.Status < sip.StatusOK {
+		if !dls.acknowledgeProvisional(msg) {
+			return true
+		}
+		dls.trackEarlyDialog(msg)
+	}
+	if request == dls.invite && msg.Status < sip.StatusOK && dls.cancelPending {
+		dls.cancelPending = false
+		if !dls.cancel() {
+			return false
+		}
 	}
 
-	if msg.Status >= sip.StatusOK && dls.request.Method == sip.MethodInvite {
+	if msg.Status >= sip.StatusOK && msg.Status < sip.StatusMultipleChoices && request.Method == sip.MethodInvite {
+		// Only the ACK for a 2xx response is sent by the dialog;
+		// the transaction layer sends the ACK for any other final response.
 		if msg.Contact == nil {
-			dls.errChan <- errors.New("Remote UA sent >=200 response w/o Contact")
+			dls.reportError(errors.New("Remote UA sent >=200 response w/o Contact"))
 			return false
 		}
-		if err := dls.manager.Send(dls.manager.NewAck(msg, dls.request)); err != nil {
+		if err := dls.manager.Send(dls.manager.NewAck(msg, request)); err != nil {
 			dls.manager.logger.Error(
 				"unable to send ACK message",
 				util.SlogError(err),
 				slog.String("msg", msg.String()),
 			)
-			dls.errChan <- fmt.Errorf("unable to send ACK message: %w", err)
+			dls.reportError(fmt.Errorf("unable to send ACK message: %w", err))
 			return false
 		}
 	}
@@ -127,47 +328,97 @@ func (dls *dialogState) handleResponse(msg *sip.Msg) bool {
 		dls.checkSDP(msg)
 	}
 
-	dls.routes = nil
-	// If we got a response to our last message, we probably do not want to resend it.
-	// However, we cannot get rid of it yet because we may receive multiple responses (such as `Trying` then `Ringing`).
-	dls.requestTimer = nil
+	if request.Method == sip.MethodBye && msg.Status >= sip.StatusOK &&
+		msg.Status != sip.StatusUnauthorized && msg.Status != sip.StatusProxyAuthenticationRequired {
+		// RFC 3261 section 15.1.1: the session is over, whatever the response,
+		// unless the BYE has to be sent again with credentials
+		if msg.Status >= sip.StatusMultipleChoices && msg.Status != sip.StatusCallTransactionDoesNotExist {
+			dls.endFailed(&sip.ResponseError{Msg: msg})
+		}
+		dls.transition(StatusHangup, msg)
+		return false
+	}
+
 	switch msg.Status {
 	case sip.StatusTrying:
-		dls.transition(StatusProceeding)
+		if !dls.cancelling {
+			dls.transition(StatusProceeding, msg)
+		}
 	case sip.StatusRinging, sip.StatusSessionProgress:
-		dls.transition(StatusRinging)
+		if dls.cancelling {
+			break
+		}
+		if msg.Payload != nil {
+			dls.transition(StatusEarlyMedia, msg)
+		} else {
+			dls.transition(StatusRinging, msg)
+		}
 	case sip.StatusOK:
 		switch msg.CSeqMethod {
 		case sip.MethodInvite:
-			if dls.remote == nil {
-				dls.transition(StatusAnswered)
-			}
+			dls.localAddr = request.From
+			dls.remoteAddr = msg.To
+			dls.remoteTarget = msg.Contact.Uri
+			dls.routeSet = msg.RecordRoute.Reversed()
 			dls.remote = msg
-		case sip.MethodBye, sip.MethodCancel:
-			dls.transition(StatusHangup)
+			dls.startSessionTimer(msg, true)
+			dls.transition(StatusAnswered, msg)
+			if dls.cancelling || dls.cancelPending {
+				// The call was answered before our CANCEL could stop it
+				return dls.bye(CauseLocalHangup, nil)
+			}
+		case sip.MethodCancel:
+			// Wait for the final response to the INVITE: usually 487, but it may have been answered
+			return true
+		}
+	case sip.StatusServiceUnavailable, sip.StatusRequestTimeout:
+		if request == dls.invite && dls.cancelling {
+			dls.endFailed(&sip.ResponseError{Msg: msg})
+			dls.transition(StatusHangup, msg)
 			return false
 		}
-	case sip.StatusServiceUnavailable:
-		if dls.request == dls.invite {
+		if request == dls.invite && dls.routes != nil {
 			dls.manager.logger.Error(
-				"received '503 Service Unavailable' reply to 'INVITE'",
+				"no usable reply to 'INVITE', trying next route",
 				slog.String("packet", msg.String()),
 				slog.String("invite", dls.invite.String()),
 				slog.String("dest", dls.dest),
 				slog.String("addr", dls.addr),
 			)
 			return dls.popRoute()
+		} else if request == dls.invite {
+			return dls.inviteFailed(msg)
 		} else {
-			dls.errChan <- &sip.ResponseError{Msg: msg}
+			dls.reportError(&sip.ResponseError{Msg: msg})
+			return false
+		}
+	case sip.StatusRequestTerminated:
+		if request.Method == sip.MethodInvite && dls.cancelling {
+			dls.transition(StatusHangup, msg)
+			return false
+		}
+		if request == dls.invite {
+			return dls.inviteFailed(msg)
+		}
+		dls.reportError(&sip.ResponseError{Msg: msg})
+		return false
+	case sip.StatusUnauthorized, sip.StatusProxyAuthenticationRequired:
+		return dls.handleAuthChallenge(tx, msg)
+	case sip.StatusSessionIntervalTooSmall:
+		if request != dls.invite {
+			dls.reportError(&sip.ResponseError{Msg: msg})
 			return false
 		}
-	case sip.StatusMovedPermanently, sip.StatusMovedTemporarily:
-		dls.invite.Request = msg.Contact.Uri
-		dls.invite.Route = nil
-		return dls.sendRequest(dls.invite)
+		return dls.handleIntervalTooSmall(tx, msg)
 	default:
-		if msg.Status > sip.StatusOK {
-			dls.errChan <- &sip.ResponseError{Msg: msg}
+		if request == dls.invite && msg.Status >= sip.StatusMultipleChoices && msg.Status < sip.StatusBadRequest {
+			return dls.handleRedirect(msg)
+		}
+		if request == dls.invite && msg.Status >= sip.StatusBadRequest {
+			return dls.inviteFailed(msg)
+		}
+		if msg.Status > sip.StatusOK && request.Method != sip.MethodCancel {
+			dls.reportError(&sip.ResponseError{Msg: msg})
 			return false
 		}
 	}
@@ -175,9 +426,24 @@ func (dls *dialogState) handleResponse(msg *sip.Msg) bool {
 }
 
 // Handle a SIP request message that was received from the remote side
-func (dls *dialogState) handleRequest(msg *sip.Msg) bool {
+func (dls *dialogState) handleRequest(tx *transaction.Server, msg *sip.Msg) bool {
+	if msg.Method == sip.MethodAck {
+		// ACK has no transaction, and must never be responded to
+		if dls.incoming && dls.state < StatusAnswered {
+			return dls.handleInitialAck(msg)
+		}
+		// Re-INVITE response has been ACK'd.
+		if dls.response != nil && AckMatch(dls.response, msg) {
+			dls.response = nil
+			dls.responseTimer = nil
+			// With a "late offer", the answer to our offer in the 200 comes in the ACK
+			dls.checkSDP(msg)
+		}
+		return true
+	}
+
 	if msg.MaxForwards <= 0 {
-		if err := dls.manager.Send(dls.manager.NewResponse(msg, sip.StatusTooManyHops)); err != nil {
+		if err := tx.Respond(dls.manager.NewResponse(msg, sip.StatusTooManyHops)); err != nil {
 			dls.manager.logger.Error(
 				"unable to send '483 Too Many Hops' reply to incoming message",
 				util.SlogError(err),
@@ -185,16 +451,21 @@ func (dls *dialogState) handleRequest(msg *sip.Msg) bool {
 			)
 			return false
 		}
-		dls.errChan <- errors.New("Remote loop detected")
+		dls.reportError(errors.New("Remote loop detected"))
 		return false
 	}
 
+	if !dls.fromRemote(msg) {
+		// A request from another fork of our INVITE, whose dialog we have hung up
+		return dls.reply(tx, msg, sip.StatusCallTransactionDoesNotExist)
+	}
+
 	if dls.rSeq == 0 {
 		dls.rSeq = msg.CSeq
 	} else {
 		if msg.CSeq < dls.rSeq {
 			// RFC 3261 mandates a 500 response for out of order requests.
-			if err := dls.manager.Send(dls.manager.NewResponse(msg, sip.StatusInternalServerError)); err != nil {
+			if err := tx.Respond(dls.manager.NewResponse(msg, sip.StatusInternalServerError)); err != nil {
 				dls.manager.logger.Error(
 					"unable to send '500 Internal Server Error' reply to incoming out-of-sequence message",
 					util.SlogError(err),
@@ -209,7 +480,7 @@ func (dls *dialogState) handleRequest(msg *sip.Msg) bool {
 
 	switch msg.Method {
 	case sip.MethodBye:
-		if err := dls.manager.Send(dls.manager.NewResponse(msg, sip.StatusOK)); err != nil {
+		if err := tx.Respond(dls.manager.NewResponse(msg, sip.StatusOK)); err != nil {
 			dls.manager.logger.Error(
 				"unable to send '200 OK' reply to incoming 'BYE' message",
 				util.SlogError(err),
@@ -217,10 +488,11 @@ func (dls *dialogState) handleRequest(msg *sip.Msg) bool {
 			)
 			return false
 		}
-		dls.transition(StatusHangup)
+		dls.hangupCause = CauseRemoteHangup
+		dls.transition(StatusHangup, msg)
 		return false
 	case sip.MethodOptions: // Probably a keep-alive ping.
-		if err := dls.manager.Send(dls.manager.NewResponse(msg, sip.StatusOK)); err != nil {
+		if err := tx.Respond(dls.manager.NewResponse(msg, sip.StatusOK)); err != nil {
 			dls.manager.logger.Error(
 				"unable to send '200 OK' reply to incoming 'OPTIONS' message",
 				util.SlogError(err),
@@ -230,15 +502,30 @@ func (dls *dialogState) handleRequest(msg *sip.Msg) bool {
 		}
 		return true
 	case sip.MethodInvite: // Re-INVITEs are used to change the RTP or signalling path.
-		dls.remote = msg
-		dls.checkSDP(msg)
-		return dls.sendResponse(dls.manager.NewResponse(msg, sip.StatusOK))
-	case sip.MethodAck: // Re-INVITE response has been ACK'd.
-		dls.response = nil
-		dls.responseTimer = nil
+		return dls.handleReinvite(tx, msg)
+	case sip.MethodUpdate:
+		return dls.handleUpdate(tx, msg)
+	case sip.MethodNotify:
+		return dls.handleNotify(tx, msg)
+	case sip.MethodRefer:
+		return dls.handleRefer(tx, msg)
+	case sip.MethodInfo:
+		return dls.handleInfo(tx, msg)
+	case sip.MethodCancel:
+		if dls.incoming && dls.state < StatusAnswered && dls.manager.transactions.MatchCancel(msg) == dls.inviteServer {
+			return dls.handleCancel(tx, msg)
+		}
+		if err := tx.Respond(dls.manager.NewResponse(msg, sip.StatusOK)); err != nil {
+			dls.manager.logger.Error(
+				"unable to send '200 OK' reply to incoming 'CANCEL' message",
+				util.SlogError(err),
+				slog.String("packet", msg.String()),
+			)
+			return false
+		}
 		return true
 	default:
-		if err := dls.manager.Send(dls.manager.NewResponse(msg, sip.StatusMethodNotAllowed)); err != nil {
+		if err := tx.Respond(dls.manager.NewResponse(msg, sip.StatusMethodNotAllowed)); err != nil {
 			dls.manager.logger.Error(
 				"unable to send '405 Method Not Allowed' reply to incoming message",
 				util.SlogError(err),
@@ -250,26 +537,52 @@ func (dls *dialogState) handleRequest(msg *sip.Msg) bool {
 	}
 }
 
-// If this message has an SDP payload, pass it back to the application
+// If this message has an SDP payload, make it the remote UA's current SDP
+// and pass it back to the application
 func (dls *dialogState) checkSDP(msg *sip.Msg) {
 	if payload, ok := msg.Payload.(*sdp.SDP); ok {
-		dls.peerChan <- &SDPWithContext{payload, msg}
+		dls.remoteSDP = payload
+		dls.reportSDP(msg)
 	}
 }
 
-// Send the INVITE and run the loop that handles this dialog's resend timers
+// Report the SDP in a message without making it the remote UA's current SDP,
+// for an offer that we have not accepted yet
+func (dls *dialogState) reportSDP(msg *sip.Msg) {
+	if payload, ok := msg.Payload.(*sdp.SDP); ok {
+		tag := tagOf(msg.From)
+		if msg.IsResponse() {
+			tag = tagOf(msg.To)
+		}
+		dls.emit(&Event{Type: EventSDP, SDP: &SDPWithContext{Payload: payload, Msg: msg, RemoteTag: tag}})
+	}
+}
+
+// Send the INVITE (if this is an outgoing call) and run the loop that handles
+// every message and timer for this dialog
 func (dls *dialogState) run() {
 	defer dls.cleanup()
-	if !dls.sendRequest(dls.invite) {
-		return
+	if !dls.incoming {
+		if !dls.sendRequest(dls.invite) {
+			return
+		}
+		dls.startRingTimer()
 	}
 
-	// This loop handles re-sending non-ACK'ed messages and hangup requests
-	// It ends if there are errors doing so
+	// This loop handles incoming messages, re-sending non-ACK'ed responses, and hangup requests
+	// It ends when the dialog is over, or if there are errors
 	for {
+		dls.publish()
+		backlog, next := dls.backlogQueue()
 		select {
-		case <-dls.requestTimer:
-			if !dls.resendRequest() {
+		case backlog <- next:
+			dls.eventBacklog = dls.eventBacklog[1:]
+		case r := <-dls.responseChan:
+			if !dls.handleResponse(r.tx, r.msg) {
+				return
+			}
+		case r := <-dls.requestChan:
+			if !dls.handleRequest(r.tx, r.msg) {
 				return
 			}
 		case <-dls.responseTimer:
@@ -277,9 +590,68 @@ func (dls *dialogState) run() {
 				return
 			}
 		case <-dls.hangupChan:
+			// The application can only hang up once, and then the channel is closed
+			dls.hangupChan = nil
 			if !dls.hangup() {
 				return
 			}
+		case r := <-dls.respondChan:
+			if !dls.respond(r) {
+				return
+			}
+		case r := <-dls.reinviteChan:
+			if !dls.startReinvite(r) {
+				return
+			}
+		case <-dls.reinviteTimer:
+			if !dls.retryReinvite() {
+				return
+			}
+		case r := <-dls.reinviteRespond:
+			if !dls.answerReinvite(r) {
+				return
+			}
+		case r := <-dls.updateChan:
+			if !dls.startUpdate(r) {
+				return
+			}
+		case r := <-dls.updateRespond:
+			if !dls.answerUpdate(r) {
+				return
+			}
+		case r := <-dls.transferChan:
+			if !dls.startTransfer(r) {
+				return
+			}
+		case r := <-dls.sendInfoChan:
+			if !dls.startInfo(r) {
+				return
+			}
+		case a := <-dls.referRespond:
+			if !dls.answerRefer(a) {
+				return
+			}
+		case msg := <-dls.referProgress:
+			dls.sendReferNotify(msg)
+		case <-dls.sessionRefresh:
+			if !dls.refreshSession() {
+				return
+			}
+		case <-dls.sessionExpire:
+			if !dls.expireSession() {
+				return
+			}
+		case <-dls.ringTimer:
+			if !dls.noAnswer() {
+				return
+			}
+		case <-dls.durationTimer:
+			if !dls.maxDurationReached() {
+				return
+			}
+		case <-dls.manager.closed:
+			dls.reportError(ErrManagerClosed)
+			return
 		}
 
 		// If the state is "terminated" or "failed", the `BYE` has
@@ -290,17 +662,17 @@ func (dls *dialogState) run() {
 	}
 }
 
-// Prepares to send an INVITE or BYE message - saves it for retrying, and determines the route
+// Prepares to send an INVITE or BYE message, and determines the route
 func (dls *dialogState) sendRequest(request *sip.Msg) bool {
 	host, port, err := RouteMessage(nil, nil, request)
 	if err != nil {
-		dls.errChan <- err
+		dls.reportError(err)
 		return false
 	}
 	wantSRV := dls.state < StatusAnswered
 	routes, err := dls.manager.RouteAddress(host, port, wantSRV)
 	if err != nil {
-		dls.errChan <- err
+		dls.reportError(err)
 		return false
 	}
 	dls.request = request
@@ -309,11 +681,11 @@ func (dls *dialogState) sendRequest(request *sip.Msg) bool {
 	return dls.popRoute()
 }
 
-// Checks whether the route to the destination is valid, and updates the dialog state
-// with the new route, if needed.
+// Checks whether the route to the destination is valid, updates the dialog state
+// with the new route, and starts a new transaction to send the request there.
 func (dls *dialogState) popRoute() bool {
 	if dls.routes == nil {
-		dls.errChan <- errors.New("Failed to contact: " + dls.dest)
+		dls.reportError(errors.New("Failed to contact: " + dls.dest))
 		return false
 	}
 	dls.addr = dls.routes.Address
@@ -327,16 +699,18 @@ func (dls *dialogState) popRoute() bool {
 		dls.remote = nil
 		dls.lSeq = dls.request.CSeq
 	}
-	dls.requestResends = 0
-	dls.requestTimer = time.After(dls.manager.resendInterval)
-	if err := dls.manager.Send(dls.request); err != nil {
+	tx, err := dls.manager.transactions.Request(dls.request, dls.receiveResponse)
+	if err != nil {
 		dls.manager.logger.Error(
 			"error sending request message",
-			slog.Int("resends", dls.requestResends),
+			util.SlogError(err),
 			slog.String("packet", dls.request.String()),
 		)
 		return false
 	}
+	if dls.request == dls.invite {
+		dls.inviteTx = tx
+	}
 	return true
 }
 
@@ -352,19 +726,18 @@ func (dls *dialogState) populate(msg *sip.Msg) {
 	lHost := dls.manager.PublicAddress().String()
 	lPort := dls.manager.PublicPort()
 
+	// Every attempt is a new transaction, so it needs a new branch. The Via is
+	// copied first, because earlier transactions may still refer to the old one.
 	if msg.Via == nil {
 		msg.Via = &sip.Via{Host: lHost}
+	} else {
+		msg.Via = msg.Via.Copy()
 	}
 	msg.Via.Port = lPort
-	branch := msg.Via.Param.Get("branch")
-	if branch != nil {
-		branch.Value = util.GenerateBranch()
-	} else {
-		msg.Via.Param = &sip.Param{
-			Name:  "branch",
-			Value: util.GenerateBranch(),
-			Next:  msg.Via.Param,
-		}
+	msg.Via.Param = &sip.Param{
+		Name:  "branch",
+		Value: util.GenerateBranch(),
+		Next:  withoutParam(msg.Via.Param, "branch"),
 	}
 
 	if msg.Contact == nil {
@@ -379,62 +752,129 @@ func (dls *dialogState) populate(msg *sip.Msg) {
 		}
 	}
 
-	if msg.Method == sip.MethodInvite {
-		if ms, ok := msg.Payload.(*sdp.SDP); ok {
-			if ms.Addr == "" {
-				ms.Addr = lHost
-			}
-			if ms.Origin.Addr == "" {
-				ms.Origin.Addr = lHost
-			}
-			if ms.Origin.ID == "" {
-				ms.Origin.ID = util.GenerateOriginID()
-			}
+	switch msg.Method {
+	case sip.MethodInvite:
+		dls.populateSDP(msg)
+		msg.Supported = addOptionTag(msg.Supported, optionTag100rel)
+		msg.Allow = dls.manager.allow()
+		msg.RecvInfo = dls.manager.recvInfoHeader()
+		dls.addSessionTimer(msg)
+	case sip.MethodUpdate:
+		dls.populateSDP(msg)
+		if dls.state == StatusAnswered {
+			dls.addSessionTimer(msg)
 		}
 	}
 	dls.manager.PopulateMessage(nil, nil, msg)
 }
 
-func (dls *dialogState) resendRequest() bool {
-	// If there's nothing to send, or if we explicitly cancelled the resend timer,
-	// skip the rest of this and report success.
-	if dls.request == nil || dls.requestTimer == nil {
-		return true
+// Returns a copy of the parameter list without the named parameter
+func withoutParam(p *sip.Param, name string) *sip.Param {
+	if p == nil {
+		return nil
 	}
-	if dls.requestResends < dls.manager.maxResends {
-		if err := dls.manager.Send(dls.request); err != nil {
-			dls.manager.logger.Error(
-				"unable to resend message",
-				util.SlogError(err),
-				slog.String("packet", dls.request.String()),
-			)
-			return false
+	if p.Name == name {
+		return withoutParam(p.Next, name)
+	}
+	return &sip.Param{
+		Name:  p.Name,
+		Value: p.Value,
+		Next:  withoutParam(p.Next, name),
+	}
+}
+
+// Fill in the local address in an SDP payload, if it was not already set
+func (dls *dialogState) populateSDP(msg *sip.Msg) {
+	lHost := dls.manager.PublicAddress().String()
+
+	if ms, ok := msg.Payload.(*sdp.SDP); ok {
+		if ms.Addr == "" {
+			ms.Addr = lHost
 		}
-		dls.requestResends++
-		dls.requestTimer = time.After(dls.manager.resendInterval)
-	} else {
+		if ms.Origin.Addr == "" {
+			ms.Origin.Addr = lHost
+		}
+		if ms.Origin.ID == "" {
+			ms.Origin.ID = util.GenerateOriginID()
+		}
+	}
+}
+
+// Build a new request within this dialog, using the route set and remote target
+func (dls *dialogState) newRequest(method string) *sip.Msg {
+	dls.lSeq++
+	return &sip.Msg{
+		Method:     method,
+		Request:    dls.remoteTarget,
+		From:       dls.localAddr,
+		To:         dls.remoteAddr,
+		CallID:     dls.callID,
+		CSeq:       dls.lSeq,
+		CSeqMethod: method,
+		Route:      dls.routeSet,
+	}
+}
+
+// Build a new request within the early dialog created by a provisional response to our INVITE
+func (dls *dialogState) earlyRequest(method string, provisional *sip.Msg) *sip.Msg {
+	dls.lSeq++
+	request := &sip.Msg{
+		Method:     method,
+		Request:    dls.invite.Request,
+		From:       dls.invite.From,
+		To:         provisional.To,
+		CallID:     dls.callID,
+		CSeq:       dls.lSeq,
+		CSeqMethod: method,
+		Route:      provisional.RecordRoute.Reversed(),
+	}
+	if provisional.Contact != nil {
+		request.Request = provisional.Contact.Uri
+	}
+	return request
+}
+
+// Send a request within the dialog as its own transaction, without the route
+// selection and retries used for the INVITE
+func (dls *dialogState) sendInDialog(request *sip.Msg) error {
+	dls.populate(request)
+	if _, err := dls.manager.transactions.Request(request, dls.receiveResponse); err != nil {
 		dls.manager.logger.Error(
-			"timeout sending request message",
-			slog.Int("resends", dls.requestResends),
-			slog.String("packet", dls.request.String()),
-			slog.String("dest", dls.dest),
-			slog.String("addr", dls.addr),
+			fmt.Sprintf("unable to send '%s' message", request.Method),
+			util.SlogError(err),
+			slog.String("packet", request.String()),
 		)
-		if !dls.popRoute() {
-			return false
-		}
+		return err
+	}
+	return nil
+}
+
+// sendResponse sends a response through its server transaction.
+// A 2xx response to an INVITE is then resent until it is ACK'ed (RFC 3261 section 13.3.1.4).
+func (dls *dialogState) sendResponse(tx *transaction.Server, msg *sip.Msg) bool {
+	if err := tx.Respond(msg); err != nil {
+		dls.manager.logger.Error(
+			"unable to send response",
+			util.SlogError(err),
+			slog.String("packet", msg.String()),
+		)
+		return false
+	}
+	if msg.CSeqMethod == sip.MethodInvite && msg.Status >= sip.StatusOK && msg.Status < sip.StatusMultipleChoices {
+		t1 := dls.manager.transactions.Timers().T1
+		dls.response = msg
+		dls.responseInterval = t1
+		dls.responseDeadline = time.Now().Add(64 * t1)
+		dls.responseTimer = time.After(t1)
 	}
 	return true
 }
 
-// sendResponse is used to reliably send a response to an INVITE only.
-func (dls *dialogState) sendResponse(msg *sip.Msg) bool {
-	dls.response = msg
-	dls.responseResends = 0
-	dls.responseTimer = time.After(dls.manager.resendInterval)
-	if err := dls.manager.Send(dls.response); err != nil {
+// Reply to a request with just a status code
+func (dls *dialogState) reply(tx *transaction.Server, msg *sip.Msg, status int) bool {
+	if err := tx.Respond(dls.manager.NewResponse(msg, status)); err != nil {
 		dls.manager.logger.Error(
-			"unable to send response to INVITE",
+			fmt.Sprintf("unable to send '%d %s' reply to incoming '%s' message", status, sip.Phrase(status), msg.Method),
 			util.SlogError(err),
 			slog.String("packet", msg.String()),
 		)
@@ -449,59 +889,105 @@ func (dls *dialogState) resendResponse() bool {
 	if dls.response == nil || dls.responseTimer == nil {
 		return true
 	}
-	if dls.responseResends < dls.manager.maxResends {
-		if err := dls.manager.Send(dls.response); err != nil {
-			dls.manager.logger.Error(
-				"unable to resend response",
-				util.SlogError(err),
-				slog.String("packet", dls.response.String()),
-			)
-			return false
-		}
-		dls.responseResends++
-		dls.responseTimer = time.After(dls.manager.resendInterval)
-	} else {
-		// TODO(jart): If resending INVITE 200 OK, start sending BYE.
+	if time.Now().After(dls.responseDeadline) {
+		return dls.handleAckTimeout()
+	}
+	if err := dls.manager.Send(dls.response); err != nil {
 		dls.manager.logger.Error(
-			"timeout sending response message",
-			slog.Int("resends", dls.responseResends),
+			"unable to resend response",
+			util.SlogError(err),
 			slog.String("packet", dls.response.String()),
-			slog.String("dest", dls.dest),
-			slog.String("addr", dls.addr),
 		)
-		if !dls.popRoute() {
-			return false
-		}
+		return false
 	}
+	dls.responseInterval = min(2*dls.responseInterval, dls.manager.transactions.Timers().T2)
+	dls.responseTimer = time.After(dls.responseInterval)
 	return true
 }
 
-func (dls *dialogState) transition(state Status) {
-	dls.state = state
-	dls.stateChan <- state
+// The remote UA never acknowledged our 2xx response to its INVITE
+func (dls *dialogState) handleAckTimeout() bool {
+	dls.manager.logger.Error(
+		"timeout waiting for ACK of 2xx response to INVITE",
+		slog.String("packet", dls.response.String()),
+		slog.String("dest", dls.dest),
+		slog.String("addr", dls.addr),
+	)
+	dls.response = nil
+	dls.responseTimer = nil
+	dls.reportError(ErrAckTimeout)
+
+	// RFC 3261 section 13.3.1.4: the dialog is confirmed, but the session should be ended
+	dls.state = StatusAnswered
+	return dls.bye(CauseTimeout, nil)
+}
+
+// End the established call with a BYE, telling the remote UA why if `reason` is set
+func (dls *dialogState) bye(cause Cause, reason *sip.Reason) bool {
+	dls.hangupCause = cause
+	dls.transition(StatusTerminating, nil)
+	bye := dls.newRequest(sip.MethodBye)
+	bye.Reason = reason
+	return dls.sendRequest(bye)
 }
 
 func (dls *dialogState) cleanup() {
-	close(dls.errChan)
-	close(dls.stateChan)
-	close(dls.peerChan)
-	delete(dls.manager.dialogs, dls.callID)
+	if dls.transfer != nil {
+		dls.finishTransfer(TransferStatusFailed, ErrCallEnded)
+	}
+	if dls.referrer != nil {
+		dls.endReferProgress()
+	}
+	if dls.info != nil {
+		dls.finishInfo(ErrCallEnded)
+	}
+	if dls.state < StatusHangup {
+		// The dialog gave up, usually after reporting an error
+		var rerr *sip.ResponseError
+		var msg *sip.Msg
+		if errors.As(dls.lastError, &rerr) {
+			msg = rerr.Msg
+		}
+		if dls.state == StatusTerminating || dls.cancelling {
+			// We could not send our BYE or CANCEL, or it got no final response
+			dls.endError = dls.lastError
+		}
+		if dls.state < StatusAnswered {
+			dls.transition(StatusFailed, msg)
+		} else {
+			dls.transition(StatusHangup, msg)
+		}
+	}
+	dls.recordFailure()
+	dls.publish()
+	close(dls.doneChan)
+	if len(dls.eventBacklog) > 0 {
+		go flushEvents(dls.events, dls.eventBacklog, dls.manager.logger)
+	} else {
+		close(dls.events)
+	}
+	dls.manager.removeDialog(dls)
 }
 
 func (dls *dialogState) hangup() bool {
+	if dls.hangupCause == CauseNone {
+		dls.hangupCause = CauseLocalHangup
+	}
 	switch dls.state {
-	case StatusProceeding, StatusRinging:
-		if err := dls.manager.Send(dls.manager.NewCancel(dls.invite)); err != nil {
-			dls.manager.logger.Error(
-				"unable to send 'CANCEL' message",
-				util.SlogError(err),
-				slog.String("invite", dls.invite.String()),
-			)
-			return false
+	case StatusProceeding, StatusRinging, StatusEarlyMedia:
+		if dls.incoming {
+			if dls.response != nil {
+				// We have to wait for the ACK of our 200 before we are allowed to send a BYE.
+				dls.hangupPending = true
+				return true
+			}
+			return dls.respond(&uasResponse{status: sip.StatusDecline})
 		}
-		return true
+		return dls.cancel()
 	case StatusAnswered:
-		return dls.sendRequest(dls.manager.NewBye(dls.invite, dls.remote, &dls.lSeq))
+		return dls.bye(dls.hangupCause, nil)
+	case StatusCancelling, StatusTerminating:
+		return true
 	case StatusHangup:
 		dls.manager.logger.Error(
 			"trying to hang up a call that is already hung up",
@@ -511,16 +997,49 @@ func (dls *dialogState) hangup() bool {
 		//  o  A UA or proxy cannot send CANCEL for a transaction until it gets a
 		//     provisional response for the request.  This was allowed in RFC 2543
 		//     but leads to potential race conditions.
-		dls.transition(StatusHangup)
+		if !dls.incoming && dls.inviteTx != nil {
+			dls.cancelPending = true
+			return true
+		}
+		dls.transition(StatusHangup, nil)
 		return false
 	}
 }
 
+// Send CANCEL for our INVITE
+func (dls *dialogState) cancel() bool {
+	cancel := dls.manager.NewCancel(dls.invite)
+	if _, err := dls.manager.transactions.Request(cancel, dls.receiveResponse); err != nil {
+		dls.manager.logger.Error(
+			"unable to send 'CANCEL' message",
+			util.SlogError(err),
+			slog.String("invite", dls.invite.String()),
+		)
+		return false
+	}
+	dls.cancelling = true
+	dls.transition(StatusCancelling, nil)
+	return true
+}
+
 func (d *Dialog) Hangup() {
+	d.mu.Lock()
 	if d.hangupDone {
+		d.mu.Unlock()
 		return
 	}
 	d.hangupDone = true
-	d.doHangup <- struct{}{}
+	d.mu.Unlock()
+	select {
+	case d.doHangup <- struct{}{}:
+	case <-d.done:
+	}
 	close(d.doHangup)
 }
+
+// Whether the application has hung up
+func (d *Dialog) hangingUp() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.hangupDone
+}
@@ -0,0 +1,391 @@
+package dialog_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sdp"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTimeout = 5 * time.Second
+
+// Create a manager that listens on a random loopback port
+func newTestManager(t *testing.T, opts ...dialog.ManagerOption) *dialog.Manager {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	opts = append([]dialog.ManagerOption{
+		dialog.WithListenString("127.0.0.1:0"),
+		dialog.WithGroupLogger(logger, ""),
+		dialog.WithTransactionTimers(50*time.Millisecond, 200*time.Millisecond, 250*time.Millisecond),
+	}, opts...)
+	m, err := dialog.NewManager(opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// Build an INVITE addressed to the manager `to`
+func newTestInvite(to *dialog.Manager) *sip.Msg {
+	return &sip.Msg{
+		Method: sip.MethodInvite,
+		Request: &sip.URI{
+			Scheme: "sip",
+			User:   "bob",
+			Host:   to.PublicAddress().String(),
+			Port:   to.PublicPort(),
+		},
+		Payload: sdp.New(
+			&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000},
+			&sdp.ULAWCodec,
+		),
+	}
+}
+
+func newTestSDP(port int) *sdp.SDP {
+	return sdp.New(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, &sdp.ULAWCodec)
+}
+
+// Sorts the events of a dialog by type, reading them as they come
+type watcher struct {
+	states  chan dialog.Status
+	errs    chan error
+	peers   chan *dialog.SDPWithContext
+	infos   chan *dialog.Info
+	earlies chan *dialog.EarlyDialog
+}
+
+func watch(d *dialog.Dialog) *watcher {
+	w := &watcher{
+		states:  make(chan dialog.Status, 16),
+		errs:    make(chan error, 16),
+		peers:   make(chan *dialog.SDPWithContext, 16),
+		infos:   make(chan *dialog.Info, 16),
+		earlies: make(chan *dialog.EarlyDialog, 16),
+	}
+	go func() {
+		for e := range d.OnEvent {
+			switch e.Type {
+			case dialog.EventState:
+				w.states <- e.State
+			case dialog.EventError:
+				w.errs <- e.Err
+			case dialog.EventSDP:
+				w.peers <- e.SDP
+			case dialog.EventInfo:
+				w.infos <- e.Info
+			case dialog.EventEarlyDialog:
+				w.earlies <- e.Early
+			}
+		}
+		close(w.states)
+		close(w.errs)
+		close(w.peers)
+		close(w.infos)
+		close(w.earlies)
+	}()
+	return w
+}
+
+// Wait until the dialog reports `want`, skipping intermediate states
+func (w *watcher) waitState(t *testing.T, want dialog.Status) {
+	t.Helper()
+	for {
+		select {
+		case state, ok := <-w.states:
+			require.True(t, ok, "dialog ended without reporting state %d", want)
+			if state == want {
+				return
+			}
+			require.Less(t, state, dialog.StatusHangup, fmt.Sprintf("dialog ended with state %d", state))
+		case <-time.After(testTimeout):
+			require.FailNow(t, "timeout waiting for dialog state")
+		}
+	}
+}
+
+// Wait for the next SDP received from the remote UA
+func (w *watcher) nextPeer(t *testing.T) *dialog.SDPWithContext {
+	t.Helper()
+	select {
+	case peer, ok := <-w.peers:
+		require.True(t, ok, "dialog ended without receiving SDP")
+		return peer
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for SDP")
+		return nil
+	}
+}
+
+// Wait for the next early dialog created by a provisional response
+func (w *watcher) nextEarly(t *testing.T) *dialog.EarlyDialog {
+	t.Helper()
+	select {
+	case early, ok := <-w.earlies:
+		require.True(t, ok, "dialog ended without an early dialog")
+		return early
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for early dialog")
+		return nil
+	}
+}
+
+// Wait for the next INFO received from the remote UA
+func (w *watcher) nextInfo(t *testing.T) *dialog.Info {
+	t.Helper()
+	select {
+	case info, ok := <-w.infos:
+		require.True(t, ok, "dialog ended without receiving INFO")
+		return info
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for INFO")
+		return nil
+	}
+}
+
+// Wait for the next error reported by the dialog
+func (w *watcher) nextErr(t *testing.T) error {
+	t.Helper()
+	select {
+	case err, ok := <-w.errs:
+		require.True(t, ok, "dialog ended without reporting an error")
+		return err
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for dialog error")
+		return nil
+	}
+}
+
+// A scripted SIP peer on a raw UDP socket
+type fakePeer struct {
+	conn *net.UDPConn
+}
+
+func newFakePeer(t *testing.T) *fakePeer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &fakePeer{conn: conn}
+}
+
+func (p *fakePeer) uri() *sip.URI {
+	addr := p.conn.LocalAddr().(*net.UDPAddr)
+	return &sip.URI{Scheme: "sip", Host: addr.IP.String(), Port: uint16(addr.Port)}
+}
+
+// Wait for the next request, skipping retransmissions of requests already seen
+func (p *fakePeer) receive(t *testing.T, seen map[string]bool) (*sip.Msg, *net.UDPAddr) {
+	t.Helper()
+	buf := make([]byte, 4096)
+	for {
+		require.NoError(t, p.conn.SetReadDeadline(time.Now().Add(testTimeout)))
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		require.NoError(t, err)
+		msg, err := sip.ParseMsg(buf[:n])
+		require.NoError(t, err)
+		key := fmt.Sprintf("%s %d", msg.Method, msg.CSeq)
+		if msg.IsResponse() || seen[key] {
+			continue
+		}
+		seen[key] = true
+		return msg, addr
+	}
+}
+
+func (p *fakePeer) respond(t *testing.T, addr *net.UDPAddr, req *sip.Msg, status int, edit func(*sip.Msg)) {
+	t.Helper()
+	msg := &sip.Msg{
+		Status:     status,
+		Phrase:     sip.Phrase(status),
+		Via:        req.Via,
+		From:       req.From,
+		To:         req.To,
+		CallID:     req.CallID,
+		CSeq:       req.CSeq,
+		CSeqMethod: req.Method,
+	}
+	if edit != nil {
+		edit(msg)
+	}
+	var b bytes.Buffer
+	msg.Append(&b)
+	_, err := p.conn.WriteToUDP(b.Bytes(), addr)
+	require.NoError(t, err)
+}
+
+// Send a request from the peer, filling in the headers that identify it
+func (p *fakePeer) send(t *testing.T, to *dialog.Manager, msg *sip.Msg) {
+	t.Helper()
+	var b bytes.Buffer
+	p.fill(msg).Append(&b)
+	p.write(t, to, b.Bytes())
+}
+
+// Fill in the headers that identify a request sent by the peer
+func (p *fakePeer) fill(msg *sip.Msg) *sip.Msg {
+	self := p.uri()
+	msg.Via = &sip.Via{Host: self.Host, Port: self.Port, Param: &sip.Param{Name: "branch", Value: "z9hG4bK-" + util.GenerateBranch()}}
+	if msg.Contact == nil {
+		msg.Contact = &sip.Addr{Uri: self}
+	}
+	if msg.CSeqMethod == "" {
+		msg.CSeqMethod = msg.Method
+	}
+	msg.MaxForwards = 70
+	return msg
+}
+
+// Send a raw message from the peer
+func (p *fakePeer) write(t *testing.T, to *dialog.Manager, data []byte) {
+	t.Helper()
+	_, err := p.conn.WriteToUDP(data, &net.UDPAddr{IP: to.PublicAddress().AsSlice(), Port: int(to.PublicPort())})
+	require.NoError(t, err)
+}
+
+// Wait for the next response to a request sent by the peer
+func (p *fakePeer) response(t *testing.T) *sip.Msg {
+	t.Helper()
+	buf := make([]byte, 4096)
+	for {
+		require.NoError(t, p.conn.SetReadDeadline(time.Now().Add(testTimeout)))
+		n, _, err := p.conn.ReadFromUDP(buf)
+		require.NoError(t, err)
+		msg, err := sip.ParseMsg(buf[:n])
+		require.NoError(t, err)
+		if msg.IsResponse() && msg.Status >= sip.StatusOK {
+			return msg
+		}
+	}
+}
+
+func TestCallAnsweredAndHungUp(t *testing.T) {
+	calls := make(chan *dialog.IncomingCall, 1)
+	callee := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		calls <- call
+	}))
+	caller := newTestManager(t)
+
+	out, err := caller.NewDialog(newTestInvite(callee))
+	require.NoError(t, err)
+
+	outW := watch(out)
+
+	var in *dialog.IncomingCall
+	select {
+	case in = <-calls:
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for incoming call")
+	}
+	inW := watch(in.Dialog)
+	require.NotNil(t, in.RemoteSDP)
+	require.NoError(t, in.Ring(nil))
+	require.NoError(t, in.Accept(in.RemoteSDP))
+
+	outW.waitState(t, dialog.StatusAnswered)
+	inW.waitState(t, dialog.StatusAnswered)
+
+	out.Hangup()
+	outW.waitState(t, dialog.StatusHangup)
+	inW.waitState(t, dialog.StatusHangup)
+}
+
+func TestCallRejected(t *testing.T) {
+	callee := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		watch(call.Dialog)
+		assert.NoError(t, call.Reject(sip.StatusBusyHere))
+	}))
+	caller := newTestManager(t)
+
+	out, err := caller.NewDialog(newTestInvite(callee))
+	require.NoError(t, err)
+
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, watch(out).nextErr(t), &rerr)
+	assert.Equal(t, sip.StatusBusyHere, rerr.Msg.Status)
+}
+
+func TestCancelMatchesInvite(t *testing.T) {
+	caller := newFakePeer(t)
+	calls := make(chan *dialog.IncomingCall, 1)
+	callee := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		calls <- call
+	}))
+
+	target := &sip.URI{Scheme: "sip", User: "bob", Host: callee.PublicAddress().String(), Port: callee.PublicPort()}
+	from := &sip.Addr{Uri: caller.uri(), Param: &sip.Param{Name: "tag", Value: "caller"}}
+	invite := &sip.Msg{
+		Method:  sip.MethodInvite,
+		Request: target,
+		From:    from,
+		To:      &sip.Addr{Uri: target},
+		CallID:  "cancel-test",
+		CSeq:    1,
+		Payload: newTestSDP(4000),
+	}
+	caller.send(t, callee, invite)
+	call := <-calls
+	in := watch(call.Dialog)
+
+	// A CANCEL from another transaction of the same call matches no INVITE
+	cancel := func() *sip.Msg {
+		return &sip.Msg{Method: sip.MethodCancel, Request: target, From: from, To: invite.To, CallID: invite.CallID, CSeq: 1}
+	}
+	caller.send(t, callee, cancel())
+	response := caller.response(t)
+	assert.Equal(t, sip.StatusCallTransactionDoesNotExist, response.Status)
+	assert.Equal(t, dialog.StatusProceeding, call.Dialog.Snapshot().State)
+
+	// The CANCEL of the INVITE ends the call
+	msg := caller.fill(cancel())
+	msg.Via = invite.Via
+	var b bytes.Buffer
+	msg.Append(&b)
+	caller.write(t, callee, b.Bytes())
+	statuses := map[string]int{}
+	for i := 0; i < 2; i++ {
+		response = caller.response(t)
+		statuses[response.CSeqMethod] = response.Status
+	}
+	assert.Equal(t, map[string]int{sip.MethodCancel: sip.StatusOK, sip.MethodInvite: sip.StatusRequestTerminated}, statuses)
+	in.waitState(t, dialog.StatusHangup)
+}
+
+func TestHairpinnedInvite(t *testing.T) {
+	calls := make(chan *dialog.IncomingCall, 1)
+	m := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		calls <- call
+	}))
+
+	// Our INVITE comes back to us, so both ends of the call share a Call-ID
+	out, err := m.NewDialog(newTestInvite(m))
+	require.NoError(t, err)
+	w := watch(out)
+	var call *dialog.IncomingCall
+	select {
+	case call = <-calls:
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for incoming call")
+	}
+	assert.Equal(t, out.CallID(), call.Dialog.CallID())
+	assert.NotSame(t, out, call.Dialog)
+	in := watch(call.Dialog)
+
+	require.NoError(t, call.Accept(newTestSDP(5000)))
+	w.waitState(t, dialog.StatusAnswered)
+	in.waitState(t, dialog.StatusAnswered)
+	assert.Len(t, m.Dialogs(), 2)
+
+	out.Hangup()
+	w.waitState(t, dialog.StatusHangup)
+	in.waitState(t, dialog.StatusHangup)
+}
@@ -0,0 +1,224 @@
+package dialog
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+)
+
+const (
+	defaultEventQueue = 64               // Events buffered for the application before they are dropped
+	eventReserve      = 16               // Room kept in the queue for the events that are not dropped
+	maxEventBacklog   = 256              // How many SDP and INFO events may wait for room, before they are dropped too
+	eventFlushTimeout = 30 * time.Second // How long the last events wait for room once the dialog has ended
+)
+
+type EventType int
+
+const (
+	EventState       EventType = iota + 1 // The dialog changed state: `Event.State`
+	EventSDP                              // SDP from the remote UA: `Event.SDP`
+	EventError                            // Something went wrong: `Event.Err`
+	EventInfo                             // An INFO from the remote UA, if enabled with `WithRecvInfo`: `Event.Info`
+	EventEarlyDialog                      // A provisional response to our INVITE created or updated an early dialog: `Event.Early`
+)
+
+// Cause classifies why a call failed or ended
+type Cause int
+
+const (
+	CauseNone           Cause = iota // Nothing went wrong
+	CauseLocalHangup                 // We hung up, cancelled our INVITE, or refused the remote UA's INVITE
+	CauseRemoteHangup                // The remote UA hung up, cancelled its INVITE, or forgot the dialog
+	CauseBusy                        // 486 Busy Here or 600 Busy Everywhere
+	CauseDeclined                    // 403 Forbidden or 603 Decline
+	CauseNotFound                    // 404 Not Found or 604 Does Not Exist Anywhere
+	CauseUnavailable                 // 480 Temporarily Unavailable or 503 Service Unavailable
+	CauseTimeout                     // No response (408 Request Timeout), or no ACK for our 2xx
+	CauseAuthentication              // We could not answer an authentication challenge
+	CauseRejected                    // Any other failure response
+	CauseSessionExpired              // The session was not refreshed in time (RFC 4028)
+	CauseShutdown                    // The manager was closed
+	CauseNoAnswer                    // Our INVITE was not answered in time (see `WithRingTimeout`), and was cancelled
+	CauseMaxDuration                 // The call lasted as long as it may (see `WithMaxCallDuration`), and was hung up
+	CauseOther                       // Any other error
+)
+
+// Event is something that happened to a dialog. Events are delivered in order on
+// `Dialog.OnEvent`, through a queue whose size is set by `WithEventQueue`.
+// If the application falls behind and the queue fills up, errors and early
+// dialogs are dropped (rather than holding up every other dialog of the manager)
+// until there is room again, and the next event delivered says how many were lost.
+// Changes of state, SDP and INFO (with its DTMF digits) are kept: room is kept
+// for them, and any that still do not fit wait in the dialog until they do.
+// Only a backlog of SDP and INFO longer than 256 events is dropped; it is also
+// abandoned if the application stops reading once the dialog has ended.
+type Event struct {
+	Type    EventType
+	Time    time.Time       // When the event happened
+	Msg     *sip.Msg        // The message that caused the event, if any
+	Code    int             // The status code of `Msg`, if it is a response
+	State   Status          // For `EventState`: the new state
+	Cause   Cause           // For `EventError`, and the final state of a call: why it failed or ended
+	SDP     *SDPWithContext // For `EventSDP`
+	Err     error           // For `EventError`
+	Info    *Info           // For `EventInfo`
+	Early   *EarlyDialog    // For `EventEarlyDialog`
+	Dropped int             // How many events were dropped just before this one, because the queue was full
+}
+
+// Queue an event for the application, without ever blocking the dialog.
+// `Dialog.Snapshot` is brought up to date first, so that it agrees with the event.
+func (dls *dialogState) emit(e *Event) {
+	dls.publish()
+	e.Time = time.Now()
+	if e.Msg != nil && e.Msg.IsResponse() {
+		e.Code = e.Msg.Status
+	}
+	room := cap(dls.events) - len(dls.events)
+	if !e.kept() {
+		room -= eventReserve
+	}
+	switch {
+	case len(dls.eventBacklog) == 0 && room > 0:
+		// Only the dialog's goroutine sends, so there is still room
+		e.Dropped = dls.droppedEvents
+		dls.droppedEvents = 0
+		dls.events <- e
+	case e.Type == EventState, e.kept() && len(dls.eventBacklog) < maxEventBacklog:
+		// Queued behind the others waiting for room, to keep them in order
+		e.Dropped = dls.droppedEvents
+		dls.droppedEvents = 0
+		dls.eventBacklog = append(dls.eventBacklog, e)
+	default:
+		dls.droppedEvents++
+		dls.manager.logger.Warn(
+			"dropping dialog event, because the application is not reading them",
+			slog.String("call-id", string(dls.callID)),
+			slog.Int("type", int(e.Type)),
+			slog.Int("dropped", dls.droppedEvents),
+		)
+	}
+}
+
+// Whether the event is kept when the queue is full: the changes of state, the SDP
+// that the application needs for media, and INFO requests such as DTMF digits
+func (e *Event) kept() bool {
+	switch e.Type {
+	case EventState, EventSDP, EventInfo:
+		return true
+	}
+	return false
+}
+
+// The queue to send the oldest event waiting for room to, or nil if none is waiting
+func (dls *dialogState) backlogQueue() (chan<- *Event, *Event) {
+	if len(dls.eventBacklog) == 0 {
+		return nil, nil
+	}
+	return dls.events, dls.eventBacklog[0]
+}
+
+// Deliver the events still waiting for room once the dialog has ended, and then
+// close the queue. If the application is no longer reading, they are dropped.
+func flushEvents(events chan<- *Event, backlog []*Event, logger *slog.Logger) {
+	timeout := time.NewTimer(eventFlushTimeout)
+	defer timeout.Stop()
+	for i, e := range backlog {
+		select {
+		case events <- e:
+		case <-timeout.C:
+			logger.Warn(
+				"dropping dialog events, because the application stopped reading them",
+				slog.Int("dropped", len(backlog)-i),
+			)
+			close(events)
+			return
+		}
+	}
+	close(events)
+}
+
+func (dls *dialogState) reportError(err error) {
+	dls.lastError = err
+	e := &Event{Type: EventError, Err: err, Cause: causeOf(err)}
+	var rerr *sip.ResponseError
+	if errors.As(err, &rerr) {
+		e.Msg = rerr.Msg
+	}
+	dls.emit(e)
+}
+
+// Report a new state. The final states also say why the call ended.
+func (dls *dialogState) transition(state Status, msg *sip.Msg) {
+	dls.state = state
+	if state == StatusAnswered {
+		dls.established()
+	}
+	e := &Event{Type: EventState, State: state, Msg: msg}
+	if state >= StatusHangup {
+		e.Cause = dls.endCause()
+	}
+	dls.emit(e)
+}
+
+// Our BYE or CANCEL failed: the call is over for us, but maybe not for the remote UA
+func (dls *dialogState) endFailed(err error) {
+	dls.reportError(err)
+	dls.endError = err
+}
+
+// Why the call ended: why our BYE or CANCEL failed, the reason we hung it up, or else the last error
+func (dls *dialogState) endCause() Cause {
+	if dls.endError != nil {
+		return causeOf(dls.endError)
+	}
+	if dls.hangupCause != CauseNone {
+		return dls.hangupCause
+	}
+	if dls.lastError != nil {
+		return causeOf(dls.lastError)
+	}
+	return CauseOther
+}
+
+func causeOf(err error) Cause {
+	switch {
+	case err == nil:
+		return CauseNone
+	case errors.Is(err, ErrAuthNotDigest), errors.Is(err, ErrAuthUnsupportedAlg), errors.Is(err, ErrAuthUnsupportedQOP),
+		errors.Is(err, ErrAuthNoCredentials), errors.Is(err, ErrAuthCredentialsInvalid):
+		return CauseAuthentication
+	case errors.Is(err, ErrSessionExpired):
+		return CauseSessionExpired
+	case errors.Is(err, ErrAckTimeout):
+		return CauseTimeout
+	case errors.Is(err, ErrManagerClosed):
+		return CauseShutdown
+	case errors.Is(err, ErrNoAnswer):
+		return CauseNoAnswer
+	}
+	var rerr *sip.ResponseError
+	if !errors.As(err, &rerr) {
+		return CauseOther
+	}
+	switch rerr.Msg.Status {
+	case sip.StatusBusyHere, sip.StatusBusyEverywhere:
+		return CauseBusy
+	case sip.StatusForbidden, sip.StatusDecline:
+		return CauseDeclined
+	case sip.StatusNotFound, sip.StatusDoesNotExistAnywhere:
+		return CauseNotFound
+	case sip.StatusTemporarilyUnavailable, sip.StatusServiceUnavailable:
+		return CauseUnavailable
+	case sip.StatusRequestTimeout:
+		return CauseTimeout
+	case sip.StatusUnauthorized, sip.StatusProxyAuthenticationRequired:
+		return CauseAuthentication
+	case sip.StatusCallTransactionDoesNotExist:
+		return CauseRemoteHangup
+	}
+	return CauseRejected
+}
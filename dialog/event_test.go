@@ -0,0 +1,123 @@
+package dialog_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nextEvent(t *testing.T, d *dialog.Dialog) *dialog.Event {
+	t.Helper()
+	select {
+	case e := <-d.OnEvent:
+		return e
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for dialog event")
+		return nil
+	}
+}
+
+// A dialog whose events are not read does not hold up the others
+func TestSlowEventConsumer(t *testing.T) {
+	callee := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		watch(call.Dialog)
+		assert.NoError(t, call.Ring(nil))
+		assert.NoError(t, call.Accept(call.RemoteSDP))
+	}))
+	caller := newTestManager(t, dialog.WithEventQueue(1))
+
+	slow, err := caller.NewDialog(newTestInvite(callee))
+	require.NoError(t, err)
+	result, err := slow.Wait(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, dialog.StatusAnswered, result.Status)
+
+	fast, err := caller.NewDialog(newTestInvite(callee))
+	require.NoError(t, err)
+	w := watch(fast)
+	w.waitState(t, dialog.StatusAnswered)
+	fast.Hangup()
+	w.waitState(t, dialog.StatusHangup)
+
+	// The early dialog did not fit in the queue, but no change of state or SDP was lost,
+	// and the next event says how many were
+	first := nextEvent(t, slow)
+	assert.Equal(t, dialog.EventState, first.Type)
+	assert.Equal(t, dialog.StatusProceeding, first.State)
+	assert.Zero(t, first.Dropped)
+	ringing := nextEvent(t, slow)
+	assert.Equal(t, dialog.EventState, ringing.Type)
+	assert.Equal(t, dialog.StatusRinging, ringing.State)
+	assert.Equal(t, 1, ringing.Dropped)
+	answer := nextEvent(t, slow)
+	require.Equal(t, dialog.EventSDP, answer.Type)
+	assert.NotNil(t, answer.SDP.Payload)
+	answered := nextEvent(t, slow)
+	assert.Equal(t, dialog.EventState, answered.Type)
+	assert.Equal(t, dialog.StatusAnswered, answered.State)
+	assert.Zero(t, answered.Dropped)
+
+	slow.Hangup()
+	next := nextEvent(t, slow)
+	assert.Equal(t, dialog.EventState, next.Type)
+	assert.Equal(t, dialog.StatusTerminating, next.State)
+	last := nextEvent(t, slow)
+	assert.Equal(t, dialog.StatusHangup, last.State)
+	assert.Equal(t, dialog.CauseLocalHangup, last.Cause)
+	_, ok := <-slow.OnEvent
+	assert.False(t, ok)
+}
+
+// Wait for the next event of type `want`, skipping the others
+func nextEventOf(t *testing.T, d *dialog.Dialog, want dialog.EventType) *dialog.Event {
+	t.Helper()
+	for {
+		e := nextEvent(t, d)
+		require.NotNil(t, e, "dialog ended without an event of type %d", want)
+		if e.Type == want {
+			return e
+		}
+	}
+}
+
+func TestEventContext(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+
+	invite, addr := callee.receive(t, map[string]bool{})
+	to := invite.To.Copy().Tag()
+	callee.respond(t, addr, invite, sip.StatusSessionProgress, func(msg *sip.Msg) {
+		msg.To = to
+		msg.Contact = &sip.Addr{Uri: callee.uri()}
+		msg.Payload = newTestSDP(5000)
+	})
+
+	early := nextEventOf(t, d, dialog.EventState)
+	assert.Equal(t, dialog.StatusEarlyMedia, early.State)
+	assert.Equal(t, sip.StatusSessionProgress, early.Code)
+	require.NotNil(t, early.Msg)
+	assert.Equal(t, invite.CallID, early.Msg.CallID)
+	assert.False(t, early.Time.IsZero())
+
+	callee.respond(t, addr, invite, sip.StatusBusyHere, func(msg *sip.Msg) { msg.To = to })
+
+	failure := nextEventOf(t, d, dialog.EventError)
+	assert.Equal(t, dialog.CauseBusy, failure.Cause)
+	assert.Equal(t, sip.StatusBusyHere, failure.Code)
+
+	final := nextEventOf(t, d, dialog.EventState)
+	assert.Equal(t, dialog.StatusFailed, final.State)
+	assert.Equal(t, dialog.CauseBusy, final.Cause)
+	assert.Equal(t, sip.StatusBusyHere, final.Code)
+	assert.False(t, final.Time.Before(early.Time))
+}
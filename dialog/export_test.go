@@ -0,0 +1,4 @@
+package dialog
+
+// Options that only tests may use
+var WithMinSE = withMinSE
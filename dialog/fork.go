@@ -0,0 +1,139 @@
+package dialog
+
+import (
+	"log/slog"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+// EarlyDialog is created by a provisional response to our INVITE. When a proxy
+// forks the INVITE, every UA that rings creates its own early dialog,
+// identified by the To tag of its responses.
+type EarlyDialog struct {
+	RemoteTag string   // The To tag of the UA that sent the provisional response
+	Msg       *sip.Msg // The provisional response that created or updated the early dialog
+}
+
+// Keep track of the early dialog of a provisional response to our INVITE,
+// and tell the application which fork it came from
+func (dls *dialogState) trackEarlyDialog(msg *sip.Msg) {
+	tag := tagOf(msg.To)
+	if tag == "" {
+		// No dialog is created without a To tag
+		return
+	}
+	if dls.earlyDialogs == nil {
+		dls.earlyDialogs = make(map[string]*sip.Msg)
+	}
+	dls.earlyDialogs[tag] = msg
+	if msg.Contact != nil {
+		dls.early = msg
+	}
+	dls.emit(&Event{Type: EventEarlyDialog, Early: &EarlyDialog{RemoteTag: tag, Msg: msg}})
+}
+
+// Handle a 2xx response to our INVITE once the dialog is already established by
+// an earlier one. A retransmission is ACK'ed again; a 2xx from another fork is
+// ACK'ed and then hung up, because only the first 2xx is accepted (RFC 3261 section 13.2.2.4).
+func (dls *dialogState) handleExtraAnswer(request, msg *sip.Msg) bool {
+	if tagOf(msg.To) == tagOf(dls.remoteAddr) {
+		dls.manager.ackAnswer(request, msg)
+		return true
+	}
+	dls.manager.logger.Info(
+		"hanging up additional answer from a forked INVITE",
+		slog.String("call-id", string(dls.callID)),
+		slog.String("tag", tagOf(msg.To)),
+	)
+	dls.manager.hangupAnswer(request, msg)
+	return true
+}
+
+// Handle a 2xx response to our INVITE that arrives once the dialog has ended,
+// such as from a fork that answers after we hung up. The INVITE transaction
+// still delivers these so that the dialogs they create can be ended.
+func (dls *dialogState) handleLateAnswer(request, msg *sip.Msg) {
+	// The dialog's goroutine has exited, so its state can be read here
+	if dls.state >= StatusAnswered && tagOf(msg.To) == tagOf(dls.remoteAddr) {
+		// A retransmission of the answer we accepted, whose BYE is already sent
+		dls.manager.ackAnswer(request, msg)
+		return
+	}
+	dls.manager.logger.Info(
+		"hanging up answer to a call that has ended",
+		slog.String("call-id", string(dls.callID)),
+		slog.String("tag", tagOf(msg.To)),
+	)
+	dls.manager.hangupAnswer(request, msg)
+}
+
+// Send an ACK for a 2xx response to our INVITE, reporting whether it was sent
+func (m *Manager) ackAnswer(request, msg *sip.Msg) bool {
+	if msg.Contact == nil {
+		m.logger.Warn(
+			"ignoring 2xx response without Contact",
+			slog.String("packet", msg.String()),
+		)
+		return false
+	}
+	if err := m.Send(m.NewAck(msg, request)); err != nil {
+		m.logger.Error(
+			"unable to send ACK message",
+			util.SlogError(err),
+			slog.String("msg", msg.String()),
+		)
+		return false
+	}
+	return true
+}
+
+// ACK a 2xx response to our INVITE that no dialog accepts, and send a BYE in
+// the dialog it created. The BYE's response goes to a handler of its own,
+// so that it does not end any dialog of ours.
+func (m *Manager) hangupAnswer(request, msg *sip.Msg) {
+	if !m.ackAnswer(request, msg) {
+		return
+	}
+	tag := tagOf(msg.To)
+	bye := &sip.Msg{
+		Method:     sip.MethodBye,
+		Request:    msg.Contact.Uri,
+		Via:        &sip.Via{Host: m.PublicAddress().String(), Port: m.PublicPort()},
+		From:       request.From,
+		To:         msg.To,
+		CallID:     msg.CallID,
+		CSeq:       request.CSeq + 1,
+		CSeqMethod: sip.MethodBye,
+		Route:      msg.RecordRoute.Reversed(),
+	}
+	m.PopulateMessage(nil, m.contact, bye)
+	_, err := m.transactions.Request(bye, func(tx *transaction.Client, response *sip.Msg) {
+		if response.Status >= sip.StatusOK {
+			m.logger.Debug(
+				"additional answer to our INVITE hung up",
+				slog.String("call-id", string(msg.CallID)),
+				slog.String("tag", tag),
+				slog.Int("status", response.Status),
+			)
+		}
+	})
+	if err != nil {
+		m.logger.Error(
+			"unable to send 'BYE' message",
+			util.SlogError(err),
+			slog.String("packet", bye.String()),
+		)
+	}
+}
+
+// Whether a request from the remote UA belongs to the dialog we accepted,
+// rather than to another fork of our INVITE
+func (dls *dialogState) fromRemote(msg *sip.Msg) bool {
+	if dls.remoteAddr == nil || dls.state < StatusAnswered {
+		// Early dialogs from every fork share this dialog until one of them answers
+		return true
+	}
+	return tagOf(msg.From) == tagOf(dls.remoteAddr)
+}
@@ -0,0 +1,132 @@
+package dialog_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForkedInvite(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+
+	// Two phones ring, and the second one sends early media
+	first, second := invite.To.Copy().Tag(), invite.To.Copy().Tag()
+	fork := func(to *sip.Addr, port int) func(*sip.Msg) {
+		return func(msg *sip.Msg) {
+			msg.To = to
+			msg.Contact = &sip.Addr{Uri: callee.uri()}
+			if port != 0 {
+				msg.Payload = newTestSDP(port)
+			}
+		}
+	}
+	callee.respond(t, addr, invite, sip.StatusRinging, fork(first, 0))
+	callee.respond(t, addr, invite, sip.StatusSessionProgress, fork(second, 5002))
+
+	assert.Equal(t, first.Param.Get("tag").Value, w.nextEarly(t).RemoteTag)
+	early := w.nextEarly(t)
+	assert.Equal(t, second.Param.Get("tag").Value, early.RemoteTag)
+	assert.Equal(t, sip.StatusSessionProgress, early.Msg.Status)
+	assert.Equal(t, early.RemoteTag, w.nextPeer(t).RemoteTag)
+
+	// The first phone answers, and is accepted
+	callee.respond(t, addr, invite, sip.StatusOK, fork(first, 5001))
+	w.waitState(t, dialog.StatusAnswered)
+	peer := w.nextPeer(t)
+	assert.Equal(t, first.Param.Get("tag").Value, peer.RemoteTag)
+	ack, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodAck, ack.Method)
+
+	// The second phone answers too, and is ACK'ed and hung up
+	callee.respond(t, addr, invite, sip.StatusOK, fork(second, 5002))
+	ack, _ = callee.receive(t, map[string]bool{})
+	require.Equal(t, sip.MethodAck, ack.Method)
+	assert.Equal(t, second.Param.Get("tag"), ack.To.Param.Get("tag"))
+	bye, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodBye, bye.Method)
+	assert.Equal(t, second.Param.Get("tag"), bye.To.Param.Get("tag"))
+	callee.respond(t, addr, bye, sip.StatusOK, nil)
+
+	// A request from the second phone does not reach the accepted dialog
+	callee.send(t, caller, &sip.Msg{
+		Method:  sip.MethodBye,
+		Request: invite.Contact.Uri,
+		From:    second,
+		To:      invite.From,
+		CallID:  invite.CallID,
+		CSeq:    1,
+	})
+	assert.Equal(t, sip.StatusCallTransactionDoesNotExist, callee.response(t).Status)
+
+	select {
+	case state := <-w.states:
+		assert.Fail(t, "unexpected state", "%d", state)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Each dialog has its own CSeq numbering
+	d.Hangup()
+	bye, _ = callee.receive(t, map[string]bool{})
+	require.Equal(t, sip.MethodBye, bye.Method)
+	assert.Equal(t, first.Param.Get("tag"), bye.To.Param.Get("tag"))
+	callee.respond(t, addr, bye, sip.StatusOK, nil)
+	w.waitState(t, dialog.StatusHangup)
+}
+
+func TestForkAnswersAfterHangup(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	first, second := invite.To.Copy().Tag(), invite.To.Copy().Tag()
+	answer := func(to *sip.Addr) func(*sip.Msg) {
+		return func(msg *sip.Msg) {
+			msg.To = to
+			msg.Contact = &sip.Addr{Uri: callee.uri()}
+			msg.Payload = newTestSDP(5000)
+		}
+	}
+
+	// The first phone answers, and the call is hung up right away
+	callee.respond(t, addr, invite, sip.StatusOK, answer(first))
+	w.waitState(t, dialog.StatusAnswered)
+	ack, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodAck, ack.Method)
+	d.Hangup()
+	bye, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodBye, bye.Method)
+	callee.respond(t, addr, bye, sip.StatusOK, nil)
+	w.waitState(t, dialog.StatusHangup)
+
+	// The second phone answers once the dialog has ended: it is ACK'ed and hung up too
+	callee.respond(t, addr, invite, sip.StatusOK, answer(second))
+	ack, _ = callee.receive(t, map[string]bool{})
+	require.Equal(t, sip.MethodAck, ack.Method)
+	assert.Equal(t, second.Param.Get("tag"), ack.To.Param.Get("tag"))
+	bye, _ = callee.receive(t, map[string]bool{})
+	require.Equal(t, sip.MethodBye, bye.Method)
+	assert.Equal(t, second.Param.Get("tag"), bye.To.Param.Get("tag"))
+	assert.Equal(t, invite.From.Param.Get("tag"), bye.From.Param.Get("tag"))
+	callee.respond(t, addr, bye, sip.StatusOK, nil)
+}
@@ -0,0 +1,306 @@
+package dialog
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/safermobility/sipmanager/sdp"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+var (
+	ErrCallAlreadyAnswered = errors.New("a final response has already been sent for this call")
+	ErrInvalidFinalStatus  = errors.New("a call can only be rejected with a status of 300 or higher")
+	ErrAckTimeout          = errors.New("timeout waiting for ACK of response to INVITE")
+	ErrCallEnded           = errors.New("the call has already ended")
+)
+
+// IncomingCallHandler is called (in a new goroutine) for every new INVITE received from a remote UA.
+// The handler must eventually call `Accept` or `Reject` on the call.
+type IncomingCallHandler func(*IncomingCall)
+
+// IncomingCall is a call from a remote UA that has not yet been answered.
+// It embeds the `Dialog` that will report the state of the call once it is accepted.
+type IncomingCall struct {
+	*Dialog
+
+	Invite    *sip.Msg // The INVITE received from the remote UA
+	RemoteSDP *sdp.SDP // The offer from the remote UA, or nil if the INVITE had no SDP
+	Replaces  *Dialog  // The call this one replaces (RFC 3891), which is hung up once this one is answered
+
+	respond     chan<- *uasResponse
+	respondMu   sync.Mutex // Held while sending a response, so only one final response gets through
+	finalSent   bool
+	maxDuration time.Duration // How long the call may last once answered; guarded by `respondMu`
+}
+
+// A response to an incoming INVITE, requested by the application
+type uasResponse struct {
+	status      int
+	payload     *sdp.SDP
+	maxDuration time.Duration // For a 2xx: how long the call may last
+}
+
+// Create a new SIP dialog record for an INVITE received from a remote UA,
+// and pass it to the application.
+func (m *Manager) handleIncomingInvite(tx *transaction.Server, msg *sip.Msg) {
+	events := make(chan *Event, m.eventQueue+eventReserve)
+	hangupChan := make(chan struct{})
+	reinviteChan := make(chan *reinviteRequest)
+	updateChan := make(chan *updateRequest)
+	transferChan := make(chan *transferRequest)
+	sendInfoChan := make(chan *infoRequest)
+	respondChan := make(chan *uasResponse)
+	doneChan := make(chan struct{})
+
+	localAddr := msg.To.Copy()
+	if localAddr.Param.Get("tag") == nil {
+		localAddr.Tag()
+	}
+
+	dls := &dialogState{
+		manager:      m,
+		events:       events,
+		hangupChan:   hangupChan,
+		respondChan:  respondChan,
+		reinviteChan: reinviteChan,
+		updateChan:   updateChan,
+		transferChan: transferChan,
+		sendInfoChan: sendInfoChan,
+		responseChan: make(chan *clientResponse),
+		requestChan:  make(chan *serverRequest),
+		doneChan:     doneChan,
+		incoming:     true,
+		state:        StatusProceeding,
+		callID:       msg.CallID,
+		localTag:     tagOf(localAddr),
+		invite:       msg,
+		inviteServer: tx,
+		remote:       msg,
+		localAddr:    localAddr,
+		remoteAddr:   msg.From,
+		routeSet:     msg.RecordRoute,
+		rSeq:         msg.CSeq,
+	}
+	if msg.Contact != nil {
+		dls.remoteTarget = msg.Contact.Uri
+	}
+	if payload, ok := msg.Payload.(*sdp.SDP); ok {
+		dls.remoteSDP = payload
+	}
+	dls.initSessionTimer()
+	dls.initLimits()
+	if !m.checkSessionInterval(tx, msg, dls.minSE) {
+		return
+	}
+	replaced, ok := m.checkReplaces(tx, msg)
+	if !ok {
+		return
+	}
+	dls.replaces = replaced
+
+	if err := tx.Respond(m.NewResponse(msg, sip.StatusTrying)); err != nil {
+		m.logger.Error(
+			"unable to send '100 Trying' reply to incoming 'INVITE' message",
+			util.SlogError(err),
+			slog.String("packet", msg.String()),
+		)
+		return
+	}
+
+	dls.dialog = &Dialog{
+		OnEvent:    events,
+		doHangup:   hangupChan,
+		doReinvite: reinviteChan,
+		doUpdate:   updateChan,
+		doTransfer: transferChan,
+		doInfo:     sendInfoChan,
+		done:       doneChan,
+		answered:   make(chan struct{}),
+		callID:     msg.CallID,
+		incoming:   true,
+	}
+	dls.publish()
+	if err := m.addDialog(dls); err != nil {
+		// A merged request that already has a dialog (RFC 3261 section 8.2.2.2),
+		// unless we are shutting down
+		status := sip.StatusLoopDetected
+		if errors.Is(err, ErrManagerClosed) {
+			status = sip.StatusServiceUnavailable
+		}
+		if err := tx.Respond(m.NewResponse(msg, status)); err != nil {
+			m.logger.Error(
+				fmt.Sprintf("unable to send '%d %s' reply to incoming 'INVITE' message", status, sip.Phrase(status)),
+				util.SlogError(err),
+				slog.String("packet", msg.String()),
+			)
+		}
+		return
+	}
+	go dls.run()
+
+	call := &IncomingCall{
+		Dialog:      dls.dialog,
+		Invite:      msg,
+		Replaces:    replaced,
+		respond:     respondChan,
+		maxDuration: m.maxDuration,
+	}
+	if payload, ok := msg.Payload.(*sdp.SDP); ok {
+		call.RemoteSDP = payload
+	}
+
+	go m.incomingCallHandler(call)
+}
+
+// Ring sends `180 Ringing`, with an optional SDP answer to establish early media
+func (c *IncomingCall) Ring(early *sdp.SDP) error {
+	return c.sendResponse(sip.StatusRinging, early)
+}
+
+// Progress sends `183 Session Progress`, with an optional SDP answer to establish early media
+func (c *IncomingCall) Progress(early *sdp.SDP) error {
+	return c.sendResponse(sip.StatusSessionProgress, early)
+}
+
+// Accept answers the call with `200 OK` and the given SDP answer.
+// The response is resent until the remote UA sends an ACK.
+func (c *IncomingCall) Accept(answer *sdp.SDP) error {
+	return c.sendResponse(sip.StatusOK, answer)
+}
+
+// Reject ends the call with the given (>=300) status
+func (c *IncomingCall) Reject(status int) error {
+	if status < sip.StatusMultipleChoices {
+		return ErrInvalidFinalStatus
+	}
+	return c.sendResponse(status, nil)
+}
+
+// SetMaxCallDuration overrides the manager's maximum call duration (`WithMaxCallDuration`)
+// for this call; zero lets it last forever. It must be called before `Accept`.
+func (c *IncomingCall) SetMaxCallDuration(duration time.Duration) error {
+	if duration < 0 {
+		return ErrCallLimitNotValid
+	}
+	c.respondMu.Lock()
+	defer c.respondMu.Unlock()
+	if c.finalSent {
+		return ErrCallAlreadyAnswered
+	}
+	c.maxDuration = duration
+	return nil
+}
+
+func (c *IncomingCall) sendResponse(status int, payload *sdp.SDP) error {
+	c.respondMu.Lock()
+	defer c.respondMu.Unlock()
+	if c.finalSent || c.hangingUp() {
+		return ErrCallAlreadyAnswered
+	}
+	select {
+	case c.respond <- &uasResponse{status: status, payload: payload, maxDuration: c.maxDuration}:
+		c.finalSent = status >= sip.StatusOK
+		return nil
+	case <-c.Dialog.done:
+		return ErrCallEnded
+	}
+}
+
+// Send a response to the INVITE that established this dialog
+func (dls *dialogState) respond(r *uasResponse) bool {
+	if dls.inviteServer.State() != transaction.StateProceeding {
+		dls.manager.logger.Error(
+			"trying to respond to an INVITE that already has a final response",
+			slog.Int("status", r.status),
+		)
+		return true
+	}
+
+	msg := dls.manager.NewResponse(dls.invite, r.status)
+	msg.To = dls.localAddr
+	if r.status < sip.StatusMultipleChoices {
+		msg.Contact = dls.manager.contact
+	}
+	if r.payload != nil {
+		msg.Payload = r.payload
+		dls.populateSDP(msg)
+		dls.localSDP = r.payload
+	}
+	if r.status >= sip.StatusOK && r.status < sip.StatusMultipleChoices {
+		dls.maxDuration = r.maxDuration
+		dls.answerSessionTimer(dls.invite, msg)
+		dls.startSessionTimer(msg, false)
+		msg.RecvInfo = dls.manager.recvInfoHeader()
+	}
+
+	if !dls.sendResponse(dls.inviteServer, msg) {
+		return false
+	}
+	switch {
+	case r.status < sip.StatusOK:
+		if r.payload != nil {
+			dls.transition(StatusEarlyMedia, msg)
+		} else if r.status == sip.StatusRinging {
+			dls.transition(StatusRinging, msg)
+		}
+	case r.status >= sip.StatusMultipleChoices:
+		// The transaction layer takes care of the ACK for this response
+		dls.endRejected(msg)
+		return false
+	}
+	return true
+}
+
+// The remote UA acknowledged our 2xx response to its INVITE
+func (dls *dialogState) handleInitialAck(msg *sip.Msg) bool {
+	if dls.response == nil || !AckMatch(dls.response, msg) {
+		return true
+	}
+	dls.response = nil
+	dls.responseTimer = nil
+
+	// With a "late offer", the answer to our offer in the 200 comes in the ACK
+	dls.checkSDP(msg)
+	dls.transition(StatusAnswered, msg)
+	if dls.hangupPending {
+		return dls.hangup()
+	}
+	return true
+}
+
+// The remote UA cancelled its INVITE before we sent a final response
+func (dls *dialogState) handleCancel(tx *transaction.Server, msg *sip.Msg) bool {
+	if err := tx.Respond(dls.manager.NewResponse(msg, sip.StatusOK)); err != nil {
+		dls.manager.logger.Error(
+			"unable to send '200 OK' reply to incoming 'CANCEL' message",
+			util.SlogError(err),
+			slog.String("packet", msg.String()),
+		)
+		return false
+	}
+	if dls.inviteServer.State() != transaction.StateProceeding {
+		// We already sent a final response, so the CANCEL has no effect
+		return true
+	}
+	dls.cancelled = true
+	return dls.respond(&uasResponse{status: sip.StatusRequestTerminated})
+}
+
+// Report the end of a call that was rejected by us or cancelled by the remote UA
+func (dls *dialogState) endRejected(response *sip.Msg) {
+	if dls.cancelled {
+		dls.hangupCause = CauseRemoteHangup
+		dls.transition(StatusHangup, response)
+		return
+	}
+	if dls.hangupCause == CauseNone {
+		dls.hangupCause = CauseLocalHangup
+	}
+	dls.transition(StatusFailed, response)
+}
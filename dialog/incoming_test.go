@@ -0,0 +1,133 @@
+package dialog_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newIncomingCallManager(t *testing.T) (*dialog.Manager, <-chan *dialog.IncomingCall) {
+	t.Helper()
+	calls := make(chan *dialog.IncomingCall, 1)
+	callee := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		calls <- call
+	}))
+	return callee, calls
+}
+
+// Wait for a call to reach the handler
+func nextIncomingCall(t *testing.T, calls <-chan *dialog.IncomingCall) *dialog.IncomingCall {
+	t.Helper()
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for incoming call")
+		return nil
+	}
+}
+
+// Send an INVITE from `caller` to `callee`, and wait for the call to reach the handler
+func sendTestInvite(t *testing.T, caller *fakePeer, callee *dialog.Manager, calls <-chan *dialog.IncomingCall, callID sip.CallID) (*sip.Msg, *dialog.IncomingCall) {
+	t.Helper()
+	target := &sip.URI{Scheme: "sip", User: "bob", Host: callee.PublicAddress().String(), Port: callee.PublicPort()}
+	invite := &sip.Msg{
+		Method:  sip.MethodInvite,
+		Request: target,
+		From:    &sip.Addr{Uri: caller.uri(), Param: &sip.Param{Name: "tag", Value: "caller"}},
+		To:      &sip.Addr{Uri: target},
+		CallID:  callID,
+		CSeq:    1,
+		Payload: newTestSDP(4000),
+	}
+	caller.send(t, callee, invite)
+	return invite, nextIncomingCall(t, calls)
+}
+
+// Wait for the next response to a request sent by the peer, including provisional ones
+func nextResponse(t *testing.T, p *fakePeer) *sip.Msg {
+	t.Helper()
+	buf := make([]byte, 4096)
+	for {
+		require.NoError(t, p.conn.SetReadDeadline(time.Now().Add(testTimeout)))
+		n, _, err := p.conn.ReadFromUDP(buf)
+		require.NoError(t, err)
+		msg, err := sip.ParseMsg(buf[:n])
+		require.NoError(t, err)
+		if msg.IsResponse() && msg.Status != sip.StatusTrying {
+			return msg
+		}
+	}
+}
+
+func TestIncomingCallAccepted(t *testing.T) {
+	callee, calls := newIncomingCallManager(t)
+	caller := newTestManager(t)
+
+	out, err := caller.NewDialog(newTestInvite(callee))
+	require.NoError(t, err)
+	w := watch(out)
+	call := nextIncomingCall(t, calls)
+	in := watch(call.Dialog)
+	require.NotNil(t, call.RemoteSDP)
+	assert.Equal(t, uint16(4000), call.RemoteSDP.Media[0].Port)
+
+	require.NoError(t, call.Ring(nil))
+	w.waitState(t, dialog.StatusRinging)
+	in.waitState(t, dialog.StatusRinging)
+
+	require.NoError(t, call.Accept(call.RemoteSDP))
+	assert.ErrorIs(t, call.Accept(call.RemoteSDP), dialog.ErrCallAlreadyAnswered)
+	w.waitState(t, dialog.StatusAnswered)
+	in.waitState(t, dialog.StatusAnswered)
+
+	out.Hangup()
+	w.waitState(t, dialog.StatusHangup)
+	in.waitState(t, dialog.StatusHangup)
+}
+
+func TestIncomingCallRejected(t *testing.T) {
+	callee, calls := newIncomingCallManager(t)
+	caller := newTestManager(t)
+
+	out, err := caller.NewDialog(newTestInvite(callee))
+	require.NoError(t, err)
+	w := watch(out)
+	call := nextIncomingCall(t, calls)
+	watch(call.Dialog)
+
+	assert.ErrorIs(t, call.Reject(sip.StatusOK), dialog.ErrInvalidFinalStatus)
+	// Only one of two concurrent final responses is sent
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- call.Reject(sip.StatusBusyHere) }()
+	}
+	assert.ElementsMatch(t, []error{nil, dialog.ErrCallAlreadyAnswered}, []error{<-errs, <-errs})
+
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, w.nextErr(t), &rerr)
+	assert.Equal(t, sip.StatusBusyHere, rerr.Msg.Status)
+}
+
+func TestIncomingCallCancelled(t *testing.T) {
+	callee, calls := newIncomingCallManager(t)
+	caller := newTestManager(t)
+
+	out, err := caller.NewDialog(newTestInvite(callee))
+	require.NoError(t, err)
+	w := watch(out)
+	call := nextIncomingCall(t, calls)
+	in := watch(call.Dialog)
+	require.NoError(t, call.Ring(nil))
+	w.waitState(t, dialog.StatusRinging)
+
+	// The caller gives up: its CANCEL is answered, and the INVITE ends with 487
+	out.Hangup()
+	in.waitState(t, dialog.StatusHangup)
+	w.waitState(t, dialog.StatusHangup)
+	assert.Error(t, call.Accept(call.RemoteSDP))
+}
@@ -0,0 +1,169 @@
+package dialog
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+)
+
+var (
+	ErrInfoPending            = errors.New("another INFO is already in progress for this call")
+	ErrInfoPackageUnsupported = errors.New("the remote UA is not willing to receive this Info Package")
+)
+
+// An INFO received from the remote UA (RFC 6086)
+type Info struct {
+	Package string      // The Info Package it belongs to, or empty for a "legacy" INFO
+	Payload sip.Payload // The body, if any
+	DTMF    *sip.DTMF   // The digit, if the body is `application/dtmf-relay` or `application/dtmf`
+	Msg     *sip.Msg
+}
+
+// An INFO requested by the application
+type infoRequest struct {
+	request *sip.Msg // Our INFO, until it has a final response
+	result  chan error
+}
+
+// SendInfo sends an INFO with `payload` to the remote UA, without an Info Package
+// (a "legacy" INFO), and waits for the response. A rejected INFO does not affect the call.
+func (d *Dialog) SendInfo(payload sip.Payload) error {
+	return d.SendInfoPackage("", payload)
+}
+
+// SendInfoPackage sends an INFO for the Info Package `pkg` to the remote UA, and waits
+// for the response. The remote UA must have listed `pkg` in its `Recv-Info` header.
+func (d *Dialog) SendInfoPackage(pkg string, payload sip.Payload) error {
+	request := &sip.Msg{Method: sip.MethodInfo, InfoPackage: pkg, Payload: payload}
+	r := &infoRequest{request: request, result: make(chan error, 1)}
+	select {
+	case d.doInfo <- r:
+	case <-d.done:
+		return ErrCallEnded
+	}
+	return <-r.result
+}
+
+// SendDTMF relays `digits` to the remote UA, one `application/dtmf-relay` INFO
+// at a time, for UAs that cannot receive RFC 4733 telephone events
+func (d *Dialog) SendDTMF(digits string, duration time.Duration) error {
+	for _, digit := range digits {
+		if err := d.SendInfo(&sip.DTMF{Signal: string(digit), Duration: int(duration.Milliseconds())}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start an INFO requested by the application, if the dialog is able to
+func (dls *dialogState) startInfo(r *infoRequest) bool {
+	pkg := r.request.InfoPackage
+	switch {
+	case dls.state != StatusAnswered:
+		r.result <- ErrCallNotAnswered
+		return true
+	case dls.info != nil:
+		r.result <- ErrInfoPending
+		return true
+	case pkg != "" && !hasOptionTag(dls.remote.RecvInfo, pkg):
+		r.result <- ErrInfoPackageUnsupported
+		return true
+	}
+
+	request := dls.newRequest(sip.MethodInfo)
+	request.InfoPackage = pkg
+	request.Payload = r.request.Payload
+	if pkg != "" {
+		// RFC 6086 section 4.2.1
+		request.ContentDisposition = "info-package"
+	}
+	r.request = request
+	dls.info = r
+	return dls.sendInfo()
+}
+
+// Start a transaction for our INFO (a new one after an authentication challenge)
+func (dls *dialogState) sendInfo() bool {
+	if err := dls.sendInDialog(dls.info.request); err != nil {
+		dls.finishInfo(err)
+	}
+	return true
+}
+
+// Our INFO that is waiting for a final response, if any
+func (dls *dialogState) pendingInfo() *sip.Msg {
+	if dls.info == nil {
+		return nil
+	}
+	return dls.info.request
+}
+
+// Handle a response to our INFO
+func (dls *dialogState) handleInfoResponse(tx *transaction.Client, msg *sip.Msg) bool {
+	if msg.Status < sip.StatusOK || tx.Request() != dls.pendingInfo() {
+		return true
+	}
+	switch {
+	case msg.Status == sip.StatusUnauthorized, msg.Status == sip.StatusProxyAuthenticationRequired:
+		return dls.handleAuthChallenge(tx, msg)
+	case msg.Status < sip.StatusMultipleChoices:
+		dls.finishInfo(nil)
+		return true
+	case msg.Status == sip.StatusCallTransactionDoesNotExist:
+		// RFC 3261 section 12.2.1.2: the dialog is gone
+		dls.finishInfo(&sip.ResponseError{Msg: msg})
+		dls.hangupCause = CauseRemoteHangup
+		dls.transition(StatusHangup, msg)
+		return false
+	default:
+		// RFC 6086 section 4.2.2: a rejected INFO does not change the dialog
+		dls.finishInfo(&sip.ResponseError{Msg: msg})
+		return true
+	}
+}
+
+// Report the outcome of our INFO to the application
+func (dls *dialogState) finishInfo(err error) {
+	dls.info.result <- err
+	dls.info = nil
+}
+
+// Handle an INFO from the remote UA
+func (dls *dialogState) handleInfo(tx *transaction.Server, msg *sip.Msg) bool {
+	if dls.manager.recvInfo == nil {
+		return dls.reply(tx, msg, sip.StatusMethodNotAllowed)
+	}
+	if msg.InfoPackage != "" && !dls.manager.receivesInfoPackage(msg.InfoPackage) {
+		// RFC 6086 section 4.2.2: tell the remote UA which packages we do receive
+		response := dls.manager.NewResponse(msg, sip.StatusBadInfoPackage)
+		response.RecvInfo = strings.Join(dls.manager.recvInfo, ", ")
+		return dls.sendResponse(tx, response)
+	}
+	if !dls.reply(tx, msg, sip.StatusOK) {
+		return false
+	}
+
+	info := &Info{
+		Package: msg.InfoPackage,
+		Payload: msg.Payload,
+		Msg:     msg,
+	}
+	if msg.Payload != nil {
+		info.DTMF, _ = sip.ParseDTMF(msg.Payload)
+	}
+	dls.emit(&Event{Type: EventInfo, Info: info})
+	return true
+}
+
+// Whether we are willing to receive INFOs for the Info Package `pkg`
+func (m *Manager) receivesInfoPackage(pkg string) bool {
+	for _, p := range m.recvInfo {
+		if strings.EqualFold(p, pkg) {
+			return true
+		}
+	}
+	return false
+}
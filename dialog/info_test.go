@@ -0,0 +1,49 @@
+package dialog_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendDTMF(t *testing.T) {
+	_, in, d := newTestCall(t, nil, []dialog.ManagerOption{dialog.WithRecvInfo()})
+
+	require.NoError(t, d.SendDTMF("5#", 160*time.Millisecond))
+	for _, digit := range []string{"5", "#"} {
+		info := in.nextInfo(t)
+		assert.Empty(t, info.Package)
+		require.NotNil(t, info.DTMF)
+		assert.Equal(t, digit, info.DTMF.Signal)
+		assert.Equal(t, 160, info.DTMF.Duration)
+	}
+}
+
+func TestInfoPackages(t *testing.T) {
+	_, in, d := newTestCall(t, nil, []dialog.ManagerOption{dialog.WithRecvInfo("foo")})
+
+	assert.ErrorIs(t, d.SendInfoPackage("bar", nil), dialog.ErrInfoPackageUnsupported)
+
+	payload := &sip.MiscPayload{T: "application/foo", D: []byte("hello")}
+	require.NoError(t, d.SendInfoPackage("foo", payload))
+	info := in.nextInfo(t)
+	assert.Equal(t, "foo", info.Package)
+	assert.Equal(t, "info-package", info.Msg.ContentDisposition)
+	assert.Equal(t, payload.D, info.Payload.Data())
+	assert.Nil(t, info.DTMF)
+}
+
+func TestInfoRefused(t *testing.T) {
+	_, _, d := newTestCall(t, nil, nil)
+
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, d.SendInfo(&sip.DTMF{Signal: "1"}), &rerr)
+	assert.Equal(t, sip.StatusMethodNotAllowed, rerr.Msg.Status)
+
+	// The call carries on after a rejected INFO
+	require.NoError(t, d.Hold())
+}
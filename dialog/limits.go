@@ -0,0 +1,69 @@
+package dialog
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+)
+
+// The Q.850 cause sent in the `Reason` header of a BYE when the call lasted too long
+const q850RecoveryOnTimerExpiry = 102
+
+var ErrNoAnswer = errors.New("the call was not answered in time")
+
+// Set the time limits of a new dialog, which its options may override
+func (dls *dialogState) initLimits() {
+	dls.ringTimeout = dls.manager.ringTimeout
+	dls.maxDuration = dls.manager.maxDuration
+}
+
+// Start waiting for our INVITE to be answered
+func (dls *dialogState) startRingTimer() {
+	if dls.ringTimeout > 0 {
+		dls.ringTimer = time.After(dls.ringTimeout)
+	}
+}
+
+// Start counting the length of the call, once it is answered
+func (dls *dialogState) startDurationTimer() {
+	dls.ringTimer = nil
+	if dls.maxDuration > 0 {
+		dls.durationTimer = time.After(dls.maxDuration)
+	}
+}
+
+// Our INVITE was not answered in time: cancel it
+func (dls *dialogState) noAnswer() bool {
+	dls.ringTimer = nil
+	if dls.state >= StatusAnswered || dls.cancelling || dls.cancelPending {
+		return true
+	}
+	dls.manager.logger.Info(
+		"call not answered in time, cancelling it",
+		slog.Duration("timeout", dls.ringTimeout),
+		slog.String("call-id", string(dls.callID)),
+	)
+	dls.hangupCause = CauseNoAnswer
+	dls.reportError(ErrNoAnswer)
+	return dls.hangup()
+}
+
+// The call has lasted as long as it is allowed to: hang it up
+func (dls *dialogState) maxDurationReached() bool {
+	dls.durationTimer = nil
+	if dls.state != StatusAnswered {
+		return true
+	}
+	dls.manager.logger.Info(
+		"call reached its maximum duration, hanging up",
+		slog.Duration("duration", dls.maxDuration),
+		slog.String("call-id", string(dls.callID)),
+	)
+	return dls.bye(CauseMaxDuration, &sip.Reason{
+		Protocol: sip.ReasonQ850,
+		Cause:    q850RecoveryOnTimerExpiry,
+		Text:     "Maximum call duration reached",
+	})
+}
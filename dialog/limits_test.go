@@ -0,0 +1,101 @@
+package dialog_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingTimeout(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t, dialog.WithRingTimeout(time.Hour))
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)},
+		dialog.WithDialogRingTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	to := invite.To.Copy().Tag()
+	callee.respond(t, addr, invite, sip.StatusRinging, func(msg *sip.Msg) { msg.To = to })
+
+	// Nobody answers, so the call is cancelled
+	request, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodCancel, request.Method)
+	callee.respond(t, addr, request, sip.StatusOK, nil)
+	callee.respond(t, addr, invite, sip.StatusRequestTerminated, func(msg *sip.Msg) { msg.To = to })
+
+	assert.ErrorIs(t, nextEventOf(t, d, dialog.EventError).Err, dialog.ErrNoAnswer)
+	assert.Equal(t, dialog.StatusCancelling, nextEventOf(t, d, dialog.EventState).State)
+	final := nextEventOf(t, d, dialog.EventState)
+	assert.Equal(t, dialog.StatusHangup, final.State)
+	assert.Equal(t, dialog.CauseNoAnswer, final.Cause)
+
+	_, err = d.Wait(context.Background())
+	assert.ErrorIs(t, err, dialog.ErrNoAnswer)
+}
+
+func TestMaxCallDuration(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t, dialog.WithMaxCallDuration(100*time.Millisecond))
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	callee.respond(t, addr, invite, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = invite.To.Copy().Tag()
+		msg.Contact = &sip.Addr{Uri: callee.uri()}
+		msg.Payload = newTestSDP(5000)
+	})
+	w.waitState(t, dialog.StatusAnswered)
+	ack, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodAck, ack.Method)
+
+	// The call is hung up once it has lasted long enough, saying why
+	bye, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodBye, bye.Method)
+	require.NotNil(t, bye.Reason)
+	assert.Equal(t, sip.ReasonQ850, bye.Reason.Protocol)
+	callee.respond(t, addr, bye, sip.StatusOK, nil)
+
+	w.waitState(t, dialog.StatusTerminating)
+	w.waitState(t, dialog.StatusHangup)
+}
+
+func TestIncomingMaxCallDuration(t *testing.T) {
+	caller := newFakePeer(t)
+	calls := make(chan *dialog.IncomingCall, 1)
+	callee := newTestManager(t, dialog.WithMaxCallDuration(time.Hour), dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		calls <- call
+	}))
+	invite, call := sendTestInvite(t, caller, callee, calls, "incoming-max-duration")
+	w := watch(call.Dialog)
+
+	assert.ErrorIs(t, call.SetMaxCallDuration(-time.Second), dialog.ErrCallLimitNotValid)
+	require.NoError(t, call.SetMaxCallDuration(100*time.Millisecond))
+	require.NoError(t, call.Accept(newTestSDP(5000)))
+	assert.ErrorIs(t, call.SetMaxCallDuration(time.Hour), dialog.ErrCallAlreadyAnswered)
+	ok := nextResponse(t, caller)
+	require.Equal(t, sip.StatusOK, ok.Status)
+	caller.send(t, callee, &sip.Msg{Method: sip.MethodAck, Request: ok.Contact.Uri, From: invite.From, To: ok.To, CallID: invite.CallID, CSeq: 1})
+	w.waitState(t, dialog.StatusAnswered)
+
+	// The call is hung up long before the manager's limit
+	bye, addr := caller.receive(t, map[string]bool{})
+	require.Equal(t, sip.MethodBye, bye.Method)
+	require.NotNil(t, bye.Reason)
+	caller.respond(t, addr, bye, sip.StatusOK, nil)
+	w.waitState(t, dialog.StatusHangup)
+}
@@ -4,49 +4,84 @@ import (
 	"log/slog"
 	"net"
 	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
 )
 
 type Manager struct {
 	logger *slog.Logger
 
 	// looseSignaling bool // Permit SIP messages from servers other than the next hop
-	maxResends       int            // How many times to try resending non-ACK'ed packets
-	rawTrace         bool           // Whether to print the raw messages in the log
-	resendInterval   time.Duration  // How long to wait before trying to resend non-ACK'ed messages
-	timestampTagging bool           // Add timestamps to Via headers for debugging
-	userAgent        string         // The `User-Agent` header value
-	listenAddress    string         // defaults to empty string = "all addresses on a random port"
-	publicAddrPort   netip.AddrPort // If behind 1-to-1 NAT, this IP will be considered our local address
-	proxyAddress     *net.UDPAddr   // If set, send all messages to the proxy instead of directly to the destination
-	allowReinvite    bool           // Whether to allow RFC 3725/4117 re-INVITE or not
+	rawTrace            bool                           // Whether to print the raw messages in the log
+	timers              transaction.Timers             // The RFC 3261 T1/T2/T4 timer values used for retransmissions
+	maxResends          int                            // If set, requests time out after this many resends rather than after 64*T1
+	timestampTagging    bool                           // Add timestamps to Via headers for debugging
+	userAgent           string                         // The `User-Agent` header value
+	listenAddress       string                         // defaults to empty string = "all addresses on a random port"
+	publicAddrPort      netip.AddrPort                 // If behind 1-to-1 NAT, this IP will be considered our local address
+	proxyAddress        *net.UDPAddr                   // If set, send all messages to the proxy instead of directly to the destination
+	allowReinvite       bool                           // Whether to allow RFC 3725/4117 re-INVITE or not
+	allowUpdate         bool                           // Whether to allow RFC 3311 UPDATE or not
+	credentials         CredentialProvider             // Used to answer digest authentication challenges
+	incomingCallHandler IncomingCallHandler            // Receives new incoming calls; if nil, incoming INVITEs are refused
+	reinviteHandler     ReinviteHandler                // Answers re-INVITEs; if nil, they are answered with our current SDP
+	updateHandler       UpdateHandler                  // Answers offers in UPDATEs; if nil, they are answered with our current SDP
+	referHandler        ReferHandler                   // Decides whether to accept REFERs; if nil, they are refused
+	recvInfo            []string                       // The RFC 6086 Info Packages we receive; if nil, INFOs are refused
+	messageHandler      MessageHandler                 // Receives MESSAGEs sent outside of a dialog; if nil, they are refused
+	notifiers           map[string]SubscriptionHandler // Receive SUBSCRIBEs for the event packages we serve, by name
+	sessionTimer        time.Duration                  // The RFC 4028 session interval to ask for; zero disables session timers
+	minSE               time.Duration                  // The smallest session interval we accept
+	eventQueue          int                            // How many events each dialog buffers for the application
+	ringTimeout         time.Duration                  // How long to wait for our INVITEs to be answered; zero to wait forever
+	maxDuration         time.Duration                  // How long calls may last once answered; zero for no limit
+	redirectHandler     RedirectHandler                // Vets the targets of 3xx responses to our INVITEs; if nil, they are all tried
+	maxRedirects        int                            // How many 3xx responses to each of our INVITEs to follow
 
 	sock    *net.UDPConn
 	contact *sip.Addr // The local (or public IP, if set) Contact for this server
 	via     *sip.Via  // The local (or public IP, if set) Via for this server
 
-	dialogs map[sip.CallID]*dialogState
+	transactions *transaction.Layer
+
+	dialogsMu sync.Mutex
+	dialogs   map[sip.CallID][]*dialogState // Usually one per Call-ID, but a hairpinned INVITE makes two
+	closing   bool                          // Set once the manager starts closing; new dialogs are refused
+
+	closeOnce sync.Once
+	closed    chan struct{} // Closed when the socket is, to end every dialog still running
+
+	registrationsMu sync.Mutex
+	registrations   map[sip.CallID]*Registration // nil once the manager is closed
+
+	subscriptionsMu sync.Mutex
+	subscriptions   map[sip.CallID]*subscriptionDialog // Both directions; nil once the manager is closed
 }
 
 const (
-	defaultMaxResends       = 2
 	defaultRawTrace         = false
-	defaultResendInterval   = time.Second
 	defaultTimestampTagging = false
 	defaultUserAgent        = "sipmanager/1.0"
+	maxResendsLimit         = 10 // The most resends that `WithMaxResends` accepts
 )
 
 func NewManager(opts ...ManagerOption) (*Manager, error) {
 	m := &Manager{
-		maxResends:       defaultMaxResends,
 		rawTrace:         defaultRawTrace,
-		resendInterval:   defaultResendInterval,
+		timers:           transaction.DefaultTimers(),
 		timestampTagging: defaultTimestampTagging,
 		userAgent:        defaultUserAgent,
-
-		dialogs: make(map[sip.CallID]*dialogState),
+		eventQueue:       defaultEventQueue,
+		maxRedirects:     defaultMaxRedirects,
+		minSE:            defaultMinSE,
+
+		dialogs:       make(map[sip.CallID][]*dialogState),
+		registrations: make(map[sip.CallID]*Registration),
+		subscriptions: make(map[sip.CallID]*subscriptionDialog),
+		closed:        make(chan struct{}),
 	}
 
 	for _, opt := range opts {
@@ -56,12 +91,21 @@ func NewManager(opts ...ManagerOption) (*Manager, error) {
 			return nil, err
 		}
 	}
+	if m.sessionTimer > 0 && m.sessionTimer < m.minSE {
+		// RFC 4028 section 4: we may not ask for less than our own Min-SE
+		return nil, ErrSessionTimerNotValid
+	}
 
 	sock, err := net.ListenPacket("udp", m.listenAddress)
 	if err != nil {
 		return nil, err
 	}
 	m.sock = sock.(*net.UDPConn)
+	if m.maxResends > 0 {
+		// Applied once every option is set, since it depends on T1
+		m.timers.Timeout = m.timers.T1 << m.maxResends
+	}
+	m.transactions = transaction.NewLayer(m, m.timers, m.logger)
 
 	m.contact = &sip.Addr{
 		Uri: &sip.URI{
@@ -107,3 +151,76 @@ func (m *Manager) PublicPort() uint16 {
 
 	return uint16(m.sock.LocalAddr().(*net.UDPAddr).Port)
 }
+
+// Route requests with the dialog's Call-ID to it. Fails if another dialog
+// already uses that Call-ID, or if the manager is closing.
+func (m *Manager) addDialog(dls *dialogState) error {
+	m.dialogsMu.Lock()
+	defer m.dialogsMu.Unlock()
+	if m.closing {
+		return ErrManagerClosed
+	}
+	for _, other := range m.dialogs[dls.callID] {
+		// The INVITE of an incoming dialog never changes, so it is safe to read here
+		if !dls.incoming && !other.incoming ||
+			dls.incoming && other.incoming && tagOf(dls.invite.From) == tagOf(other.invite.From) {
+			return ErrDialogExists
+		}
+	}
+	m.dialogs[dls.callID] = append(m.dialogs[dls.callID], dls)
+	return nil
+}
+
+func (m *Manager) removeDialog(dls *dialogState) {
+	m.dialogsMu.Lock()
+	defer m.dialogsMu.Unlock()
+	dialogs := m.dialogs[dls.callID]
+	for i, other := range dialogs {
+		if other == dls {
+			dialogs = append(dialogs[:i:i], dialogs[i+1:]...)
+			break
+		}
+	}
+	if len(dialogs) == 0 {
+		delete(m.dialogs, dls.callID)
+	} else {
+		m.dialogs[dls.callID] = dialogs
+	}
+}
+
+// Find the dialog that a request from the remote UA belongs to,
+// by its Call-ID and our tag (the tag of its To header)
+func (m *Manager) findDialog(callID sip.CallID, localTag string) *dialogState {
+	m.dialogsMu.Lock()
+	defer m.dialogsMu.Unlock()
+	for _, dls := range m.dialogs[callID] {
+		if dls.localTag == localTag {
+			return dls
+		}
+	}
+	return nil
+}
+
+// Find the incoming dialog whose INVITE a CANCEL applies to
+func (m *Manager) findCancelled(callID sip.CallID, invite *transaction.Server) *dialogState {
+	m.dialogsMu.Lock()
+	defer m.dialogsMu.Unlock()
+	for _, dls := range m.dialogs[callID] {
+		if dls.incoming && dls.inviteServer == invite {
+			return dls
+		}
+	}
+	return nil
+}
+
+// Refuse new dialogs from now on, and return the ones in progress
+func (m *Manager) closeDialogs() []*dialogState {
+	m.dialogsMu.Lock()
+	defer m.dialogsMu.Unlock()
+	m.closing = true
+	dialogs := make([]*dialogState, 0, len(m.dialogs))
+	for _, byCallID := range m.dialogs {
+		dialogs = append(dialogs, byCallID...)
+	}
+	return dialogs
+}
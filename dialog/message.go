@@ -0,0 +1,144 @@
+package dialog
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+var (
+	ErrMessageNoTarget        = errors.New("a MESSAGE needs a destination")
+	ErrMessageNoPayload       = errors.New("a MESSAGE needs a payload")
+	ErrMessageAlreadyAnswered = errors.New("this MESSAGE has already been answered")
+)
+
+// SendMessage sends an RFC 3428 MESSAGE to `to`, outside of any dialog, and waits for
+// the final response. Authentication challenges are answered with the manager's
+// credentials. The payload is usually a `text/plain` `sip.MiscPayload`.
+//
+// A 2xx response is returned with a nil error: `200 OK` means the message was
+// delivered, and `202 Accepted` that it will be (RFC 3428 section 7). Any other
+// final response is returned along with a `*sip.ResponseError`.
+func (m *Manager) SendMessage(to *sip.URI, payload sip.Payload) (*sip.Msg, error) {
+	if to == nil || to.Host == "" {
+		return nil, ErrMessageNoTarget
+	}
+	if payload == nil {
+		return nil, ErrMessageNoPayload
+	}
+
+	request := &sip.Msg{
+		Method:     sip.MethodMessage,
+		Request:    to,
+		Via:        &sip.Via{Host: m.PublicAddress().String(), Port: m.PublicPort()},
+		CSeq:       util.GenerateCSeq(),
+		CSeqMethod: sip.MethodMessage,
+		Payload:    payload,
+	}
+	nonceCounts := make(map[string]int)
+	for {
+		msg, err := m.sendMessageRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case msg.Status < sip.StatusMultipleChoices:
+			return msg, nil
+		case msg.Status == sip.StatusUnauthorized, msg.Status == sip.StatusProxyAuthenticationRequired:
+			retry, err := m.authorize(request, msg, m.credentials, nonceCounts)
+			if err != nil {
+				return msg, err
+			}
+			// The new request is a new transaction, so it needs a new CSeq and branch.
+			retry.Via = &sip.Via{Host: m.PublicAddress().String(), Port: m.PublicPort()}
+			retry.CSeq++
+			request = retry
+		default:
+			return msg, &sip.ResponseError{Msg: msg}
+		}
+	}
+}
+
+// Start a transaction for a MESSAGE, and wait for its final response
+// (a `408 Request Timeout` from the transaction layer, if there is none)
+func (m *Manager) sendMessageRequest(request *sip.Msg) (*sip.Msg, error) {
+	final := make(chan *sip.Msg, 1)
+	_, err := m.transactions.Request(request, func(tx *transaction.Client, msg *sip.Msg) {
+		if msg.Status < sip.StatusOK {
+			return
+		}
+		select {
+		case final <- msg:
+		default:
+		}
+	})
+	if err != nil {
+		m.logger.Error(
+			"unable to send 'MESSAGE' message",
+			util.SlogError(err),
+			slog.String("packet", request.String()),
+		)
+		return nil, err
+	}
+	return <-final, nil
+}
+
+// MessageHandler is called (in a new goroutine) for every MESSAGE received outside
+// of a dialog. The handler must eventually call `Respond`.
+type MessageHandler func(*IncomingMessage)
+
+// IncomingMessage is an RFC 3428 MESSAGE received from a remote UA
+type IncomingMessage struct {
+	Msg     *sip.Msg    // The MESSAGE received from the remote UA
+	Payload sip.Payload // The message itself, usually `text/plain`
+
+	manager  *Manager
+	tx       *transaction.Server
+	mu       sync.Mutex // Guards `answered`, since the handler may respond from any goroutine
+	answered bool
+}
+
+// Respond sends the final response to the MESSAGE: `200 OK` if it was delivered,
+// `202 Accepted` if it will be delivered later (for example, once it is stored
+// or forwarded), or a (>=300) status to refuse it.
+func (im *IncomingMessage) Respond(status int) error {
+	if status < sip.StatusOK {
+		return ErrInvalidFinalStatus
+	}
+	im.mu.Lock()
+	answered := im.answered
+	im.answered = true
+	im.mu.Unlock()
+	if answered {
+		return ErrMessageAlreadyAnswered
+	}
+
+	response := im.manager.NewResponse(im.Msg, status)
+	response.To = im.Msg.To.Copy()
+	if response.To.Param.Get("tag") == nil {
+		response.To.Tag()
+	}
+	if err := im.tx.Respond(response); err != nil {
+		im.manager.logger.Error(
+			"unable to send reply to incoming 'MESSAGE' message",
+			util.SlogError(err),
+			slog.String("packet", im.Msg.String()),
+		)
+		return err
+	}
+	return nil
+}
+
+// Pass a MESSAGE received outside of a dialog to the application
+func (m *Manager) handleIncomingMessage(tx *transaction.Server, msg *sip.Msg) {
+	go m.messageHandler(&IncomingMessage{
+		Msg:     msg,
+		Payload: msg.Payload,
+		manager: m,
+		tx:      tx,
+	})
+}
@@ -0,0 +1,95 @@
+package dialog_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendMessage(t *testing.T) {
+	messages := make(chan *dialog.IncomingMessage, 1)
+	receiver := newTestManager(t, dialog.WithMessageHandler(func(im *dialog.IncomingMessage) {
+		messages <- im
+	}))
+	sender := newTestManager(t)
+
+	to := newTestInvite(receiver).Request
+	type result struct {
+		msg *sip.Msg
+		err error
+	}
+	results := make(chan result, 1)
+	send := func(text string) {
+		go func() {
+			msg, err := sender.SendMessage(to, &sip.MiscPayload{T: "text/plain", D: []byte(text)})
+			results <- result{msg, err}
+		}()
+	}
+	receive := func() *dialog.IncomingMessage {
+		select {
+		case im := <-messages:
+			return im
+		case <-time.After(testTimeout):
+			require.FailNow(t, "timeout waiting for MESSAGE")
+			return nil
+		}
+	}
+
+	send("stored for later")
+	im := receive()
+	assert.Equal(t, "text/plain", im.Payload.ContentType())
+	assert.Equal(t, "stored for later", string(im.Payload.Data()))
+	require.NoError(t, im.Respond(sip.StatusAccepted))
+	assert.ErrorIs(t, im.Respond(sip.StatusOK), dialog.ErrMessageAlreadyAnswered)
+	r := <-results
+	require.NoError(t, r.err)
+	assert.Equal(t, sip.StatusAccepted, r.msg.Status)
+	assert.NotNil(t, r.msg.To.Param.Get("tag"))
+
+	// Only one of two concurrent responses is sent
+	send("refused")
+	im = receive()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- im.Respond(sip.StatusBusyHere) }()
+	}
+	assert.ElementsMatch(t, []error{nil, dialog.ErrMessageAlreadyAnswered}, []error{<-errs, <-errs})
+	r = <-results
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, r.err, &rerr)
+	assert.Equal(t, sip.StatusBusyHere, r.msg.Status)
+}
+
+func TestSendMessageWithChallenge(t *testing.T) {
+	peer := newFakePeer(t)
+	m := newTestManager(t, dialog.WithCredentials("alice", "secret"))
+
+	results := make(chan error, 1)
+	go func() {
+		_, err := m.SendMessage(peer.uri(), &sip.MiscPayload{T: "text/plain", D: []byte("hello")})
+		results <- err
+	}()
+
+	seen := map[string]bool{}
+	req, addr := peer.receive(t, seen)
+	assert.Equal(t, sip.MethodMessage, req.Method)
+	assert.Nil(t, req.Contact)
+	assert.NotEmpty(t, req.CallID)
+	peer.respond(t, addr, req, sip.StatusProxyAuthenticationRequired, func(msg *sip.Msg) {
+		msg.ProxyAuthenticate = `Digest realm="example.test", nonce="abc", qop="auth"`
+	})
+
+	retry, addr := peer.receive(t, seen)
+	assert.True(t, strings.HasPrefix(retry.ProxyAuthorization, `Digest username="alice", realm="example.test"`))
+	assert.Equal(t, req.CallID, retry.CallID)
+	assert.Nil(t, retry.Contact)
+	assert.Greater(t, retry.CSeq, req.CSeq)
+	assert.Equal(t, "hello", string(retry.Payload.Data()))
+	peer.respond(t, addr, retry, sip.StatusOK, nil)
+	require.NoError(t, <-results)
+}
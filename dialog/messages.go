@@ -16,6 +16,7 @@ package dialog
 
 import (
 	"log/slog"
+	"strings"
 
 	"github.com/safermobility/sipmanager/sip"
 )
@@ -25,11 +26,38 @@ const (
 	GosipAllowWithReinvite = "INVITE, ACK, CANCEL, BYE, OPTIONS"
 )
 
-func (m *Manager) NewResponse(msg *sip.Msg, status int) *sip.Msg {
+// The `Allow` header value for the methods we accept
+func (m *Manager) allow() string {
 	allow := GosipAllow
 	if m.allowReinvite {
 		allow = GosipAllowWithReinvite
 	}
+	if m.allowUpdate {
+		allow += ", " + sip.MethodUpdate
+	}
+	if m.referHandler != nil {
+		allow += ", " + sip.MethodRefer
+	}
+	// We can always send a REFER, so we must accept the NOTIFYs that report its progress
+	allow += ", " + sip.MethodNotify
+	if m.recvInfo != nil {
+		allow += ", " + sip.MethodInfo
+	}
+	if m.messageHandler != nil {
+		allow += ", " + sip.MethodMessage
+	}
+	if m.notifiers != nil {
+		allow += ", " + sip.MethodSubscribe
+	}
+	return allow
+}
+
+// The `Recv-Info` header value for the Info Packages we receive
+func (m *Manager) recvInfoHeader() string {
+	return strings.Join(m.recvInfo, ", ")
+}
+
+func (m *Manager) NewResponse(msg *sip.Msg, status int) *sip.Msg {
 	return &sip.Msg{
 		Status:      status,
 		Phrase:      sip.Phrase(status),
@@ -41,7 +69,7 @@ func (m *Manager) NewResponse(msg *sip.Msg, status int) *sip.Msg {
 		CSeqMethod:  msg.CSeqMethod,
 		RecordRoute: msg.RecordRoute,
 		UserAgent:   m.userAgent,
-		Allow:       allow,
+		Allow:       m.allow(),
 	}
 }
 
@@ -0,0 +1,369 @@
+package dialog
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+const (
+	defaultNotifierExpires = time.Hour      // How long a subscription lasts when the SUBSCRIBE has no `Expires`
+	maxNotifierExpires     = 24 * time.Hour // The longest subscription we grant
+)
+
+var (
+	ErrSubscriptionAlreadyAnswered = errors.New("this subscription has already been answered")
+	ErrSubscriptionTerminated      = errors.New("the subscription has ended")
+)
+
+// SubscriptionHandler is called (in a new goroutine) for every new SUBSCRIBE
+// for an event package we serve. The handler must eventually call `Accept` or `Reject`.
+type SubscriptionHandler func(*IncomingSubscription)
+
+// IncomingSubscription is a request from a remote UA to be notified of an event package
+type IncomingSubscription struct {
+	Msg     *sip.Msg      // The SUBSCRIBE received from the remote UA
+	Event   string        // The event package, without parameters
+	Expires time.Duration // How long the subscription should last; zero to only fetch the current state
+
+	manager  *Manager
+	tx       *transaction.Server
+	mu       sync.Mutex // Guards `answered`, since the handler may answer from any goroutine
+	answered bool
+}
+
+// The "public" interface of a subscription served by us. Events are buffered;
+// if the buffer fills up, further events are dropped.
+type Notifier struct {
+	OnErr   <-chan error
+	OnState <-chan SubscriptionStatus
+
+	doNotify chan<- *notifyRequest
+	done     <-chan struct{}
+}
+
+// A change of state requested by the application
+type notifyRequest struct {
+	body      sip.Payload
+	terminate bool
+	reason    string // Why the subscription was terminated, if it was
+}
+
+// The "internal" interface of a subscription served by us
+type notifierState struct {
+	*subscriptionDialog
+	errChan    chan<- error
+	stateChan  chan<- SubscriptionStatus
+	notifyChan <-chan *notifyRequest
+	state      SubscriptionStatus     // Most recently reported state.
+	event      string                 // The `Event` header of the subscription.
+	subscribe  *sip.Msg               // The SUBSCRIBE that created the subscription.
+	expires    time.Time              // When the subscription ends, unless it is refreshed.
+	expire     <-chan time.Time       // Fires when the subscription ends.
+	body       sip.Payload            // The current state, sent in every NOTIFY.
+	notify     *sip.Msg               // Our NOTIFY that is waiting for a final response.
+	pending    *sip.SubscriptionState // The state to NOTIFY once the NOTIFY in progress is answered, if any.
+}
+
+// Accept creates the subscription, and notifies the subscriber of the current state in `body`.
+// Later changes are sent with `Notifier.Notify`.
+func (s *IncomingSubscription) Accept(body sip.Payload) (*Notifier, error) {
+	if !s.claim() {
+		return nil, ErrSubscriptionAlreadyAnswered
+	}
+
+	errChan := make(chan error, subscriptionEventQueue)
+	stateChan := make(chan SubscriptionStatus, subscriptionEventQueue)
+	notifyChan := make(chan *notifyRequest)
+
+	ns := &notifierState{
+		subscriptionDialog: s.manager.newSubscriptionDialog(),
+		errChan:            errChan,
+		stateChan:          stateChan,
+		notifyChan:         notifyChan,
+		event:              s.Msg.Event,
+		subscribe:          s.Msg,
+		body:               body,
+	}
+	ns.callID = s.Msg.CallID
+	ns.localAddr = s.Msg.To.Copy().Tag()
+	ns.remoteAddr = s.Msg.From
+	ns.routeSet = s.Msg.RecordRoute
+	ns.rSeq = s.Msg.CSeq
+	ns.lSeq = util.GenerateCSeq()
+	if s.Msg.Contact != nil {
+		ns.remoteTarget = s.Msg.Contact.Uri
+	}
+
+	n := &Notifier{
+		OnErr:    errChan,
+		OnState:  stateChan,
+		doNotify: notifyChan,
+		done:     ns.doneChan,
+	}
+	ns.stop = func() { n.Terminate("noresource") }
+	if !s.manager.addSubscription(ns.subscriptionDialog) {
+		ns.reply(s.tx, s.Msg, sip.StatusServiceUnavailable)
+		return nil, ErrManagerClosed
+	}
+	go ns.run(s.tx, s.Expires)
+
+	return n, nil
+}
+
+// Reject refuses the subscription with the given (>=300) status, usually `403 Forbidden`
+func (s *IncomingSubscription) Reject(status int) error {
+	if status < sip.StatusMultipleChoices {
+		return ErrInvalidFinalStatus
+	}
+	if !s.claim() {
+		return ErrSubscriptionAlreadyAnswered
+	}
+	if err := s.tx.Respond(s.manager.NewResponse(s.Msg, status)); err != nil {
+		s.manager.logger.Error(
+			"unable to send reply to incoming 'SUBSCRIBE' message",
+			util.SlogError(err),
+			slog.String("packet", s.Msg.String()),
+		)
+		return err
+	}
+	return nil
+}
+
+// Take the right to answer the SUBSCRIBE, which only the first `Accept` or `Reject` gets
+func (s *IncomingSubscription) claim() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.answered {
+		return false
+	}
+	s.answered = true
+	return true
+}
+
+// Notify sends the new state of the subscription to the subscriber
+func (n *Notifier) Notify(body sip.Payload) error {
+	return n.send(&notifyRequest{body: body})
+}
+
+// Terminate ends the subscription, telling the subscriber why, like `noresource`
+// or `rejected` (RFC 6665 section 4.1.3). The reason may be empty.
+func (n *Notifier) Terminate(reason string) error {
+	return n.send(&notifyRequest{terminate: true, reason: reason})
+}
+
+func (n *Notifier) send(r *notifyRequest) error {
+	select {
+	case n.doNotify <- r:
+		return nil
+	case <-n.done:
+		return ErrSubscriptionTerminated
+	}
+}
+
+// Answer the SUBSCRIBE and send the first NOTIFY, then handle refreshes and
+// changes of state until the subscription ends
+func (ns *notifierState) run(tx *transaction.Server, expires time.Duration) {
+	defer ns.cleanup()
+	ns.refresh(tx, ns.subscribe, expires)
+
+	// Once the subscription has ended, wait for the final NOTIFY to be answered
+	for ns.state != SubscriptionStatusTerminated || ns.notify != nil {
+		select {
+		case r := <-ns.responseChan:
+			ns.handleResponse(r.tx, r.msg)
+		case r := <-ns.requestChan:
+			ns.handleRequest(r.tx, r.msg)
+		case r := <-ns.notifyChan:
+			if r.terminate {
+				ns.terminate(r.reason)
+			} else {
+				ns.body = r.body
+				ns.sendState()
+			}
+		case <-ns.expire:
+			ns.expire = nil
+			ns.terminate("timeout")
+		}
+	}
+}
+
+// Answer a SUBSCRIBE that creates, refreshes or ends the subscription,
+// and NOTIFY the subscriber of the current state
+func (ns *notifierState) refresh(tx *transaction.Server, msg *sip.Msg, expires time.Duration) {
+	response := ns.newResponse(msg, sip.StatusOK)
+	response.Contact = ns.manager.contact
+	response.Expires = int(expires / time.Second)
+	ns.respond(tx, response)
+
+	if expires <= 0 {
+		// An unsubscription, or a SUBSCRIBE that only fetches the current state
+		ns.terminate("timeout")
+		return
+	}
+	ns.expires = time.Now().Add(expires)
+	ns.expire = time.After(expires)
+	ns.transition(SubscriptionStatusActive)
+	ns.sendState()
+}
+
+// NOTIFY the subscriber of the current state
+func (ns *notifierState) sendState() {
+	ns.sendNotify(&sip.SubscriptionState{
+		State:   sip.SubscriptionActive,
+		Expires: max(int(time.Until(ns.expires)/time.Second), 1),
+	})
+}
+
+// End the subscription with a final NOTIFY
+func (ns *notifierState) terminate(reason string) {
+	ns.expire = nil
+	ns.notifyChan = nil
+	ns.transition(SubscriptionStatusTerminated)
+	ns.sendNotify(&sip.SubscriptionState{State: sip.SubscriptionTerminated, Reason: reason})
+}
+
+func (ns *notifierState) sendNotify(state *sip.SubscriptionState) {
+	if ns.notify != nil {
+		// Only one NOTIFY at a time; the latest state is sent once this one is answered
+		ns.pending = state
+		return
+	}
+	notify := ns.newRequest(sip.MethodNotify)
+	notify.Event = ns.event
+	notify.SubscriptionState = state
+	if ns.body != nil {
+		notify.Payload = ns.body
+	}
+	ns.notify = notify
+	if err := ns.send(notify); err != nil {
+		ns.notify = nil
+		ns.fail(err)
+	}
+}
+
+func (ns *notifierState) handleResponse(tx *transaction.Client, msg *sip.Msg) {
+	if tx.Request() != ns.notify || msg.Status < sip.StatusOK {
+		return
+	}
+	ns.notify = nil
+	if msg.Status >= sip.StatusMultipleChoices {
+		ns.pending = nil
+		// RFC 6665 section 4.2.2: the subscriber is gone, or no longer wants it
+		ns.fail(&sip.ResponseError{Msg: msg})
+		return
+	}
+	if ns.pending != nil {
+		state := ns.pending
+		ns.pending = nil
+		ns.sendNotify(state)
+	}
+}
+
+func (ns *notifierState) handleRequest(tx *transaction.Server, msg *sip.Msg) {
+	if msg.Method != sip.MethodSubscribe {
+		ns.reply(tx, msg, sip.StatusMethodNotAllowed)
+		return
+	}
+	if ns.state == SubscriptionStatusTerminated {
+		ns.reply(tx, msg, sip.StatusCallTransactionDoesNotExist)
+		return
+	}
+	if !ns.checkSequence(tx, msg) {
+		return
+	}
+	if eventPackage(msg.Event) != eventPackage(ns.event) {
+		ns.reply(tx, msg, sip.StatusBadEvent)
+		return
+	}
+	if msg.Contact != nil {
+		ns.remoteTarget = msg.Contact.Uri
+	}
+	ns.refresh(tx, msg, subscribeExpires(msg))
+}
+
+// How long the subscriber asked the subscription to last. Without an `Expires` header,
+// the event package's default applies (RFC 6665 section 4.2.1.1); we use one hour.
+func subscribeExpires(msg *sip.Msg) time.Duration {
+	if !msg.HasExpires {
+		return defaultNotifierExpires
+	}
+	if msg.Expires < 0 || msg.Expires > int(maxNotifierExpires/time.Second) {
+		// The parser wraps around on very large values
+		return maxNotifierExpires
+	}
+	return time.Duration(msg.Expires) * time.Second
+}
+
+// Report an error that ends the subscription, without telling the subscriber
+func (ns *notifierState) fail(err error) {
+	ns.manager.logger.Warn(
+		"subscription ended",
+		util.SlogError(err),
+		slog.String("event", ns.event),
+		slog.String("call-id", string(ns.callID)),
+	)
+	select {
+	case ns.errChan <- err:
+	default:
+	}
+	ns.transition(SubscriptionStatusTerminated)
+}
+
+func (ns *notifierState) transition(state SubscriptionStatus) {
+	if ns.state == state {
+		return
+	}
+	ns.state = state
+	select {
+	case ns.stateChan <- state:
+	default:
+	}
+}
+
+func (ns *notifierState) cleanup() {
+	close(ns.doneChan)
+	close(ns.errChan)
+	close(ns.stateChan)
+	ns.manager.removeSubscription(ns.subscriptionDialog)
+}
+
+// Pass a new SUBSCRIBE to the handler of its event package, if we serve it
+func (m *Manager) handleIncomingSubscribe(tx *transaction.Server, msg *sip.Msg) {
+	event := eventPackage(msg.Event)
+	handler, ok := m.notifiers[event]
+	if !ok {
+		response := m.NewResponse(msg, sip.StatusBadEvent)
+		response.AllowEvents = m.allowEvents()
+		if err := tx.Respond(response); err != nil {
+			m.logger.Error(
+				"unable to send '489 Bad Event' reply to incoming 'SUBSCRIBE' message",
+				util.SlogError(err),
+				slog.String("packet", msg.String()),
+			)
+		}
+		return
+	}
+	go handler(&IncomingSubscription{
+		Msg:     msg,
+		Event:   event,
+		Expires: subscribeExpires(msg),
+		manager: m,
+		tx:      tx,
+	})
+}
+
+// The `Allow-Events` header value for the event packages we serve
+func (m *Manager) allowEvents() string {
+	events := make([]string, 0, len(m.notifiers))
+	for event := range m.notifiers {
+		events = append(events, event)
+	}
+	return strings.Join(events, ", ")
+}
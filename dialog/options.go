@@ -7,15 +7,36 @@ import (
 	"net"
 	"net/netip"
 	"time"
+
+	"github.com/safermobility/sipmanager/sip"
 )
 
 type ManagerOption func(*Manager) error
 
+// DialogOption overrides manager settings for a single dialog
+type DialogOption func(*dialogState) error
+
+// RegistrationOption configures a single registration
+type RegistrationOption func(*registrationState) error
+
+// SubscriptionOption configures a single subscription made with `Manager.Subscribe`
+type SubscriptionOption func(*subscriberState) error
+
+// TransferOption configures a single transfer
+type TransferOption func(*transferState) error
+
 var (
 	ErrAddrPortAlreadySet   = errors.New("socket listen address/port can only be set once")
 	ErrProxyAddressNotValid = errors.New("proxy address is not valid")
+	ErrExpiresNotValid      = errors.New("registration or subscription interval must be at least one second")
+	ErrSessionTimerNotValid = errors.New("session interval must be at least 90 seconds")
+	ErrEventQueueNotValid   = errors.New("event queue must hold at least one event")
+	ErrCallLimitNotValid    = errors.New("call time limits can not be negative")
+	ErrRedirectsNotValid    = errors.New("the number of redirects to follow can not be negative")
+	ErrMaxResendsNotValid   = errors.New("the number of resends must be between 0 and 10")
 )
 
+// Whether to accept re-INVITEs from the remote UA; if not, they are refused with `405 Method Not Allowed`
 func WithAllowReinvite(allow bool) ManagerOption {
 	return func(m *Manager) error {
 		m.allowReinvite = allow
@@ -24,6 +45,129 @@ func WithAllowReinvite(allow bool) ManagerOption {
 	}
 }
 
+// Whether to accept RFC 3311 UPDATEs from the remote UA; if not, they are refused with `405 Method Not Allowed`
+func WithAllowUpdate(allow bool) ManagerOption {
+	return func(m *Manager) error {
+		m.allowUpdate = allow
+		return nil
+	}
+}
+
+// Use the same username and password to answer every authentication challenge
+func WithCredentials(username, password string) ManagerOption {
+	return WithCredentialProvider(StaticCredentials(username, password))
+}
+
+// Look up the credentials to answer authentication challenges for each realm
+func WithCredentialProvider(provider CredentialProvider) ManagerOption {
+	return func(m *Manager) error {
+		m.credentials = provider
+		return nil
+	}
+}
+
+// How many events each dialog buffers on `Dialog.OnEvent` before it drops them
+func WithEventQueue(size int) ManagerOption {
+	return func(m *Manager) error {
+		if size < 1 {
+			return ErrEventQueueNotValid
+		}
+		m.eventQueue = size
+		return nil
+	}
+}
+
+// Follow at most `count` redirects (3xx responses) for each of our calls. The default
+// is 5; zero treats every redirect as a failure.
+func WithMaxRedirects(count int) ManagerOption {
+	return func(m *Manager) error {
+		if count < 0 {
+			return ErrRedirectsNotValid
+		}
+		m.maxRedirects = count
+		return nil
+	}
+}
+
+// Let `handler` veto or rewrite each target that our calls are redirected to
+func WithRedirectHandler(handler RedirectHandler) ManagerOption {
+	return func(m *Manager) error {
+		m.redirectHandler = handler
+		return nil
+	}
+}
+
+// Accept incoming calls and pass them to `handler`
+func WithIncomingCallHandler(handler IncomingCallHandler) ManagerOption {
+	return func(m *Manager) error {
+		m.incomingCallHandler = handler
+		return nil
+	}
+}
+
+// Let the application answer re-INVITEs (implies `WithAllowReinvite(true)`)
+func WithReinviteHandler(handler ReinviteHandler) ManagerOption {
+	return func(m *Manager) error {
+		m.allowReinvite = true
+		m.reinviteHandler = handler
+		return nil
+	}
+}
+
+// Let the application answer offers in UPDATEs (implies `WithAllowUpdate(true)`)
+func WithUpdateHandler(handler UpdateHandler) ManagerOption {
+	return func(m *Manager) error {
+		m.allowUpdate = true
+		m.updateHandler = handler
+		return nil
+	}
+}
+
+// Accept INFOs from the remote UA, delivering them as `EventInfo` events. Legacy INFOs
+// (without an Info Package) are always accepted, as are those for `packages` (RFC 6086).
+func WithRecvInfo(packages ...string) ManagerOption {
+	return func(m *Manager) error {
+		m.recvInfo = append([]string{}, packages...)
+		return nil
+	}
+}
+
+// Receive RFC 3428 MESSAGEs sent outside of a dialog, letting `handler` respond to each one
+func WithMessageHandler(handler MessageHandler) ManagerOption {
+	return func(m *Manager) error {
+		m.messageHandler = handler
+		return nil
+	}
+}
+
+// Serve the event package `event`, letting `handler` decide whether to accept each new subscription
+func WithNotifier(event string, handler SubscriptionHandler) ManagerOption {
+	return func(m *Manager) error {
+		if m.notifiers == nil {
+			m.notifiers = make(map[string]SubscriptionHandler)
+		}
+		m.notifiers[eventPackage(event)] = handler
+		return nil
+	}
+}
+
+// Accept transfers from the remote UA (as the transferee), letting `handler`
+// decide whether to call the target of each REFER
+func WithReferHandler(handler ReferHandler) ManagerOption {
+	return func(m *Manager) error {
+		m.referHandler = handler
+		return nil
+	}
+}
+
+// Hang up the call once the transfer target has answered
+func WithTransferHangup(hangup bool) TransferOption {
+	return func(ts *transferState) error {
+		ts.hangup = hangup
+		return nil
+	}
+}
+
 // Select the local listening address and port
 func WithListenAddrPort(a netip.AddrPort) ManagerOption {
 	return func(m *Manager) error {
@@ -70,8 +214,15 @@ func WithListenString(address string) ManagerOption {
 // 	}
 // }
 
+// Give up on a request that has been sent again `num` times without a final response,
+// by setting RFC 3261 timers B and F to 2^num*T1 rather than 64*T1 (which allows 6 resends).
+// Non-INVITE requests may be resent a few more times, since their interval stops growing at T2.
+// Zero (the default) keeps the standard timers.
 func WithMaxResends(num int) ManagerOption {
 	return func(m *Manager) error {
+		if num < 0 || num > maxResendsLimit {
+			return ErrMaxResendsNotValid
+		}
 		m.maxResends = num
 		return nil
 	}
@@ -113,16 +264,71 @@ func WithRawTrace(val bool) ManagerOption {
 	}
 }
 
+// Set the initial retransmit interval (RFC 3261 timer T1)
 func WithResendInterval(interval time.Duration) ManagerOption {
 	return func(m *Manager) error {
-		m.resendInterval = interval
+		m.timers.T1 = interval
 		return nil
 	}
 }
 
+// Set the initial retransmit interval (RFC 3261 timer T1) in milliseconds
 func WithResendIntervalMilliseconds(interval int) ManagerOption {
+	return WithResendInterval(time.Duration(interval) * time.Millisecond)
+}
+
+// Set the RFC 3261 timer values; a zero value keeps the default
+func WithTransactionTimers(t1, t2, t4 time.Duration) ManagerOption {
 	return func(m *Manager) error {
-		m.resendInterval = time.Duration(interval) * time.Millisecond
+		if t1 > 0 {
+			m.timers.T1 = t1
+		}
+		if t2 > 0 {
+			m.timers.T2 = t2
+		}
+		if t4 > 0 {
+			m.timers.T4 = t4
+		}
+		return nil
+	}
+}
+
+// Enable RFC 4028 session timers, asking for the given session interval.
+// Whichever side is the refresher sends an UPDATE (if the other side allows it)
+// or a re-INVITE every half interval,
+// and the call is hung up if the session is not refreshed in time.
+// The interval must be at least 90 seconds (RFC 4028 section 4).
+func WithSessionTimer(interval time.Duration) ManagerOption {
+	return func(m *Manager) error {
+		if interval <= 0 {
+			return ErrSessionTimerNotValid
+		}
+		m.sessionTimer = interval
+		return nil
+	}
+}
+
+// Cancel our outgoing calls that are not answered within `timeout`, reporting
+// `CauseNoAnswer`. Zero (the default) waits for as long as the called UA rings.
+func WithRingTimeout(timeout time.Duration) ManagerOption {
+	return func(m *Manager) error {
+		if timeout < 0 {
+			return ErrCallLimitNotValid
+		}
+		m.ringTimeout = timeout
+		return nil
+	}
+}
+
+// Hang up calls (in either direction) once they have lasted `duration` since
+// they were answered, with a BYE whose `Reason` header says why, and report
+// `CauseMaxDuration`. Zero (the default) lets calls last forever.
+func WithMaxCallDuration(duration time.Duration) ManagerOption {
+	return func(m *Manager) error {
+		if duration < 0 {
+			return ErrCallLimitNotValid
+		}
+		m.maxDuration = duration
 		return nil
 	}
 }
@@ -150,3 +356,105 @@ func WithGroupLogger(logger *slog.Logger, groupName string) ManagerOption {
 		return nil
 	}
 }
+
+// Use different credentials for this dialog than the manager's default
+func WithDialogCredentials(provider CredentialProvider) DialogOption {
+	return func(dls *dialogState) error {
+		dls.credentials = provider
+		return nil
+	}
+}
+
+// Override the manager's ring timeout (`WithRingTimeout`) for this dialog
+func WithDialogRingTimeout(timeout time.Duration) DialogOption {
+	return func(dls *dialogState) error {
+		if timeout < 0 {
+			return ErrCallLimitNotValid
+		}
+		dls.ringTimeout = timeout
+		return nil
+	}
+}
+
+// Override the manager's maximum call duration (`WithMaxCallDuration`) for this dialog.
+// For an incoming call, use `IncomingCall.SetMaxCallDuration` instead.
+func WithDialogMaxCallDuration(duration time.Duration) DialogOption {
+	return func(dls *dialogState) error {
+		if duration < 0 {
+			return ErrCallLimitNotValid
+		}
+		dls.maxDuration = duration
+		return nil
+	}
+}
+
+// Override the manager's redirect handler (`WithRedirectHandler`) for this dialog
+func WithDialogRedirectHandler(handler RedirectHandler) DialogOption {
+	return func(dls *dialogState) error {
+		dls.redirectHandler = handler
+		return nil
+	}
+}
+
+// Send REGISTER requests to `registrar` instead of the domain of the address of record
+func WithRegistrar(registrar *sip.URI) RegistrationOption {
+	return func(rs *registrationState) error {
+		rs.registrar = registrar
+		return nil
+	}
+}
+
+// Ask the registrar to keep our binding for `expires`
+func WithRegistrationExpires(expires time.Duration) RegistrationOption {
+	return func(rs *registrationState) error {
+		if expires < time.Second {
+			return ErrExpiresNotValid
+		}
+		rs.expires = expires
+		return nil
+	}
+}
+
+// How long to wait before trying again after a registration fails
+func WithRegistrationRetry(interval time.Duration) RegistrationOption {
+	return func(rs *registrationState) error {
+		rs.retry = interval
+		return nil
+	}
+}
+
+// Use different credentials for this registration than the manager's default
+func WithRegistrationCredentials(provider CredentialProvider) RegistrationOption {
+	return func(rs *registrationState) error {
+		rs.credentials = provider
+		return nil
+	}
+}
+
+// Ask for subscriptions that last `expires` before they have to be refreshed (default 1 hour)
+func WithSubscriptionExpires(expires time.Duration) SubscriptionOption {
+	return func(ss *subscriberState) error {
+		if expires < time.Second {
+			return ErrExpiresNotValid
+		}
+		ss.expires = expires
+		return nil
+	}
+}
+
+// Use `from` as the `From` header of the subscription, instead of our contact address
+func WithSubscriptionFrom(from *sip.Addr) SubscriptionOption {
+	return func(ss *subscriberState) error {
+		ss.from = from.Copy()
+		ss.from.Param = nil
+		return nil
+	}
+}
+
+// Use different credentials for this subscription than for the manager
+func WithSubscriptionCredentials(provider CredentialProvider) SubscriptionOption {
+	return func(ss *subscriberState) error {
+		ss.credentials = provider
+		return nil
+	}
+}
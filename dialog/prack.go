@@ -0,0 +1,82 @@
+package dialog
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+)
+
+// The RFC 3262 option tag for reliable provisional responses
+const optionTag100rel = "100rel"
+
+// Decide whether a provisional response to our INVITE should be processed,
+// sending a PRACK if it is a new reliable provisional response (RFC 3262 section 4).
+// Returns false for retransmitted or out-of-order reliable provisional responses.
+func (dls *dialogState) acknowledgeProvisional(msg *sip.Msg) bool {
+	if !hasOptionTag(msg.Require, optionTag100rel) || msg.RSeq <= 0 {
+		return true
+	}
+
+	// Each early dialog has its own sequence of reliable provisional responses
+	toTag := tagOf(msg.To)
+	if dls.provisionalRSeqs == nil {
+		dls.provisionalRSeqs = make(map[string]int)
+	}
+	if last, ok := dls.provisionalRSeqs[toTag]; ok && msg.RSeq != last+1 {
+		dls.manager.logger.Debug(
+			"ignoring retransmitted or out-of-order reliable provisional response",
+			slog.Int("rseq", msg.RSeq),
+			slog.Int("last", last),
+		)
+		return false
+	}
+	dls.provisionalRSeqs[toTag] = msg.RSeq
+
+	// The PRACK is sent within the early dialog created by the provisional response.
+	// If it can't be sent, the remote UA will give up on the provisional response.
+	prack := dls.earlyRequest(sip.MethodPrack, msg)
+	prack.RAck = &sip.RAck{
+		RSeq:   msg.RSeq,
+		CSeq:   msg.CSeq,
+		Method: msg.CSeqMethod,
+	}
+	dls.sendInDialog(prack)
+	return true
+}
+
+// Handle a response to one of our PRACKs. A failed PRACK does not end the call,
+// because the remote UA will give up on the provisional response by itself.
+func (dls *dialogState) handlePrackResponse(tx *transaction.Client, msg *sip.Msg) bool {
+	if msg.Status >= sip.StatusMultipleChoices {
+		dls.manager.logger.Warn(
+			"'PRACK' was rejected",
+			slog.Int("status", msg.Status),
+			slog.String("packet", msg.String()),
+		)
+	}
+	return true
+}
+
+// Whether a comma-separated header like `Supported` or `Require` contains an option tag
+func hasOptionTag(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add an option tag to a comma-separated header, if it is not already there
+func addOptionTag(header, tag string) string {
+	switch {
+	case hasOptionTag(header, tag):
+		return header
+	case header == "":
+		return tag
+	default:
+		return header + ", " + tag
+	}
+}
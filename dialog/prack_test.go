@@ -0,0 +1,66 @@
+package dialog_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReliableProvisionalIsPracked(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	assert.Contains(t, invite.Supported, "100rel")
+
+	to := invite.To.Copy().Tag()
+	progress := func(msg *sip.Msg) {
+		msg.To = to
+		msg.Contact = &sip.Addr{Uri: callee.uri()}
+		msg.Require = "100rel"
+		msg.RSeq = 1
+		msg.Payload = newTestSDP(5000)
+	}
+	callee.respond(t, addr, invite, sip.StatusSessionProgress, progress)
+
+	prack, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodPrack, prack.Method)
+	assert.Equal(t, &sip.RAck{RSeq: 1, CSeq: invite.CSeq, Method: sip.MethodInvite}, prack.RAck)
+	assert.Greater(t, prack.CSeq, invite.CSeq)
+	assert.Equal(t, to.Param.Get("tag"), prack.To.Param.Get("tag"))
+	callee.respond(t, addr, prack, sip.StatusOK, func(msg *sip.Msg) { msg.To = to })
+
+	// The early media SDP is delivered once, even if the 183 is retransmitted
+	peer := w.nextPeer(t)
+	assert.Equal(t, sip.StatusSessionProgress, peer.Msg.Status)
+	callee.respond(t, addr, invite, sip.StatusSessionProgress, progress)
+
+	callee.respond(t, addr, invite, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = to
+		msg.Contact = &sip.Addr{Uri: callee.uri()}
+		msg.Payload = newTestSDP(5000)
+	})
+	w.waitState(t, dialog.StatusAnswered)
+	peer = w.nextPeer(t)
+	assert.Equal(t, sip.StatusOK, peer.Msg.Status)
+
+	// The retransmitted 183 was not PRACK'ed again
+	ack, _ := callee.receive(t, seen)
+	assert.Equal(t, sip.MethodAck, ack.Method)
+	select {
+	case peer := <-w.peers:
+		assert.Fail(t, "unexpected SDP", "%v", peer.Msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
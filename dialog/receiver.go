@@ -1,6 +1,7 @@
 package dialog
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
 	"github.com/safermobility/sipmanager/util"
 )
 
@@ -40,6 +42,7 @@ func (m *Manager) ReceiveMessages() {
 		msg, err := sip.ParseMsg(packet)
 		if err != nil {
 			m.logger.Warn("unable to parse sip message", util.SlogError(err), util.SlogByteString("packet", packet))
+			continue
 		}
 		m.addReceived(msg, addr)
 		m.addTimestamp(msg)
@@ -70,16 +73,70 @@ func (m *Manager) HandleIncomingMessage(msg *sip.Msg) {
 		return
 	}
 
-	if dlg, ok := m.dialogs[msg.CallID]; ok {
-		if msg.IsResponse() {
-			dlg.handleResponse(msg)
-		} else {
-			dlg.handleRequest(msg)
+	if msg.IsResponse() {
+		if !m.transactions.HandleResponse(msg) {
+			m.logger.Warn("received response that doesn't match any transaction", slog.String("call-id", string(msg.CallID)))
+		}
+		return
+	}
+
+	// Retransmitted requests are answered by their transaction
+	tx, forward := m.transactions.HandleRequest(msg)
+	if !forward {
+		return
+	}
+
+	if msg.Method == sip.MethodCancel {
+		// RFC 3261 section 9.2: a CANCEL applies to an INVITE, rather than to a dialog
+		invite := m.transactions.MatchCancel(msg)
+		if invite == nil {
+			m.replyUnknownTransaction(tx, msg)
+			return
+		}
+		if dls := m.findCancelled(msg.CallID, invite); dls != nil {
+			dls.receiveRequest(tx, msg)
+			return
 		}
+	}
+
+	// An INVITE without a To tag starts a new dialog, even if it shares
+	// the Call-ID of one of ours (because a proxy sent our INVITE back to us)
+	if dls := m.findDialog(msg.CallID, tagOf(msg.To)); dls != nil {
+		dls.receiveRequest(tx, msg)
 		return
 	}
 
-	err := m.Send(m.NewResponse(msg, sip.StatusCallTransactionDoesNotExist))
+	if sd := m.findSubscription(msg.CallID); sd != nil {
+		sd.receiveRequest(tx, msg)
+		return
+	}
+
+	if msg.Method == sip.MethodAck {
+		// There is no response to an ACK, even if we don't know about it
+		m.logger.Warn("received ACK for unknown dialog", slog.String("call-id", string(msg.CallID)))
+		return
+	}
+
+	if msg.Method == sip.MethodInvite && m.incomingCallHandler != nil && msg.To.Param.Get("tag") == nil {
+		m.handleIncomingInvite(tx, msg)
+		return
+	}
+
+	if msg.Method == sip.MethodMessage && m.messageHandler != nil && msg.To.Param.Get("tag") == nil {
+		m.handleIncomingMessage(tx, msg)
+		return
+	}
+
+	if msg.Method == sip.MethodSubscribe && m.notifiers != nil && msg.To.Param.Get("tag") == nil {
+		m.handleIncomingSubscribe(tx, msg)
+		return
+	}
+
+	m.replyUnknownTransaction(tx, msg)
+}
+
+func (m *Manager) replyUnknownTransaction(tx *transaction.Server, msg *sip.Msg) {
+	err := tx.Respond(m.NewResponse(msg, sip.StatusCallTransactionDoesNotExist))
 	m.logger.Warn("received incoming message for unknown transaction", slog.String("call-id", string(msg.CallID)))
 	if err != nil {
 		m.logger.Error(
@@ -168,6 +225,25 @@ func (m *Manager) fixMessagesFromStrictRouters(lHost string, lPort uint16, msg *
 	}
 }
 
+// Close removes every registration made with `Register` (waiting a few seconds
+// at most for the registrars to confirm) and ends every subscription, in
+// either direction, then closes the socket. Calls still in progress end without
+// telling the remote UA; use `Shutdown` to hang them up first.
 func (m *Manager) Close() error {
-	return m.sock.Close()
+	m.closeDialogs()
+	ctx, cancel := context.WithTimeout(context.Background(), unregisterTimeout)
+	defer cancel()
+	m.unregisterAll(ctx)
+	m.closeSubscriptions()
+	return m.closeTransport()
+}
+
+// Close the socket, and end every dialog that is still running
+func (m *Manager) closeTransport() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		err = m.sock.Close()
+	})
+	return err
 }
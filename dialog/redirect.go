@@ -0,0 +1,193 @@
+package dialog
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/safermobility/sipmanager/sip"
+)
+
+const defaultMaxRedirects = 5 // How many 3xx responses to our INVITE are followed
+
+var ErrTooManyRedirects = errors.New("the call was redirected too many times")
+
+// RedirectHandler decides whether to send our INVITE to `target`, one of the
+// Contacts of a 3xx `response` (for a `305 Use Proxy`, the proxy to send it through).
+// It returns the target to use, which may be rewritten, or nil to skip it.
+// It is called by the dialog's goroutine, so it must not block or use the dialog.
+type RedirectHandler func(response *sip.Msg, target *sip.URI) *sip.URI
+
+// A target for our INVITE, from a 3xx response
+type redirectTarget struct {
+	uri      *sip.URI
+	q        float64  // The preference of the target, from 0 to 1
+	proxy    bool     // From a `305 Use Proxy`: send the INVITE through it, rather than to it
+	response *sip.Msg // The response that gave us the target
+}
+
+// Set the redirect policy of a new dialog, which its options may override
+func (dls *dialogState) initRedirects() {
+	dls.redirectHandler = dls.manager.redirectHandler
+	dls.maxRedirects = dls.manager.maxRedirects
+}
+
+// Handle a 3xx response to our INVITE: add its Contacts to the targets to try,
+// and send the INVITE to the most preferred one (RFC 3261 section 8.1.3.4)
+func (dls *dialogState) handleRedirect(msg *sip.Msg) bool {
+	if dls.cancelling || dls.cancelPending {
+		// We have given up on the call
+		dls.transition(StatusHangup, msg)
+		return false
+	}
+	switch msg.Status {
+	case sip.StatusMultipleChoices, sip.StatusMovedPermanently, sip.StatusMovedTemporarily, sip.StatusUseProxy:
+	default:
+		// 380 Alternative Service describes the alternatives in its body, which is for the application
+		return dls.inviteFailed(msg)
+	}
+
+	if dls.triedTargets == nil {
+		dls.triedTargets = map[string]bool{targetKey(dls.invite): true}
+	}
+	dls.redirects++
+	if dls.redirects > dls.maxRedirects {
+		dls.reportError(fmt.Errorf("%w: %w", ErrTooManyRedirects, &sip.ResponseError{Msg: msg}))
+		return false
+	}
+	for contact := msg.Contact; contact != nil; contact = contact.Next {
+		switch strings.ToLower(contact.Uri.Scheme) {
+		case "", "sip", "sips":
+		default:
+			// We can't send an INVITE to a `tel:` or `mailto:` URI
+			continue
+		}
+		dls.redirectTargets = append(dls.redirectTargets, &redirectTarget{
+			uri:      contact.Uri,
+			q:        qValue(contact),
+			proxy:    msg.Status == sip.StatusUseProxy,
+			response: msg,
+		})
+	}
+	sort.SliceStable(dls.redirectTargets, func(i, j int) bool {
+		return dls.redirectTargets[i].q > dls.redirectTargets[j].q
+	})
+	return dls.tryNextTarget(msg)
+}
+
+// Our INVITE was refused: try the next target of an earlier redirect, if there is one.
+// A 6xx response means that no other target will accept the call either.
+func (dls *dialogState) inviteFailed(msg *sip.Msg) bool {
+	if len(dls.redirectTargets) > 0 && msg.Status < sip.StatusBusyEverywhere {
+		return dls.tryNextTarget(msg)
+	}
+	dls.reportError(&sip.ResponseError{Msg: msg})
+	return false
+}
+
+// Send our INVITE to the next target that the application accepts and that
+// has not been tried yet. `msg` is the response that made us give up on the last one.
+func (dls *dialogState) tryNextTarget(msg *sip.Msg) bool {
+	for len(dls.redirectTargets) > 0 {
+		target := dls.redirectTargets[0]
+		dls.redirectTargets = dls.redirectTargets[1:]
+
+		if dls.alreadyTried(dls.redirectRequest(target, target.uri)) {
+			continue
+		}
+		uri := target.uri.Copy()
+		if dls.redirectHandler != nil {
+			if uri = dls.redirectHandler(target.response, uri); uri == nil {
+				continue
+			}
+		}
+		request := dls.redirectRequest(target, uri)
+		if dls.alreadyTried(request) {
+			continue
+		}
+		dls.triedTargets[targetKey(request)] = true
+
+		dls.lSeq++
+		request.CSeq = dls.lSeq
+		dls.invite = request
+		dls.early = nil
+		dls.earlyDialogs = nil
+		dls.manager.logger.Info(
+			"redirecting call",
+			slog.Int("status", target.response.Status),
+			slog.String("target", uri.String()),
+			slog.String("call-id", string(dls.callID)),
+		)
+		dls.transition(StatusRedirected, target.response)
+		return dls.sendRequest(request)
+	}
+	dls.reportError(&sip.ResponseError{Msg: msg})
+	return false
+}
+
+// Build a copy of our INVITE for a new target. It is a new transaction,
+// so the caller must give it a new CSeq (and it gets a new branch when sent).
+func (dls *dialogState) redirectRequest(target *redirectTarget, uri *sip.URI) *sip.Msg {
+	request := dls.invite.Copy()
+	request.Via = nil
+	// Our credentials answered the old target's challenges, not the new one's
+	request.Authorization = ""
+	request.ProxyAuthorization = ""
+	if target.proxy {
+		if uri.Param.Get("lr") == nil {
+			uri = uri.Copy()
+			uri.Param = &sip.URIParam{Name: "lr", Next: uri.Param}
+		}
+		request.Route = &sip.Addr{Uri: uri}
+	} else {
+		request.Request = uri
+		request.Route = nil
+	}
+	return request
+}
+
+// Whether our INVITE was already sent where `request` goes, which means a redirect loop
+func (dls *dialogState) alreadyTried(request *sip.Msg) bool {
+	if !dls.triedTargets[targetKey(request)] {
+		return false
+	}
+	dls.manager.logger.Warn(
+		"skipping redirect to a target that was already tried",
+		slog.String("target", request.Request.String()),
+		slog.String("call-id", string(dls.callID)),
+	)
+	return true
+}
+
+// The preference of a Contact, from its `q` parameter. A Contact without one is preferred.
+func qValue(contact *sip.Addr) float64 {
+	param := contact.Param.Get("q")
+	if param == nil {
+		return 1
+	}
+	q, err := strconv.ParseFloat(param.Value, 64)
+	if err != nil {
+		return 1
+	}
+	return min(max(q, 0), 1)
+}
+
+// Where an INVITE goes, to detect redirect loops: its target, and the proxy it is sent through
+func targetKey(request *sip.Msg) string {
+	key := uriKey(request.Request)
+	if request.Route != nil {
+		key += " via " + uriKey(request.Route.Uri)
+	}
+	return key
+}
+
+func uriKey(uri *sip.URI) string {
+	scheme := strings.ToLower(uri.Scheme)
+	if scheme == "" {
+		scheme = "sip"
+	}
+	return scheme + ":" + uri.User + "@" + strings.ToLower(uri.Host) + ":" + strconv.Itoa(int(uri.GetPort()))
+}
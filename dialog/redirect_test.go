@@ -0,0 +1,125 @@
+package dialog_test
+
+import (
+	"testing"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirect(t *testing.T) {
+	redirector, busy, callee := newFakePeer(t), newFakePeer(t), newFakePeer(t)
+	var offered []string
+	caller := newTestManager(t, dialog.WithRedirectHandler(func(response *sip.Msg, target *sip.URI) *sip.URI {
+		offered = append(offered, target.User)
+		if target.User == "voicemail" {
+			return nil
+		}
+		return target
+	}))
+
+	target := redirector.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	// Bob can be reached at two phones, preferably the busy one; the redirector
+	// itself (a loop) and voicemail (vetoed) are not tried
+	invite, addr := redirector.receive(t, map[string]bool{})
+	first, second, mailbox := busy.uri(), callee.uri(), callee.uri()
+	first.User, second.User, mailbox.User = "desk", "mobile", "voicemail"
+	redirector.respond(t, addr, invite, sip.StatusMultipleChoices, func(msg *sip.Msg) {
+		msg.To = invite.To.Copy().Tag()
+		msg.Contact = &sip.Addr{Uri: second, Param: &sip.Param{Name: "q", Value: "0.5"},
+			Next: &sip.Addr{Uri: target,
+				Next: &sip.Addr{Uri: first, Param: &sip.Param{Name: "q", Value: "0.9"},
+					Next: &sip.Addr{Uri: mailbox, Param: &sip.Param{Name: "q", Value: "0.7"}}}}}
+	})
+	w.waitState(t, dialog.StatusRedirected)
+
+	// Each attempt is a new transaction
+	retry, addr := busy.receive(t, map[string]bool{})
+	assert.Equal(t, "desk", retry.Request.User)
+	assert.Greater(t, retry.CSeq, invite.CSeq)
+	assert.NotEqual(t, invite.Via.Param.Get("branch").Value, retry.Via.Param.Get("branch").Value)
+	assert.Equal(t, invite.CallID, retry.CallID)
+	busy.respond(t, addr, retry, sip.StatusBusyHere, func(msg *sip.Msg) { msg.To = retry.To.Copy().Tag() })
+
+	last, addr := callee.receive(t, map[string]bool{})
+	assert.Equal(t, "mobile", last.Request.User)
+	assert.Greater(t, last.CSeq, retry.CSeq)
+	callee.respond(t, addr, last, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = last.To.Copy().Tag()
+		msg.Contact = &sip.Addr{Uri: callee.uri()}
+		msg.Payload = newTestSDP(5000)
+	})
+	w.waitState(t, dialog.StatusAnswered)
+	assert.Equal(t, []string{"desk", "voicemail", "mobile"}, offered)
+}
+
+func TestRedirectLimit(t *testing.T) {
+	redirector := newFakePeer(t)
+	caller := newTestManager(t, dialog.WithMaxRedirects(1))
+
+	target := redirector.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	seen := map[string]bool{}
+	for i, user := range []string{"alice", "carol"} {
+		invite, addr := redirector.receive(t, seen)
+		for invite.Method != sip.MethodInvite {
+			// The ACK for the last redirect
+			invite, addr = redirector.receive(t, seen)
+		}
+		next := redirector.uri()
+		next.User = user
+		redirector.respond(t, addr, invite, sip.StatusMovedTemporarily, func(msg *sip.Msg) {
+			msg.To = invite.To.Copy().Tag()
+			msg.Contact = &sip.Addr{Uri: next}
+		})
+		if i == 0 {
+			w.waitState(t, dialog.StatusRedirected)
+		}
+	}
+	assert.ErrorIs(t, w.nextErr(t), dialog.ErrTooManyRedirects)
+	w.waitState(t, dialog.StatusFailed)
+}
+
+func TestRedirectDropsCredentials(t *testing.T) {
+	redirector, callee := newFakePeer(t), newFakePeer(t)
+	caller := newTestManager(t, dialog.WithCredentials("alice", "secret"))
+
+	target := redirector.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	seen := map[string]bool{}
+	invite, addr := redirector.receive(t, seen)
+	redirector.respond(t, addr, invite, sip.StatusProxyAuthenticationRequired, func(msg *sip.Msg) {
+		msg.To = invite.To.Copy().Tag()
+		msg.ProxyAuthenticate = `Digest realm="example.test", nonce="abc", qop="auth"`
+	})
+	for invite.Method != sip.MethodInvite || invite.ProxyAuthorization == "" {
+		invite, addr = redirector.receive(t, seen)
+	}
+	next := callee.uri()
+	next.User = "bob"
+	redirector.respond(t, addr, invite, sip.StatusMovedTemporarily, func(msg *sip.Msg) {
+		msg.To = invite.To.Copy().Tag()
+		msg.Contact = &sip.Addr{Uri: next}
+	})
+	w.waitState(t, dialog.StatusRedirected)
+
+	// The credentials were for the redirector, not for the new target
+	retry, _ := callee.receive(t, map[string]bool{})
+	assert.Empty(t, retry.ProxyAuthorization)
+	assert.Empty(t, retry.Authorization)
+}
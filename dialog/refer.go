@@ -0,0 +1,283 @@
+package dialog
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/safermobility/sipmanager/sdp"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+)
+
+const referSubscriptionExpires = 60 // Seconds our implicit REFER subscription lasts, as reported in NOTIFYs
+
+var ErrReferNoTarget = errors.New("the REFER has no usable Refer-To target")
+
+// ReferHandler is called (in a new goroutine) for every REFER received from the remote UA,
+// asking us to call someone else. The handler must eventually call `Accept` or `Reject`.
+type ReferHandler func(*IncomingRefer)
+
+// IncomingRefer is a request from the remote UA to transfer us to another target (RFC 3515)
+type IncomingRefer struct {
+	Dialog   *Dialog       // The dialog the REFER was received in
+	Msg      *sip.Msg      // The REFER received from the remote UA
+	Target   *sip.URI      // Who to call, from the `Refer-To` header
+	Replaces *sip.Replaces // The dialog the new call should replace (an attended transfer), if any
+
+	respond  chan<- *referAnswer
+	mu       sync.Mutex // Held while sending the answer, so only one gets through
+	answered bool
+}
+
+// The application's decision about an incoming REFER
+type referAnswer struct {
+	status int      // 202 to accept, or the (>=300) status to reject with
+	offer  *sdp.SDP // The SDP offer for the new call
+	opts   []DialogOption
+	dialog *Dialog    // The new call, set before `result` receives nil
+	result chan error // Receives the outcome of placing the new call, if accepted
+}
+
+// Accept calls the target of the REFER with `offer`, and returns the new call.
+// The remote UA is kept informed of the new call's progress until it is answered or fails.
+func (r *IncomingRefer) Accept(offer *sdp.SDP, opts ...DialogOption) (*Dialog, error) {
+	a := &referAnswer{
+		status: sip.StatusAccepted,
+		offer:  offer,
+		opts:   opts,
+		result: make(chan error, 1),
+	}
+	if err := r.sendAnswer(a); err != nil {
+		return nil, err
+	}
+	if err := <-a.result; err != nil {
+		return nil, err
+	}
+	return a.dialog, nil
+}
+
+// Reject refuses the REFER with the given (>=300) status, usually `603 Decline`
+func (r *IncomingRefer) Reject(status int) error {
+	if status < sip.StatusMultipleChoices {
+		return ErrInvalidFinalStatus
+	}
+	return r.sendAnswer(&referAnswer{status: status})
+}
+
+func (r *IncomingRefer) sendAnswer(a *referAnswer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.answered {
+		return ErrCallAlreadyAnswered
+	}
+	select {
+	case r.respond <- a:
+		r.answered = true
+		return nil
+	case <-r.Dialog.done:
+		return ErrCallEnded
+	}
+}
+
+// The implicit subscription created by a REFER we accepted. The new call
+// reports its progress through it, to be sent to the referrer in NOTIFYs.
+type referSubscription struct {
+	progress chan<- *sip.Msg // Responses to the new call's INVITE
+	done     <-chan struct{} // Closed when the dialog the REFER was received in ends
+}
+
+// Handle a REFER from the remote UA
+func (dls *dialogState) handleRefer(tx *transaction.Server, msg *sip.Msg) bool {
+	handler := dls.manager.referHandler
+	if handler == nil {
+		return dls.reply(tx, msg, sip.StatusMethodNotAllowed)
+	}
+	if dls.state != StatusAnswered {
+		return dls.reply(tx, msg, sip.StatusForbidden)
+	}
+	if dls.referServer != nil || dls.referProgress != nil {
+		// We only keep track of one transfer at a time
+		return dls.replyRetryLater(tx, msg)
+	}
+	target, err := parseReferTo(msg.ReferTo)
+	if err != nil {
+		dls.manager.logger.Warn(
+			"refusing REFER without a usable Refer-To",
+			slog.String("packet", msg.String()),
+		)
+		return dls.reply(tx, msg, sip.StatusBadRequest)
+	}
+
+	refer := &IncomingRefer{
+		Dialog: dls.dialog,
+		Msg:    msg,
+		Target: target,
+	}
+	if h := target.Header.Get("Replaces"); h != nil {
+		if refer.Replaces, err = sip.ParseReplaces(h.Value); err != nil {
+			return dls.reply(tx, msg, sip.StatusBadRequest)
+		}
+	}
+	target.Header = nil
+
+	respond := make(chan *referAnswer)
+	refer.respond = respond
+	dls.referServer = tx
+	dls.referRespond = respond
+	go handler(refer)
+	return true
+}
+
+// Send the application's decision about the remote UA's REFER, and place the new call if it was accepted
+func (dls *dialogState) answerRefer(a *referAnswer) bool {
+	tx := dls.referServer
+	dls.referServer = nil
+	dls.referRespond = nil
+	request := tx.Request()
+
+	if a.status >= sip.StatusMultipleChoices {
+		return dls.reply(tx, request, a.status)
+	}
+
+	target, _ := parseReferTo(request.ReferTo)
+	invite := &sip.Msg{
+		Method:     sip.MethodInvite,
+		Request:    target,
+		From:       &sip.Addr{Uri: dls.localAddr.Uri.Copy(), Display: dls.localAddr.Display},
+		ReferredBy: request.ReferredBy,
+	}
+	if h := target.Header.Get("Replaces"); h != nil {
+		invite.Replaces, _ = sip.ParseReplaces(h.Value)
+	}
+	target.Header = nil
+	if a.offer != nil {
+		invite.Payload = a.offer
+	}
+
+	progress := make(chan *sip.Msg)
+	sub := &referSubscription{progress: progress, done: dls.doneChan}
+	d, err := dls.manager.NewDialog(invite, append(a.opts, withReferSubscription(sub))...)
+	if err != nil {
+		a.result <- err
+		return dls.reply(tx, request, sip.StatusServiceUnavailable)
+	}
+	a.dialog = d
+	a.result <- nil
+
+	if !dls.reply(tx, request, sip.StatusAccepted) {
+		return false
+	}
+	dls.referProgress = progress
+	// RFC 3515 section 2.4.4: the first NOTIFY is sent straight away
+	dls.sendReferNotify(&sip.Msg{Status: sip.StatusTrying})
+	return true
+}
+
+// Tell the remote UA how the call it asked for is going (RFC 3515 section 2.4.5).
+// A final response ends the subscription.
+func (dls *dialogState) sendReferNotify(response *sip.Msg) {
+	state := &sip.SubscriptionState{State: sip.SubscriptionActive, Expires: referSubscriptionExpires}
+	if response.Status >= sip.StatusOK {
+		state = &sip.SubscriptionState{State: sip.SubscriptionTerminated, Reason: "noresource"}
+		dls.referProgress = nil
+	}
+
+	notify := dls.newRequest(sip.MethodNotify)
+	notify.Event = "refer"
+	notify.SubscriptionState = state
+	notify.Payload = &sip.MiscPayload{
+		T: sip.ContentTypeSipFrag,
+		D: []byte(statusLine(response)),
+	}
+	dls.sendInDialog(notify)
+}
+
+// Handle a response to one of our NOTIFYs. A failed NOTIFY is not retried, and
+// does not end the dialog: the remote UA has just lost interest in the new call.
+func (dls *dialogState) handleNotifyResponse(tx *transaction.Client, msg *sip.Msg) bool {
+	if msg.Status >= sip.StatusMultipleChoices {
+		dls.manager.logger.Warn(
+			"'NOTIFY' was rejected",
+			slog.Int("status", msg.Status),
+			slog.String("packet", msg.String()),
+		)
+	}
+	return true
+}
+
+// Report the progress of a call placed because of a REFER, through the
+// subscription in the dialog the REFER was received in
+func (dls *dialogState) reportReferProgress(msg *sip.Msg) {
+	switch msg.Status {
+	case sip.StatusTrying:
+		// The first NOTIFY already said so
+		return
+	case sip.StatusUnauthorized, sip.StatusProxyAuthenticationRequired:
+		// The INVITE will be sent again with credentials
+		return
+	}
+	if msg.Status >= sip.StatusMultipleChoices {
+		// The INVITE may still be tried at another address, so failures
+		// are only reported when the call ends
+		dls.referFailure = msg
+		return
+	}
+	dls.sendReferProgress(msg)
+}
+
+// The call placed because of a REFER ended without being answered
+func (dls *dialogState) endReferProgress() {
+	failure := dls.referFailure
+	if failure == nil {
+		failure = &sip.Msg{Status: sip.StatusServiceUnavailable}
+	}
+	dls.sendReferProgress(failure)
+}
+
+func (dls *dialogState) sendReferProgress(msg *sip.Msg) {
+	select {
+	case dls.referrer.progress <- msg:
+		if msg.Status >= sip.StatusOK {
+			dls.referrer = nil
+		}
+	case <-dls.referrer.done:
+		dls.referrer = nil
+	}
+}
+
+// The status line of a response, as used in a `message/sipfrag` body
+func statusLine(response *sip.Msg) string {
+	phrase := response.Phrase
+	if phrase == "" {
+		phrase = sip.Phrase(response.Status)
+	}
+	return "SIP/2.0 " + strconv.Itoa(response.Status) + " " + phrase + "\r\n"
+}
+
+// Parse the target of a `Refer-To` header, which is a name-addr or an addr-spec
+func parseReferTo(referTo string) (*sip.URI, error) {
+	s := strings.TrimSpace(referTo)
+	if start := strings.IndexByte(s, '<'); start >= 0 {
+		end := strings.IndexByte(s[start:], '>')
+		if end < 0 {
+			return nil, ErrReferNoTarget
+		}
+		s = s[start+1 : start+end]
+	}
+	uri, err := sip.ParseURI([]byte(s))
+	if err != nil || uri.Host == "" {
+		return nil, ErrReferNoTarget
+	}
+	return uri, nil
+}
+
+// Place a call on behalf of a REFER, reporting its progress through `sub`
+func withReferSubscription(sub *referSubscription) DialogOption {
+	return func(dls *dialogState) error {
+		dls.referrer = sub
+		return nil
+	}
+}
@@ -0,0 +1,371 @@
+package dialog
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+type RegistrationStatus int
+
+const (
+	RegistrationStatusRegistering RegistrationStatus = iota + 1
+	RegistrationStatusRegistered
+	RegistrationStatusFailed
+	RegistrationStatusUnregistered
+)
+
+const (
+	defaultRegisterExpires = time.Hour
+	defaultRegisterRetry   = time.Minute
+	registerRefreshMargin  = 30 * time.Second // Refresh this long before a binding expires (or halfway, if sooner)
+	registrationEventQueue = 8                // Events buffered for the application before they are dropped
+	unregisterTimeout      = 5 * time.Second  // How long `Close` waits for the registrar to remove our bindings
+)
+
+var (
+	ErrRegistrationNoAOR   = errors.New("a registration needs an address of record with a host")
+	ErrManagerClosed       = errors.New("the manager has been closed")
+	ErrIntervalTooBrief    = errors.New("registrar rejected the registration interval without a usable Min-Expires")
+	ErrRegistrationExpired = errors.New("registrar did not grant a binding for our contact")
+)
+
+// The "public" interface of a registration with a registrar.
+// Events are buffered, so a slow reader does not delay refreshes;
+// if the buffer fills up, further events are dropped.
+type Registration struct {
+	OnErr   <-chan error
+	OnState <-chan RegistrationStatus
+
+	doUnregister chan<- struct{}
+	done         <-chan struct{}
+	unregister   sync.Once
+}
+
+// The "internal" interface of a registration
+type registrationState struct {
+	manager        *Manager
+	errChan        chan<- error
+	stateChan      chan<- RegistrationStatus
+	unregisterChan <-chan struct{}
+	responseChan   chan *clientResponse
+	doneChan       chan struct{}
+	state          RegistrationStatus // Most recently reported state.
+	aor            *sip.Addr          // The address of record being registered, used as the `To` header.
+	from           *sip.Addr          // The `From` header, with our tag.
+	registrar      *sip.URI           // The Request-URI of our REGISTER requests.
+	contact        *sip.Addr          // The binding we ask the registrar to create.
+	callID         sip.CallID         // The same Call-ID is used for every refresh (RFC 3261 section 10.2.4).
+	cSeq           int                // The CSeq of the most recent REGISTER.
+	expires        time.Duration      // The binding duration we ask for.
+	retry          time.Duration      // How long to wait before trying again after a failure.
+	request        *sip.Msg           // The REGISTER currently in progress.
+	timer          <-chan time.Time   // Fires when the binding should be refreshed, or a failure retried.
+	unregistering  bool               // Whether we are removing our binding.
+	credentials    CredentialProvider // Overrides the manager's credentials for this registration, if set.
+	nonceCounts    map[string]int     // Digest authentication nonce counts, by nonce.
+}
+
+// Register binds our contact address to `aor` at its registrar, and keeps
+// refreshing the binding until `Unregister` is called or the manager is closed.
+// By default the registrar is the domain of the address of record.
+func (m *Manager) Register(aor *sip.Addr, opts ...RegistrationOption) (*Registration, error) {
+	if aor == nil || aor.Uri == nil || aor.Uri.Host == "" {
+		return nil, ErrRegistrationNoAOR
+	}
+
+	errChan := make(chan error, registrationEventQueue)
+	stateChan := make(chan RegistrationStatus, registrationEventQueue)
+	unregisterChan := make(chan struct{})
+	doneChan := make(chan struct{})
+
+	contact := m.contact.Copy()
+	contact.Uri.Scheme = "sip"
+	contact.Uri.User = aor.Uri.User
+
+	from := aor.Copy()
+	from.Param = nil
+	from.Tag()
+
+	rs := &registrationState{
+		manager:        m,
+		errChan:        errChan,
+		stateChan:      stateChan,
+		unregisterChan: unregisterChan,
+		responseChan:   make(chan *clientResponse),
+		doneChan:       doneChan,
+		aor:            aor,
+		from:           from,
+		registrar:      &sip.URI{Scheme: aor.Uri.Scheme, Host: aor.Uri.Host, Port: aor.Uri.Port},
+		contact:        contact,
+		callID:         sip.CallID(util.GenerateCallID()),
+		cSeq:           util.GenerateCSeq(),
+		expires:        defaultRegisterExpires,
+		retry:          defaultRegisterRetry,
+	}
+	for _, opt := range opts {
+		if err := opt(rs); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &Registration{
+		OnErr:        errChan,
+		OnState:      stateChan,
+		doUnregister: unregisterChan,
+		done:         doneChan,
+	}
+
+	m.registrationsMu.Lock()
+	defer m.registrationsMu.Unlock()
+	if m.registrations == nil {
+		return nil, ErrManagerClosed
+	}
+	m.registrations[rs.callID] = r
+	go rs.run()
+
+	return r, nil
+}
+
+// Unregister removes our binding from the registrar and ends the registration.
+// It returns immediately; `OnState` reports `RegistrationStatusUnregistered` when it is done.
+func (r *Registration) Unregister() {
+	r.unregister.Do(func() {
+		select {
+		case r.doUnregister <- struct{}{}:
+		case <-r.done:
+		}
+	})
+}
+
+// Remove every binding we made, and wait for the registrar to confirm,
+// until `ctx` is done. Registrations still waiting end when the socket closes.
+func (m *Manager) unregisterAll(ctx context.Context) {
+	m.registrationsMu.Lock()
+	registrations := m.registrations
+	m.registrations = nil
+	m.registrationsMu.Unlock()
+
+	for _, r := range registrations {
+		r.Unregister()
+	}
+	for _, r := range registrations {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Pass a response from one of our client transactions to the registration's goroutine
+func (rs *registrationState) receiveResponse(tx *transaction.Client, msg *sip.Msg) {
+	select {
+	case rs.responseChan <- &clientResponse{tx, msg}:
+	case <-rs.doneChan:
+	}
+}
+
+// Send the first REGISTER, then handle responses, refreshes and unregistration until done
+func (rs *registrationState) run() {
+	defer rs.cleanup()
+	rs.transition(RegistrationStatusRegistering)
+	rs.send()
+
+	for rs.state != RegistrationStatusUnregistered {
+		select {
+		case r := <-rs.responseChan:
+			rs.handleResponse(r.tx, r.msg)
+		case <-rs.timer:
+			rs.timer = nil
+			rs.send()
+		case <-rs.unregisterChan:
+			rs.unregisterChan = nil
+			rs.unregister()
+		case <-rs.manager.closed:
+			// The registrar can no longer be told, so the binding is left to expire
+			rs.unregistering = true
+			rs.fail(ErrManagerClosed)
+		}
+	}
+}
+
+// Build and send a new REGISTER for our binding
+func (rs *registrationState) send() {
+	expires := int(rs.expires / time.Second)
+	if rs.unregistering {
+		expires = 0
+	}
+	rs.cSeq++
+	rs.sendRequest(&sip.Msg{
+		Method:     sip.MethodRegister,
+		Request:    rs.registrar,
+		Via:        &sip.Via{Host: rs.manager.PublicAddress().String(), Port: rs.manager.PublicPort()},
+		From:       rs.from,
+		To:         rs.aor,
+		CallID:     rs.callID,
+		CSeq:       rs.cSeq,
+		CSeqMethod: sip.MethodRegister,
+		Contact:    rs.contact,
+		Expires:    expires,
+	})
+}
+
+// Start a transaction for a REGISTER; failures are retried later
+func (rs *registrationState) sendRequest(request *sip.Msg) {
+	rs.request = request
+	if _, err := rs.manager.transactions.Request(request, rs.receiveResponse); err != nil {
+		rs.manager.logger.Error(
+			"unable to send 'REGISTER' message",
+			util.SlogError(err),
+			slog.String("packet", request.String()),
+		)
+		rs.fail(err)
+	}
+}
+
+func (rs *registrationState) handleResponse(tx *transaction.Client, msg *sip.Msg) {
+	if tx.Request() != rs.request || msg.Status < sip.StatusOK {
+		// A response to a REGISTER we have already given up on, or a provisional response
+		return
+	}
+
+	switch {
+	case msg.Status < sip.StatusMultipleChoices:
+		if rs.unregistering {
+			rs.transition(RegistrationStatusUnregistered)
+			return
+		}
+		granted := rs.granted(msg)
+		if granted <= 0 {
+			rs.fail(ErrRegistrationExpired)
+			return
+		}
+		rs.transition(RegistrationStatusRegistered)
+		rs.timer = time.After(granted - min(granted/2, registerRefreshMargin))
+	case msg.Status == sip.StatusUnauthorized, msg.Status == sip.StatusProxyAuthenticationRequired:
+		provider := rs.credentials
+		if provider == nil {
+			provider = rs.manager.credentials
+		}
+		if rs.nonceCounts == nil {
+			rs.nonceCounts = make(map[string]int)
+		}
+		request, err := rs.manager.authorize(tx.Request(), msg, provider, rs.nonceCounts)
+		if err != nil {
+			rs.fail(err)
+			return
+		}
+		request.Via = &sip.Via{Host: rs.manager.PublicAddress().String(), Port: rs.manager.PublicPort()}
+		rs.cSeq++
+		request.CSeq = rs.cSeq
+		rs.sendRequest(request)
+	case msg.Status == sip.StatusIntervalTooBrief && !rs.unregistering:
+		// RFC 3261 section 10.2.8: try again with the registrar's minimum
+		minExpires := time.Duration(msg.MinExpires) * time.Second
+		if minExpires <= rs.expires {
+			rs.fail(ErrIntervalTooBrief)
+			return
+		}
+		rs.manager.logger.Debug(
+			"registrar requires a longer registration interval",
+			slog.String("aor", rs.aor.String()),
+			slog.Int("min-expires", msg.MinExpires),
+		)
+		rs.expires = minExpires
+		rs.send()
+	default:
+		rs.fail(&sip.ResponseError{Msg: msg})
+	}
+}
+
+// Find how long the registrar will keep our binding (RFC 3261 section 10.2.4)
+func (rs *registrationState) granted(msg *sip.Msg) time.Duration {
+	for contact := msg.Contact; contact != nil; contact = contact.Next {
+		if contact.Uri == nil ||
+			contact.Uri.User != rs.contact.Uri.User ||
+			!contact.Uri.CompareHostPort(rs.contact.Uri) {
+			continue
+		}
+		if p := contact.Param.Get("expires"); p != nil {
+			if seconds, err := strconv.Atoi(p.Value); err == nil {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+		break
+	}
+	if msg.Expires > 0 {
+		return time.Duration(msg.Expires) * time.Second
+	}
+	if msg.Contact == nil {
+		return 0
+	}
+	return rs.expires
+}
+
+// Report a failed REGISTER, and try again later (unless we were unregistering)
+func (rs *registrationState) fail(err error) {
+	rs.report(err)
+	if rs.unregistering {
+		rs.transition(RegistrationStatusUnregistered)
+		return
+	}
+	rs.request = nil
+	rs.transition(RegistrationStatusFailed)
+	rs.timer = time.After(rs.retry)
+}
+
+// Remove our binding, if we might have one
+func (rs *registrationState) unregister() {
+	rs.unregistering = true
+	rs.timer = nil
+	if rs.state == RegistrationStatusFailed {
+		rs.transition(RegistrationStatusUnregistered)
+		return
+	}
+	rs.send()
+}
+
+func (rs *registrationState) transition(state RegistrationStatus) {
+	if rs.state == state {
+		return
+	}
+	rs.state = state
+	select {
+	case rs.stateChan <- state:
+	default:
+		rs.manager.logger.Warn(
+			"dropping registration state change, because the application is not reading them",
+			slog.String("aor", rs.aor.String()),
+		)
+	}
+}
+
+func (rs *registrationState) report(err error) {
+	rs.manager.logger.Error(
+		"registration failed",
+		util.SlogError(err),
+		slog.String("aor", rs.aor.String()),
+	)
+	select {
+	case rs.errChan <- err:
+	default:
+	}
+}
+
+func (rs *registrationState) cleanup() {
+	close(rs.doneChan)
+	close(rs.errChan)
+	close(rs.stateChan)
+
+	rs.manager.registrationsMu.Lock()
+	defer rs.manager.registrationsMu.Unlock()
+	delete(rs.manager.registrations, rs.callID)
+}
@@ -0,0 +1,136 @@
+package dialog_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nextRegistrationState(t *testing.T, r *dialog.Registration) dialog.RegistrationStatus {
+	t.Helper()
+	select {
+	case state, ok := <-r.OnState:
+		require.True(t, ok, "registration ended unexpectedly")
+		return state
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for registration state")
+		return 0
+	}
+}
+
+func TestRegisterWithChallengeAndRefresh(t *testing.T) {
+	registrar := newFakePeer(t)
+	m := newTestManager(t, dialog.WithCredentials("alice", "secret"))
+
+	aor := &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "alice", Host: "example.test"}}
+	r, err := m.Register(aor, dialog.WithRegistrar(registrar.uri()), dialog.WithRegistrationExpires(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, dialog.RegistrationStatusRegistering, nextRegistrationState(t, r))
+
+	seen := map[string]bool{}
+	req, addr := registrar.receive(t, seen)
+	assert.Equal(t, sip.MethodRegister, req.Method)
+	assert.Equal(t, 1, req.Expires)
+	assert.Equal(t, "alice", req.Contact.Uri.User)
+	registrar.respond(t, addr, req, sip.StatusIntervalTooBrief, func(msg *sip.Msg) {
+		msg.MinExpires = 2
+	})
+
+	req, addr = registrar.receive(t, seen)
+	assert.Equal(t, 2, req.Expires)
+	registrar.respond(t, addr, req, sip.StatusUnauthorized, func(msg *sip.Msg) {
+		msg.WWWAuthenticate = `Digest realm="example.test", nonce="abc", qop="auth"`
+	})
+
+	req, addr = registrar.receive(t, seen)
+	assert.True(t, strings.HasPrefix(req.Authorization, `Digest username="alice", realm="example.test"`))
+	registrar.respond(t, addr, req, sip.StatusOK, func(msg *sip.Msg) {
+		msg.Contact = req.Contact.Copy()
+		msg.Contact.Param = &sip.Param{Name: "expires", Value: "2"}
+	})
+	assert.Equal(t, dialog.RegistrationStatusRegistered, nextRegistrationState(t, r))
+
+	// The binding is refreshed before it expires, with the same Call-ID
+	start := time.Now()
+	refresh, addr := registrar.receive(t, seen)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, req.CallID, refresh.CallID)
+	assert.Greater(t, refresh.CSeq, req.CSeq)
+	registrar.respond(t, addr, refresh, sip.StatusOK, func(msg *sip.Msg) {
+		msg.Contact = refresh.Contact.Copy()
+		msg.Expires = 2
+	})
+
+	// Closing the manager removes the binding
+	closed := make(chan error)
+	go func() { closed <- m.Close() }()
+	req, addr = registrar.receive(t, seen)
+	assert.Equal(t, 0, req.Expires)
+	registrar.respond(t, addr, req, sip.StatusOK, nil)
+	assert.Equal(t, dialog.RegistrationStatusUnregistered, nextRegistrationState(t, r))
+	require.NoError(t, <-closed)
+}
+
+func TestRegisterFailureIsRetried(t *testing.T) {
+	registrar := newFakePeer(t)
+	m := newTestManager(t)
+
+	aor := &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "bob", Host: "example.test"}}
+	r, err := m.Register(aor, dialog.WithRegistrar(registrar.uri()), dialog.WithRegistrationRetry(10*time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, dialog.RegistrationStatusRegistering, nextRegistrationState(t, r))
+
+	seen := map[string]bool{}
+	req, addr := registrar.receive(t, seen)
+	registrar.respond(t, addr, req, sip.StatusForbidden, nil)
+	assert.Equal(t, dialog.RegistrationStatusFailed, nextRegistrationState(t, r))
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, <-r.OnErr, &rerr)
+	assert.Equal(t, sip.StatusForbidden, rerr.Msg.Status)
+
+	req, addr = registrar.receive(t, seen)
+	registrar.respond(t, addr, req, sip.StatusOK, func(msg *sip.Msg) {
+		msg.Contact = req.Contact
+	})
+	assert.Equal(t, dialog.RegistrationStatusRegistered, nextRegistrationState(t, r))
+
+	r.Unregister()
+	req, addr = registrar.receive(t, seen)
+	assert.Equal(t, 0, req.Expires)
+	registrar.respond(t, addr, req, sip.StatusOK, nil)
+	assert.Equal(t, dialog.RegistrationStatusUnregistered, nextRegistrationState(t, r))
+}
+
+func TestUnregisterWithoutAnswer(t *testing.T) {
+	registrar := newFakePeer(t)
+	// Slow timers, so the REGISTER transaction outlasts the wait in `Close`
+	m := newTestManager(t, dialog.WithTransactionTimers(time.Second, 4*time.Second, 5*time.Second))
+
+	aor := &sip.Addr{Uri: &sip.URI{Scheme: "sip", User: "bob", Host: "example.test"}}
+	r, err := m.Register(aor, dialog.WithRegistrar(registrar.uri()))
+	require.NoError(t, err)
+	assert.Equal(t, dialog.RegistrationStatusRegistering, nextRegistrationState(t, r))
+
+	seen := map[string]bool{}
+	req, addr := registrar.receive(t, seen)
+	registrar.respond(t, addr, req, sip.StatusOK, func(msg *sip.Msg) {
+		msg.Contact = req.Contact
+	})
+	assert.Equal(t, dialog.RegistrationStatusRegistered, nextRegistrationState(t, r))
+
+	// The registrar never confirms that the binding is removed, but the manager still closes
+	start := time.Now()
+	require.NoError(t, m.Close())
+	assert.Less(t, time.Since(start), 6*time.Second)
+	req, _ = registrar.receive(t, seen)
+	assert.Equal(t, 0, req.Expires)
+
+	// The registration gives up once the socket is closed
+	assert.Equal(t, dialog.RegistrationStatusUnregistered, nextRegistrationState(t, r))
+	assert.ErrorIs(t, <-r.OnErr, dialog.ErrManagerClosed)
+}
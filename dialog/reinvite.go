@@ -0,0 +1,399 @@
+package dialog
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/safermobility/sipmanager/sdp"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+var (
+	ErrCallNotAnswered   = errors.New("the call has not been answered yet")
+	ErrReinvitePending   = errors.New("another INVITE is already in progress for this call")
+	ErrNoLocalSDP        = errors.New("there is no previous SDP to change the direction of")
+	ErrReinviteNoPayload = errors.New("a re-INVITE needs an SDP offer")
+)
+
+// A re-INVITE requested by the application
+type reinviteRequest struct {
+	offer     *sdp.SDP           // The new offer, or nil to change the direction of the current one
+	direction sdp.MediaDirection // The new direction, if `offer` is nil
+	result    chan error
+}
+
+// Reinvite sends a new SDP offer to the remote UA within the established dialog.
+// The answer is delivered as an `EventSDP` event; if the offer is rejected, an
+// `EventError` is delivered and the previous session remains in place.
+func (d *Dialog) Reinvite(offer *sdp.SDP) error {
+	if offer == nil {
+		return ErrReinviteNoPayload
+	}
+	return d.reinvite(&reinviteRequest{offer: offer})
+}
+
+// Hold puts the remote UA on hold by re-offering our current SDP as `sendonly`
+func (d *Dialog) Hold() error {
+	return d.reinvite(&reinviteRequest{direction: sdp.SendOnly})
+}
+
+// Resume takes the remote UA off hold by re-offering our current SDP as `sendrecv`
+func (d *Dialog) Resume() error {
+	return d.reinvite(&reinviteRequest{direction: sdp.SendRecv})
+}
+
+func (d *Dialog) reinvite(r *reinviteRequest) error {
+	r.result = make(chan error, 1)
+	select {
+	case d.doReinvite <- r:
+	case <-d.done:
+		return ErrCallEnded
+	}
+	return <-r.result
+}
+
+// Start a re-INVITE requested by the application, if the dialog is able to
+func (dls *dialogState) startReinvite(r *reinviteRequest) bool {
+	if dls.state != StatusAnswered {
+		r.result <- ErrCallNotAnswered
+		return true
+	}
+	if dls.reinvite != nil || dls.reinviteOffer != nil || dls.response != nil || dls.reinviteServer != nil {
+		// RFC 3261 section 14.1: only one INVITE transaction at a time, in either direction
+		r.result <- ErrReinvitePending
+		return true
+	}
+	if dls.updateOffer != nil || dls.updateServer != nil {
+		// RFC 3311 section 5.1: only one offer at a time, in either direction
+		r.result <- ErrUpdatePending
+		return true
+	}
+
+	offer := r.offer
+	if offer == nil {
+		if dls.localSDP == nil {
+			r.result <- ErrNoLocalSDP
+			return true
+		}
+		offer = withDirection(dls.localSDP, r.direction)
+	}
+	nextVersion(offer, dls.localSDP)
+	r.result <- nil
+
+	dls.reinviteOffer = offer
+	return dls.sendReinvite()
+}
+
+// Send (or resend, after a 491 or an authentication challenge) the re-INVITE with our pending offer
+func (dls *dialogState) sendReinvite() bool {
+	request := dls.newRequest(sip.MethodInvite)
+	request.Payload = dls.reinviteOffer
+	dls.reinvite = request
+	return dls.sendRequest(request)
+}
+
+// Handle a response to a re-INVITE we sent
+func (dls *dialogState) handleReinviteResponse(tx *transaction.Client, msg *sip.Msg) bool {
+	request := tx.Request()
+
+	switch {
+	case msg.Status < sip.StatusOK:
+		return true
+	case msg.Status < sip.StatusMultipleChoices:
+		// Every 2xx must be ACK'ed, even a retransmission
+		if msg.Contact != nil && request == dls.reinvite {
+			dls.remoteTarget = msg.Contact.Uri
+		}
+		ack := dls.manager.NewAck(msg, request)
+		ack.Request = dls.remoteTarget
+		ack.Route = dls.routeSet
+		if err := dls.manager.Send(ack); err != nil {
+			dls.manager.logger.Error(
+				"unable to send ACK message",
+				util.SlogError(err),
+				slog.String("msg", msg.String()),
+			)
+		}
+		if request != dls.reinvite {
+			return true
+		}
+		dls.localSDP = dls.reinviteOffer
+		dls.startSessionTimer(msg, true)
+		dls.reinvite = nil
+		dls.reinviteOffer = nil
+		dls.checkSDP(msg)
+		return true
+	}
+
+	if request != dls.reinvite {
+		return true
+	}
+	if msg.Status == sip.StatusUnauthorized || msg.Status == sip.StatusProxyAuthenticationRequired {
+		return dls.handleAuthChallenge(tx, msg)
+	}
+	if msg.Status == sip.StatusSessionIntervalTooSmall && dls.manager.sessionTimer > 0 && msg.MinSE > seconds(dls.sessionRequest) {
+		return dls.handleIntervalTooSmall(tx, msg)
+	}
+	dls.reinvite = nil
+
+	switch msg.Status {
+	case sip.StatusRequestPending:
+		// RFC 3261 section 14.1: both sides sent a re-INVITE at the same time, so wait
+		// a random time before trying again: 2.1 to 4 seconds if we own the Call-ID,
+		// or up to 2 seconds if not
+		wait := time.Duration(rand.Intn(201)) * 10 * time.Millisecond
+		if !dls.incoming {
+			wait = 2100*time.Millisecond + time.Duration(rand.Intn(191))*10*time.Millisecond
+		}
+		dls.manager.logger.Debug(
+			"re-INVITE crossed with the remote UA's, will try again",
+			slog.Duration("wait", wait),
+		)
+		dls.reinviteTimer = time.After(wait)
+		return true
+	case sip.StatusCallTransactionDoesNotExist:
+		// RFC 3261 section 14.1: the dialog is gone
+		dls.reinviteOffer = nil
+		dls.reportError(&sip.ResponseError{Msg: msg})
+		dls.hangupCause = CauseRemoteHangup
+		dls.transition(StatusHangup, msg)
+		return false
+	case sip.StatusRequestTimeout:
+		// RFC 3261 section 14.1: the dialog should be ended
+		dls.reinviteOffer = nil
+		dls.reportError(&sip.ResponseError{Msg: msg})
+		return dls.hangup()
+	default:
+		// The offer was rejected, so the previous session remains in place
+		dls.reinviteOffer = nil
+		dls.reportError(&sip.ResponseError{Msg: msg})
+		return true
+	}
+}
+
+// The back-off after a `491 Request Pending` is over
+func (dls *dialogState) retryReinvite() bool {
+	dls.reinviteTimer = nil
+	if dls.reinviteOffer == nil || dls.state != StatusAnswered {
+		return true
+	}
+	if dls.response != nil || dls.reinviteServer != nil {
+		// The remote UA's re-INVITE has not been answered or ACK'ed yet
+		dls.reinviteTimer = time.After(dls.manager.transactions.Timers().T1)
+		return true
+	}
+	return dls.sendReinvite()
+}
+
+// Copy an SDP with every media stream set to `direction`
+func withDirection(s *sdp.SDP, direction sdp.MediaDirection) *sdp.SDP {
+	res := *s
+	res.Direction = direction
+	if s.Origin != nil {
+		origin := *s.Origin
+		res.Origin = &origin
+	}
+	res.Media = make([]*sdp.Media, len(s.Media))
+	for i, media := range s.Media {
+		m := *media
+		m.Direction = direction
+		res.Media[i] = &m
+	}
+	return &res
+}
+
+// RFC 3264 section 8: a new offer in the same session must have a higher origin version
+func nextVersion(offer, previous *sdp.SDP) {
+	if offer.Origin == nil || previous == nil || previous.Origin == nil || offer.Origin.ID != previous.Origin.ID {
+		return
+	}
+	prev, err := strconv.ParseUint(originVersion(previous.Origin), 10, 64)
+	if err != nil {
+		return
+	}
+	if cur, err := strconv.ParseUint(originVersion(offer.Origin), 10, 64); err == nil && cur > prev {
+		return
+	}
+	offer.Origin.Version = strconv.FormatUint(prev+1, 10)
+}
+
+// The version written in the o= line, which defaults to the session ID
+func originVersion(origin *sdp.Origin) string {
+	if origin.Version == "" {
+		return origin.ID
+	}
+	return origin.Version
+}
+
+// ReinviteHandler is called (in a new goroutine) for every re-INVITE received from the remote UA.
+// The handler must eventually call `Accept` or `Reject` on the re-INVITE.
+type ReinviteHandler func(*IncomingReinvite)
+
+// IncomingReinvite is a new offer (or a request for one) from the remote UA within an established dialog
+type IncomingReinvite struct {
+	Dialog *Dialog
+	Msg    *sip.Msg // The re-INVITE received from the remote UA
+	Offer  *sdp.SDP // The new offer, or nil if the remote UA wants us to make one ("late offer")
+
+	respond  chan<- *uasResponse
+	mu       sync.Mutex // Held while sending the response, so only one gets through
+	answered bool
+}
+
+// Accept sends `200 OK` with our answer to the offer, or with our offer if
+// the re-INVITE had none (in which case the answer is delivered as an `EventSDP` event).
+func (r *IncomingReinvite) Accept(payload *sdp.SDP) error {
+	if payload == nil {
+		return ErrReinviteNoPayload
+	}
+	return r.sendResponse(sip.StatusOK, payload)
+}
+
+// Reject refuses the new offer, leaving the session unchanged. The status is usually
+// `488 Not Acceptable Here`, or `491 Request Pending` to make the remote UA try again later.
+func (r *IncomingReinvite) Reject(status int) error {
+	if status < sip.StatusMultipleChoices {
+		return ErrInvalidFinalStatus
+	}
+	return r.sendResponse(status, nil)
+}
+
+func (r *IncomingReinvite) sendResponse(status int, payload *sdp.SDP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.answered {
+		return ErrCallAlreadyAnswered
+	}
+	select {
+	case r.respond <- &uasResponse{status: status, payload: payload}:
+		r.answered = true
+		return nil
+	case <-r.Dialog.done:
+		return ErrCallEnded
+	}
+}
+
+// Handle a re-INVITE from the remote UA
+func (dls *dialogState) handleReinvite(tx *transaction.Server, msg *sip.Msg) bool {
+	if !dls.manager.allowReinvite {
+		return dls.reply(tx, msg, sip.StatusMethodNotAllowed)
+	}
+	if dls.reinviteServer != nil {
+		// RFC 3261 section 14.2: we have not answered the previous re-INVITE yet
+		return dls.replyRetryLater(tx, msg)
+	}
+	if dls.updateOffer != nil || dls.updateServer != nil {
+		// RFC 3311 section 5.1: an offer in an UPDATE has not been answered yet
+		return dls.reply(tx, msg, sip.StatusRequestPending)
+	}
+	if dls.reinvite != nil || dls.reinviteOffer != nil || dls.response != nil {
+		// RFC 3261 section 14.2: our own re-INVITE is still in progress
+		return dls.reply(tx, msg, sip.StatusRequestPending)
+	}
+	if !dls.manager.checkSessionInterval(tx, msg, dls.minSE) {
+		return true
+	}
+
+	// The new target and offer only take effect if we accept the re-INVITE
+	dls.reportSDP(msg)
+	offer, _ := msg.Payload.(*sdp.SDP)
+
+	handler := dls.manager.reinviteHandler
+	if handler == nil {
+		// Keep the current session, agreeing to whatever direction the remote UA asked for
+		if dls.localSDP == nil {
+			return dls.reply(tx, msg, sip.StatusNotAcceptableHere)
+		}
+		payload := dls.localSDP
+		if offer != nil {
+			payload = withDirection(dls.localSDP, answerDirection(offer))
+			nextVersion(payload, dls.localSDP)
+		}
+		dls.reinviteServer = tx
+		return dls.answerReinvite(&uasResponse{status: sip.StatusOK, payload: payload})
+	}
+
+	if !dls.reply(tx, msg, sip.StatusTrying) {
+		return false
+	}
+	respond := make(chan *uasResponse)
+	dls.reinviteServer = tx
+	dls.reinviteRespond = respond
+	go handler(&IncomingReinvite{
+		Dialog:  dls.dialog,
+		Msg:     msg,
+		Offer:   offer,
+		respond: respond,
+	})
+	return true
+}
+
+// Refuse a request with an offer while we are still answering an earlier one,
+// asking the remote UA to try again after a random time (RFC 3261 section 14.2)
+func (dls *dialogState) replyRetryLater(tx *transaction.Server, msg *sip.Msg) bool {
+	response := dls.manager.NewResponse(msg, sip.StatusInternalServerError)
+	response.RetryAfter = strconv.Itoa(rand.Intn(11))
+	if err := tx.Respond(response); err != nil {
+		dls.manager.logger.Error(
+			fmt.Sprintf("unable to send '500 Internal Server Error' reply to incoming '%s' message", msg.Method),
+			util.SlogError(err),
+			slog.String("packet", msg.String()),
+		)
+		return false
+	}
+	return true
+}
+
+// Send the final response to the remote UA's re-INVITE
+func (dls *dialogState) answerReinvite(r *uasResponse) bool {
+	tx := dls.reinviteServer
+	dls.reinviteServer = nil
+	dls.reinviteRespond = nil
+
+	msg := dls.manager.NewResponse(tx.Request(), r.status)
+	if r.status < sip.StatusMultipleChoices {
+		msg.Contact = dls.manager.contact
+	}
+	if r.payload != nil {
+		msg.Payload = r.payload
+		dls.populateSDP(msg)
+		dls.localSDP = r.payload
+	}
+	if r.status >= sip.StatusOK && r.status < sip.StatusMultipleChoices {
+		request := tx.Request()
+		if request.Contact != nil {
+			dls.remoteTarget = request.Contact.Uri
+		}
+		if offer, ok := request.Payload.(*sdp.SDP); ok {
+			dls.remoteSDP = offer
+		}
+		dls.answerSessionTimer(request, msg)
+		dls.startSessionTimer(msg, false)
+	}
+	return dls.sendResponse(tx, msg)
+}
+
+// The direction of our answer that matches the direction of the remote UA's offer
+func answerDirection(offer *sdp.SDP) sdp.MediaDirection {
+	direction := offer.Direction
+	if len(offer.Media) > 0 && offer.Media[0].Direction != "" {
+		direction = offer.Media[0].Direction
+	}
+	switch direction {
+	case sdp.SendOnly:
+		return sdp.RecvOnly
+	case sdp.RecvOnly:
+		return sdp.SendOnly
+	case sdp.Inactive:
+		return sdp.Inactive
+	default:
+		return sdp.SendRecv
+	}
+}
@@ -0,0 +1,259 @@
+package dialog_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sdp"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHoldRetriesAfterRequestPending(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	// Answer the call
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	to := invite.To.Copy().Tag()
+	answer := func(req *sip.Msg, status int, payload *sdp.SDP) {
+		callee.respond(t, addr, req, status, func(msg *sip.Msg) {
+			msg.To = to
+			msg.Contact = &sip.Addr{Uri: callee.uri()}
+			if payload != nil {
+				msg.Payload = payload
+			}
+		})
+	}
+	answer(invite, sip.StatusOK, newTestSDP(5000))
+	ack, _ := callee.receive(t, seen)
+	assert.Equal(t, sip.MethodAck, ack.Method)
+	w.waitState(t, dialog.StatusAnswered)
+	w.nextPeer(t)
+
+	require.NoError(t, d.Hold())
+	assert.ErrorIs(t, d.Hold(), dialog.ErrReinvitePending)
+
+	reinvite, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodInvite, reinvite.Method)
+	assert.Greater(t, reinvite.CSeq, invite.CSeq)
+	assert.Equal(t, to.Param.Get("tag"), reinvite.To.Param.Get("tag"))
+	offer, ok := reinvite.Payload.(*sdp.SDP)
+	require.True(t, ok)
+	assert.Equal(t, sdp.SendOnly, offer.Direction)
+
+	// A 491 is retried after a random delay of 2.1 to 4s, because we own the Call-ID
+	answer(reinvite, sip.StatusRequestPending, nil)
+	start := time.Now()
+	ack, _ = callee.receive(t, seen)
+	assert.Equal(t, sip.MethodAck, ack.Method)
+	retry, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodInvite, retry.Method)
+	assert.GreaterOrEqual(t, time.Since(start), 2*time.Second)
+	assert.Less(t, time.Since(start), 4100*time.Millisecond)
+	assert.Greater(t, retry.CSeq, reinvite.CSeq)
+
+	answer(retry, sip.StatusOK, newTestSDP(6000))
+	ack, _ = callee.receive(t, seen)
+	assert.Equal(t, sip.MethodAck, ack.Method)
+	assert.Equal(t, retry.CSeq, ack.CSeq)
+	peer := w.nextPeer(t)
+	assert.Equal(t, uint16(6000), peer.Payload.Media[0].Port)
+
+	// Resuming needs a new origin version
+	require.NoError(t, d.Resume())
+	resume, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodInvite, resume.Method)
+	resumed := resume.Payload.(*sdp.SDP)
+	assert.Equal(t, sdp.SendRecv, resumed.Direction)
+	assert.NotEqual(t, offer.Origin.Version, resumed.Origin.Version)
+	answer(resume, sip.StatusOK, newTestSDP(6000))
+	w.nextPeer(t)
+}
+
+// Set up a call between two managers and wait until it is answered
+func newTestCall(t *testing.T, callerOpts, calleeOpts []dialog.ManagerOption) (out, in *watcher, outDialog *dialog.Dialog) {
+	t.Helper()
+	calls := make(chan *dialog.IncomingCall, 1)
+	callee := newTestManager(t, append(calleeOpts, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		calls <- call
+	}))...)
+	caller := newTestManager(t, callerOpts...)
+
+	d, err := caller.NewDialog(newTestInvite(callee))
+	require.NoError(t, err)
+	out = watch(d)
+
+	var call *dialog.IncomingCall
+	select {
+	case call = <-calls:
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for incoming call")
+	}
+	in = watch(call.Dialog)
+	require.NoError(t, call.Accept(newTestSDP(5000)))
+	out.waitState(t, dialog.StatusAnswered)
+	in.waitState(t, dialog.StatusAnswered)
+	out.nextPeer(t)
+	return out, in, d
+}
+
+func TestReinviteAnsweredByApplication(t *testing.T) {
+	reinvites := make(chan *dialog.IncomingReinvite, 1)
+	out, in, d := newTestCall(t, nil, []dialog.ManagerOption{
+		dialog.WithReinviteHandler(func(r *dialog.IncomingReinvite) {
+			reinvites <- r
+		}),
+	})
+
+	require.NoError(t, d.Hold())
+	r := <-reinvites
+	require.NotNil(t, r.Offer)
+	assert.Equal(t, sdp.SendOnly, r.Offer.Direction)
+	in.nextPeer(t)
+	// Only one of two concurrent responses is sent
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- r.Reject(sip.StatusNotAcceptableHere) }()
+	}
+	assert.ElementsMatch(t, []error{nil, dialog.ErrCallAlreadyAnswered}, []error{<-errs, <-errs})
+
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, out.nextErr(t), &rerr)
+	assert.Equal(t, sip.StatusNotAcceptableHere, rerr.Msg.Status)
+	// A rejected offer does not change the session
+	require.NotNil(t, r.Dialog.RemoteSDP())
+	assert.NotEqual(t, sdp.SendOnly, r.Dialog.RemoteSDP().Direction)
+
+	// The call survives a rejected offer
+	require.NoError(t, d.Hold())
+	r = <-reinvites
+	in.nextPeer(t)
+	answer := newTestSDP(7000)
+	answer.Direction = sdp.RecvOnly
+	require.NoError(t, r.Accept(answer))
+	peer := out.nextPeer(t)
+	assert.Equal(t, sdp.RecvOnly, peer.Payload.Direction)
+	assert.Equal(t, uint16(7000), peer.Payload.Media[0].Port)
+	assert.Eventually(t, func() bool {
+		return r.Dialog.RemoteSDP().Direction == sdp.SendOnly
+	}, testTimeout, 10*time.Millisecond)
+}
+
+func TestReinviteRefusedWhenNotAllowed(t *testing.T) {
+	out, _, d := newTestCall(t, nil, nil)
+
+	require.NoError(t, d.Hold())
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, out.nextErr(t), &rerr)
+	assert.Equal(t, sip.StatusMethodNotAllowed, rerr.Msg.Status)
+}
+
+func TestLateOfferReinvite(t *testing.T) {
+	caller := newFakePeer(t)
+	calls := make(chan *dialog.IncomingCall, 1)
+	callee := newTestManager(t,
+		dialog.WithAllowReinvite(true),
+		dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+			calls <- call
+		}),
+	)
+
+	target := &sip.URI{Scheme: "sip", User: "bob", Host: callee.PublicAddress().String(), Port: callee.PublicPort()}
+	from := &sip.Addr{Uri: caller.uri(), Param: &sip.Param{Name: "tag", Value: "caller"}}
+	invite := &sip.Msg{
+		Method:  sip.MethodInvite,
+		Request: target,
+		From:    from,
+		To:      &sip.Addr{Uri: target},
+		CallID:  "late-offer-test",
+		CSeq:    1,
+		Payload: newTestSDP(4000),
+	}
+	caller.send(t, callee, invite)
+
+	call := <-calls
+	in := watch(call.Dialog)
+	require.NoError(t, call.Accept(newTestSDP(5000)))
+	ok := caller.response(t)
+	require.Equal(t, sip.StatusOK, ok.Status)
+	caller.send(t, callee, &sip.Msg{Method: sip.MethodAck, Request: ok.Contact.Uri, From: from, To: ok.To, CallID: invite.CallID, CSeq: 1})
+	in.waitState(t, dialog.StatusAnswered)
+
+	// A re-INVITE without SDP gets our offer in the 200, and the answer comes in the ACK
+	caller.send(t, callee, &sip.Msg{Method: sip.MethodInvite, Request: ok.Contact.Uri, From: from, To: ok.To, CallID: invite.CallID, CSeq: 2})
+	ok = caller.response(t)
+	require.Equal(t, sip.StatusOK, ok.Status)
+	offer, isSDP := ok.Payload.(*sdp.SDP)
+	require.True(t, isSDP)
+	assert.Equal(t, uint16(5000), offer.Media[0].Port)
+
+	caller.send(t, callee, &sip.Msg{Method: sip.MethodAck, Request: ok.Contact.Uri, From: from, To: ok.To, CallID: invite.CallID, CSeq: 2, Payload: newTestSDP(8000)})
+	assert.Equal(t, uint16(8000), in.nextPeer(t).Payload.Media[0].Port)
+}
+
+func TestRejectedReinviteKeepsTarget(t *testing.T) {
+	caller := newFakePeer(t)
+	calls := make(chan *dialog.IncomingCall, 1)
+	callee := newTestManager(t,
+		dialog.WithAllowReinvite(true),
+		dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+			calls <- call
+		}),
+		dialog.WithReinviteHandler(func(r *dialog.IncomingReinvite) {
+			r.Reject(sip.StatusNotAcceptableHere)
+		}),
+	)
+
+	target := &sip.URI{Scheme: "sip", User: "bob", Host: callee.PublicAddress().String(), Port: callee.PublicPort()}
+	from := &sip.Addr{Uri: caller.uri(), Param: &sip.Param{Name: "tag", Value: "caller"}}
+	invite := &sip.Msg{
+		Method:  sip.MethodInvite,
+		Request: target,
+		From:    from,
+		To:      &sip.Addr{Uri: target},
+		CallID:  "rejected-reinvite-test",
+		CSeq:    1,
+		Payload: newTestSDP(4000),
+	}
+	caller.send(t, callee, invite)
+
+	call := <-calls
+	in := watch(call.Dialog)
+	require.NoError(t, call.Accept(newTestSDP(5000)))
+	ok := caller.response(t)
+	require.Equal(t, sip.StatusOK, ok.Status)
+	caller.send(t, callee, &sip.Msg{Method: sip.MethodAck, Request: ok.Contact.Uri, From: from, To: ok.To, CallID: invite.CallID, CSeq: 1})
+	in.waitState(t, dialog.StatusAnswered)
+
+	// The re-INVITE is refused, so its new Contact is not our next target
+	moved := caller.uri()
+	moved.User = "moved"
+	caller.send(t, callee, &sip.Msg{
+		Method:  sip.MethodInvite,
+		Request: ok.Contact.Uri,
+		From:    from,
+		To:      ok.To,
+		Contact: &sip.Addr{Uri: moved},
+		CallID:  invite.CallID,
+		CSeq:    2,
+		Payload: newTestSDP(6000),
+	})
+	assert.Equal(t, sip.StatusNotAcceptableHere, caller.response(t).Status)
+
+	call.Dialog.Hangup()
+	bye, addr := caller.receive(t, map[string]bool{})
+	require.Equal(t, sip.MethodBye, bye.Method)
+	assert.Empty(t, bye.Request.User)
+	caller.respond(t, addr, bye, sip.StatusOK, nil)
+	in.waitState(t, dialog.StatusHangup)
+}
@@ -0,0 +1,115 @@
+package dialog
+
+import (
+	"log/slog"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+// DialogID identifies an established dialog by its Call-ID and the tags of both sides
+type DialogID struct {
+	CallID    sip.CallID
+	LocalTag  string
+	RemoteTag string
+}
+
+// TransferTo asks the remote UA to replace `other` (usually a consultation call
+// with the transfer target) with a new call of its own, joining the two remote
+// parties together (an "attended" transfer, RFC 5589 section 7). The REFER's
+// `Refer-To` is the remote target of `other`, with a `Replaces` header (RFC 3891)
+// that identifies that dialog.
+func (d *Dialog) TransferTo(other *Dialog, opts ...TransferOption) (*Transfer, error) {
+	if other == nil {
+		return nil, ErrTransferNoTarget
+	}
+	id, target := other.identity()
+	if target == nil {
+		return nil, ErrCallNotAnswered
+	}
+
+	// The tags are from the point of view of the transfer target
+	replaces := &sip.Replaces{CallID: id.CallID, ToTag: id.RemoteTag, FromTag: id.LocalTag}
+	referTo := target.Copy()
+	referTo.Header = &sip.URIHeader{Name: "Replaces", Value: replaces.String()}
+	return d.transfer("<"+referTo.String()+">", opts)
+}
+
+// The identity of the dialog, and where requests within it are sent.
+// The target is nil until the dialog is established.
+func (d *Dialog) identity() (DialogID, *sip.URI) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.id, d.remoteTarget
+}
+
+// The dialog is now established: make its identity available to other goroutines,
+// and end the dialog it replaces, if any
+func (dls *dialogState) established() {
+	dls.dialog.mu.Lock()
+	dls.dialog.id = DialogID{
+		CallID:    dls.callID,
+		LocalTag:  tagOf(dls.localAddr),
+		RemoteTag: tagOf(dls.remoteAddr),
+	}
+	dls.dialog.mu.Unlock()
+	dls.publish()
+	dls.recordAnswer()
+	dls.startDurationTimer()
+
+	if dls.replaces != nil {
+		// RFC 3891 section 3: the replaced dialog ends once its replacement is established
+		go dls.replaces.Hangup()
+		dls.replaces = nil
+	}
+}
+
+// Find the established dialog that an incoming INVITE wants to replace.
+// If there isn't one, the status to refuse the INVITE with is returned instead.
+func (m *Manager) findReplaced(r *sip.Replaces) (*Dialog, int) {
+	dls := m.findDialog(r.CallID, r.ToTag)
+	if dls == nil {
+		return nil, sip.StatusCallTransactionDoesNotExist
+	}
+	// Early dialogs have no identity yet, so they can't be matched
+	id, _ := dls.dialog.identity()
+	if id != (DialogID{CallID: r.CallID, LocalTag: r.ToTag, RemoteTag: r.FromTag}) {
+		return nil, sip.StatusCallTransactionDoesNotExist
+	}
+	if r.EarlyOnly {
+		return nil, sip.StatusBusyHere
+	}
+	return dls.dialog, 0
+}
+
+// Check the `Replaces` header of a new INVITE. Returns false if the INVITE was refused.
+func (m *Manager) checkReplaces(tx *transaction.Server, msg *sip.Msg) (*Dialog, bool) {
+	if msg.Replaces == nil {
+		return nil, true
+	}
+	replaced, status := m.findReplaced(msg.Replaces)
+	if replaced != nil {
+		return replaced, true
+	}
+	m.logger.Warn(
+		"refusing INVITE that replaces an unknown dialog",
+		slog.String("replaces", msg.Replaces.String()),
+	)
+	if err := tx.Respond(m.NewResponse(msg, status)); err != nil {
+		m.logger.Error(
+			"unable to send reply to incoming 'INVITE' message with 'Replaces'",
+			util.SlogError(err),
+			slog.String("packet", msg.String()),
+		)
+	}
+	return nil, false
+}
+
+// The tag parameter of a `From` or `To` address
+func tagOf(addr *sip.Addr) string {
+	if tag := addr.Param.Get("tag"); tag != nil {
+		return tag.Value
+	}
+	return ""
+}
@@ -1,7 +1,6 @@
 package dialog
 
 import (
-	"errors"
 	"log/slog"
 	"net"
 	"strconv"
@@ -21,16 +20,14 @@ func (m *Manager) PopulateMessage(via *sip.Via, contact *sip.Addr, msg *sip.Msg)
 		if msg.Via == nil {
 			msg.Via = via
 		}
-		if msg.Contact == nil {
+		if msg.Contact == nil && msg.Method != sip.MethodMessage {
+			// RFC 3428 section 10: a MESSAGE must not carry a Contact
 			msg.Contact = contact
 		}
 		if msg.To == nil {
 			msg.To = &sip.Addr{Uri: msg.Request}
 		}
-		if msg.From == nil {
-			msg.From = msg.Contact.Copy()
-			msg.From.Uri.Param = nil
-		}
+		m.populateFrom(msg)
 		if msg.CallID == "" {
 			msg.CallID = sip.CallID(util.GenerateCallID())
 		}
@@ -53,19 +50,32 @@ func (m *Manager) PopulateMessage(via *sip.Via, contact *sip.Addr, msg *sip.Msg)
 				Next:  msg.Via.Param,
 			}
 		}
-		if msg.From.Param.Get("tag") == nil {
-			msg.From.Param = &sip.Param{
-				Name:  "tag",
-				Value: util.GenerateTag(),
-				Next:  msg.From.Param,
-			}
+	}
+}
+
+// Fill in the From header of a request, and its tag
+func (m *Manager) populateFrom(msg *sip.Msg) {
+	if msg.From == nil {
+		contact := msg.Contact
+		if contact == nil {
+			contact = m.contact
+		}
+		msg.From = contact.Copy()
+		msg.From.Uri.Param = nil
+	}
+	if msg.From.Param.Get("tag") == nil {
+		msg.From.Param = &sip.Param{
+			Name:  "tag",
+			Value: util.GenerateTag(),
+			Next:  msg.From.Param,
 		}
 	}
 }
 
 func RouteMessage(via *sip.Via, contact *sip.Addr, msg *sip.Msg) (host string, port uint16, err error) {
 	if msg.IsResponse() {
-		if via.CompareHostPort(msg.Via) {
+		if via.CompareHostPort(msg.Via) && msg.Via.Next != nil {
+			// Unless the request came from us (a call to ourselves)
 			msg.Via = msg.Via.Next
 		}
 
@@ -90,9 +100,6 @@ func RouteMessage(via *sip.Via, contact *sip.Addr, msg *sip.Msg) (host string, p
 			msg.Route = msg.Route.Next
 		}
 		if msg.Route != nil {
-			if msg.Method == "REGISTER" {
-				return "", 0, errors.New("Don't route REGISTER requests")
-			}
 			if msg.Route.Uri.Param.Get("lr") != nil {
 				// RFC3261 16.12.1.1 Basic SIP Trapezoid
 				host, port = msg.Route.Uri.Host, msg.Route.Uri.Port
@@ -0,0 +1,58 @@
+package dialog
+
+import (
+	"context"
+)
+
+// Shutdown ends everything the manager is doing, then closes it. New calls are
+// refused from the start. Calls that have not been answered are cancelled (or
+// declined, if incoming), answered calls are hung up, and Shutdown waits for
+// them to end. Then registrations are removed and subscriptions ended, and
+// the socket is closed.
+//
+// The calls that may not have ended for the remote UA are returned: those
+// whose BYE or CANCEL failed, such as with a `408 Request Timeout` or
+// `503 Service Unavailable`. If `ctx` is done first, the calls that had not
+// ended are returned too, along with `ctx.Err()`; they, and any registrations
+// and subscriptions still ending, are abandoned when the socket closes.
+func (m *Manager) Shutdown(ctx context.Context) ([]*Dialog, error) {
+	dialogs := m.closeDialogs()
+	for _, dls := range dialogs {
+		go dls.dialog.Hangup()
+	}
+	for _, dls := range dialogs {
+		select {
+		case <-dls.doneChan:
+		case <-ctx.Done():
+		}
+	}
+
+	var unended []*Dialog
+	for _, dls := range dialogs {
+		select {
+		case <-dls.doneChan:
+			if dls.dialog.endUnconfirmed() {
+				unended = append(unended, dls.dialog)
+			}
+		default:
+			unended = append(unended, dls.dialog)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.unregisterAll(ctx)
+		m.closeSubscriptions()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	err := m.closeTransport()
+	if ctx.Err() != nil {
+		return unended, ctx.Err()
+	}
+	return unended, err
+}
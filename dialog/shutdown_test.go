@@ -0,0 +1,132 @@
+package dialog_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown(t *testing.T) {
+	answered := make(chan *watcher, 1)
+	callee := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		answered <- watch(call.Dialog)
+		assert.NoError(t, call.Accept(call.RemoteSDP))
+	}))
+	ringing := newFakePeer(t)
+	caller := newTestManager(t)
+
+	d, err := caller.NewDialog(newTestInvite(callee))
+	require.NoError(t, err)
+	watch(d).waitState(t, dialog.StatusAnswered)
+	in := <-answered
+
+	target := ringing.uri()
+	target.User = "bob"
+	early, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4002)})
+	require.NoError(t, err)
+	earlyW := watch(early)
+	seen := map[string]bool{}
+	invite, addr := ringing.receive(t, seen)
+	to := invite.To.Copy().Tag()
+	ringing.respond(t, addr, invite, sip.StatusRinging, func(msg *sip.Msg) { msg.To = to })
+	earlyW.waitState(t, dialog.StatusRinging)
+
+	result := make(chan []*dialog.Dialog, 1)
+	go func() {
+		unended, err := caller.Shutdown(context.Background())
+		assert.NoError(t, err)
+		result <- unended
+	}()
+
+	// The ringing call is cancelled, and the answered one is hung up
+	cancel, _ := ringing.receive(t, seen)
+	require.Equal(t, sip.MethodCancel, cancel.Method)
+	ringing.respond(t, addr, cancel, sip.StatusOK, nil)
+	ringing.respond(t, addr, invite, sip.StatusRequestTerminated, func(msg *sip.Msg) { msg.To = to })
+	in.waitState(t, dialog.StatusHangup)
+
+	select {
+	case unended := <-result:
+		assert.Empty(t, unended)
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for shutdown")
+	}
+
+	_, err = caller.NewDialog(newTestInvite(callee))
+	assert.ErrorIs(t, err, dialog.ErrManagerClosed)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+	invite, addr := callee.receive(t, map[string]bool{})
+	callee.respond(t, addr, invite, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = invite.To.Copy().Tag()
+		msg.Contact = &sip.Addr{Uri: callee.uri()}
+		msg.Payload = newTestSDP(5000)
+	})
+	w.waitState(t, dialog.StatusAnswered)
+
+	// The callee never answers the BYE
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	unended, err := caller.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, []*dialog.Dialog{d}, unended)
+	assert.ErrorIs(t, w.nextErr(t), dialog.ErrManagerClosed)
+}
+
+func TestShutdownByeFailed(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	callee.respond(t, addr, invite, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = invite.To.Copy().Tag()
+		msg.Contact = &sip.Addr{Uri: callee.uri()}
+		msg.Payload = newTestSDP(5000)
+	})
+	require.Equal(t, dialog.StatusAnswered, nextEventOf(t, d, dialog.EventState).State)
+
+	result := make(chan []*dialog.Dialog, 1)
+	go func() {
+		unended, err := caller.Shutdown(context.Background())
+		assert.NoError(t, err)
+		result <- unended
+	}()
+
+	ack, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodAck, ack.Method)
+
+	// The call is over for us, but the callee may not know it
+	bye, _ := callee.receive(t, seen)
+	require.Equal(t, sip.MethodBye, bye.Method)
+	callee.respond(t, addr, bye, sip.StatusServiceUnavailable, nil)
+	assert.Equal(t, dialog.CauseUnavailable, nextEventOf(t, d, dialog.EventError).Cause)
+	final := nextEventOf(t, d, dialog.EventState)
+	assert.Equal(t, dialog.StatusHangup, final.State)
+	assert.Equal(t, dialog.CauseUnavailable, final.Cause)
+
+	select {
+	case unended := <-result:
+		assert.Equal(t, []*dialog.Dialog{d}, unended)
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for shutdown")
+	}
+}
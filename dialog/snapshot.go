@@ -0,0 +1,123 @@
+package dialog
+
+import (
+	"github.com/safermobility/sipmanager/sdp"
+	"github.com/safermobility/sipmanager/sip"
+)
+
+// DialogSnapshot is the state of a dialog at one moment, for correlating calls
+// with media sessions and call records. The SDPs are shared with the dialog,
+// and must not be modified.
+type DialogSnapshot struct {
+	Dialog       *Dialog
+	ID           DialogID  // Only the Call-ID is set until the dialog is established
+	Incoming     bool      // Whether the remote UA sent the INVITE
+	State        Status    // The latest state reported on `OnEvent`
+	RemoteTarget *sip.URI  // Where requests within the dialog are sent; nil until it is established
+	RouteSet     *sip.Addr // The Route headers for requests within the dialog
+	LocalSeq     int       // The CSeq of our latest request
+	RemoteSeq    int       // The CSeq of the remote UA's latest request
+	LocalSDP     *sdp.SDP  // The latest SDP offer or answer we sent
+	RemoteSDP    *sdp.SDP  // The latest SDP offer or answer the remote UA sent
+}
+
+// ID identifies the dialog. Only the Call-ID is set until the dialog is established.
+func (d *Dialog) ID() DialogID {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.id.CallID == "" {
+		return DialogID{CallID: d.callID}
+	}
+	return d.id
+}
+
+// CallID is the Call-ID of the dialog, which is known from the start
+func (d *Dialog) CallID() sip.CallID {
+	return d.callID
+}
+
+// RemoteTarget is where requests within the dialog are sent (the remote Contact),
+// or nil until the dialog is established
+func (d *Dialog) RemoteTarget() *sip.URI {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.remoteTarget
+}
+
+// LocalSDP is the latest SDP offer or answer we sent, if any
+func (d *Dialog) LocalSDP() *sdp.SDP {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.localSDP
+}
+
+// RemoteSDP is the latest SDP offer or answer the remote UA sent, if any
+func (d *Dialog) RemoteSDP() *sdp.SDP {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.remoteSDP
+}
+
+// Snapshot returns the state of the dialog, all taken at the same moment
+func (d *Dialog) Snapshot() DialogSnapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.id
+	if id.CallID == "" {
+		id.CallID = d.callID
+	}
+	return DialogSnapshot{
+		Dialog:       d,
+		ID:           id,
+		Incoming:     d.incoming,
+		State:        d.state,
+		RemoteTarget: d.remoteTarget,
+		RouteSet:     d.routeSet,
+		LocalSeq:     d.localSeq,
+		RemoteSeq:    d.remoteSeq,
+		LocalSDP:     d.localSDP,
+		RemoteSDP:    d.remoteSDP,
+	}
+}
+
+// Dialogs returns a snapshot of every call in progress
+func (m *Manager) Dialogs() []DialogSnapshot {
+	m.dialogsMu.Lock()
+	dialogs := make([]*Dialog, 0, len(m.dialogs))
+	for _, byCallID := range m.dialogs {
+		for _, dls := range byCallID {
+			dialogs = append(dialogs, dls.dialog)
+		}
+	}
+	m.dialogsMu.Unlock()
+
+	snapshots := make([]DialogSnapshot, len(dialogs))
+	for i, d := range dialogs {
+		snapshots[i] = d.Snapshot()
+	}
+	return snapshots
+}
+
+// Make the current state of the dialog available to other goroutines
+func (dls *dialogState) publish() {
+	d := dls.dialog
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state = dls.state
+	if d.id.CallID != "" {
+		d.remoteTarget = dls.remoteTarget
+	}
+	d.routeSet = dls.routeSet
+	d.localSeq = dls.lSeq
+	d.remoteSeq = dls.rSeq
+	d.localSDP = dls.localSDP
+	d.remoteSDP = dls.remoteSDP
+	d.endErr = dls.endError
+}
+
+// Whether the call ended without the remote UA confirming it, so it may still think the call is up
+func (d *Dialog) endUnconfirmed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.endErr != nil
+}
@@ -0,0 +1,64 @@
+package dialog_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialogSnapshot(t *testing.T) {
+	calls := make(chan *dialog.IncomingCall, 1)
+	callee := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		calls <- call
+	}))
+	caller := newTestManager(t)
+
+	invite := newTestInvite(callee)
+	out, err := caller.NewDialog(invite)
+	require.NoError(t, err)
+	outW := watch(out)
+	assert.Equal(t, invite.CallID, out.CallID())
+	assert.Equal(t, dialog.DialogID{CallID: invite.CallID}, out.ID())
+	assert.Nil(t, out.RemoteTarget())
+
+	var in *dialog.IncomingCall
+	select {
+	case in = <-calls:
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for incoming call")
+	}
+	inW := watch(in.Dialog)
+	require.NoError(t, in.Accept(in.RemoteSDP))
+	outW.waitState(t, dialog.StatusAnswered)
+	inW.waitState(t, dialog.StatusAnswered)
+
+	// Both sides agree on the dialog, from their own points of view
+	id := out.ID()
+	assert.NotEmpty(t, id.LocalTag)
+	assert.NotEmpty(t, id.RemoteTag)
+	assert.Equal(t, dialog.DialogID{CallID: id.CallID, LocalTag: id.RemoteTag, RemoteTag: id.LocalTag}, in.Dialog.ID())
+	assert.Equal(t, callee.PublicPort(), out.RemoteTarget().Port)
+	assert.Same(t, invite.Payload, out.LocalSDP())
+	require.NotNil(t, out.RemoteSDP())
+	assert.Equal(t, string(in.RemoteSDP.Data()), string(out.RemoteSDP().Data()))
+	assert.Same(t, in.RemoteSDP, in.Dialog.LocalSDP())
+
+	snapshots := caller.Dialogs()
+	require.Len(t, snapshots, 1)
+	snapshot := snapshots[0]
+	assert.Same(t, out, snapshot.Dialog)
+	assert.Equal(t, id, snapshot.ID)
+	assert.False(t, snapshot.Incoming)
+	assert.Equal(t, dialog.StatusAnswered, snapshot.State)
+	assert.Equal(t, invite.CSeq, snapshot.LocalSeq)
+	assert.True(t, callee.Dialogs()[0].Incoming)
+
+	out.Hangup()
+	outW.waitState(t, dialog.StatusHangup)
+	inW.waitState(t, dialog.StatusHangup)
+	assert.Equal(t, dialog.StatusHangup, out.Snapshot().State)
+	assert.Eventually(t, func() bool { return len(caller.Dialogs()) == 0 }, testTimeout, 10*time.Millisecond)
+}
@@ -0,0 +1,423 @@
+package dialog
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+const (
+	defaultSubscribeExpires = time.Hour
+	defaultSubscribeRetry   = time.Minute
+	subscribeRefreshMargin  = 30 * time.Second // Refresh this long before a subscription expires (or halfway, if sooner)
+)
+
+var (
+	ErrSubscriptionRejected   = errors.New("the notifier ended the subscription")
+	ErrSubscriptionNotifyBody = errors.New("unable to parse the body of a NOTIFY")
+)
+
+// The "public" interface of a subscription to an event package at a notifier.
+// Events are buffered, so a slow reader does not delay refreshes;
+// if the buffer fills up, further events are dropped.
+type Subscription struct {
+	OnErr    <-chan error
+	OnState  <-chan SubscriptionStatus
+	OnNotify <-chan *Notification
+
+	doUnsubscribe chan<- struct{}
+	done          <-chan struct{}
+	unsubscribe   sync.Once
+}
+
+// A NOTIFY received for a subscription
+type Notification struct {
+	State *sip.SubscriptionState
+	Body  any // The body, as parsed by the event package, or nil if there is none
+	Msg   *sip.Msg
+}
+
+// The "internal" interface of a subscription
+type subscriberState struct {
+	*subscriptionDialog
+	errChan         chan<- error
+	stateChan       chan<- SubscriptionStatus
+	notifyChan      chan<- *Notification
+	unsubscribeChan <-chan struct{}
+	state           SubscriptionStatus // Most recently reported state.
+	pkg             EventPackage       // The event package we subscribe to.
+	target          *sip.URI           // The resource we subscribe to, used as the Request-URI and `To` header.
+	from            *sip.Addr          // The `From` header, without a tag.
+	expires         time.Duration      // The subscription duration we ask for.
+	retry           time.Duration      // How long to wait before subscribing again, if the notifier gave no time.
+	request         *sip.Msg           // The SUBSCRIBE currently in progress.
+	established     bool               // Whether the notifier has created the dialog, with a 2xx or a NOTIFY.
+	timer           <-chan time.Time   // Fires when the subscription should be refreshed, or made again.
+	unsubscribing   bool               // Whether we are ending the subscription.
+	credentials     CredentialProvider // Overrides the manager's credentials for this subscription, if set.
+	nonceCounts     map[string]int     // Digest authentication nonce counts, by nonce.
+}
+
+// Subscribe asks `target` to notify us of the state of the event package `pkg`
+// (RFC 6665), and keeps refreshing the subscription until `Unsubscribe` is called,
+// the notifier ends it, or the manager is closed.
+func (m *Manager) Subscribe(target *sip.URI, pkg EventPackage, opts ...SubscriptionOption) (*Subscription, error) {
+	if target == nil || target.Host == "" {
+		return nil, ErrSubscriptionNoTarget
+	}
+
+	errChan := make(chan error, subscriptionEventQueue)
+	stateChan := make(chan SubscriptionStatus, subscriptionEventQueue)
+	notifyChan := make(chan *Notification, subscriptionEventQueue)
+	unsubscribeChan := make(chan struct{})
+
+	from := m.contact.Copy()
+	from.Uri.Scheme = "sip"
+	from.Uri.Param = nil
+
+	ss := &subscriberState{
+		subscriptionDialog: m.newSubscriptionDialog(),
+		errChan:            errChan,
+		stateChan:          stateChan,
+		notifyChan:         notifyChan,
+		unsubscribeChan:    unsubscribeChan,
+		pkg:                pkg,
+		target:             target,
+		from:               from,
+		expires:            defaultSubscribeExpires,
+		retry:              defaultSubscribeRetry,
+	}
+	for _, opt := range opts {
+		if err := opt(ss); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Subscription{
+		OnErr:         errChan,
+		OnState:       stateChan,
+		OnNotify:      notifyChan,
+		doUnsubscribe: unsubscribeChan,
+		done:          ss.doneChan,
+	}
+	ss.stop = s.Unsubscribe
+	ss.newDialog()
+	if !m.addSubscription(ss.subscriptionDialog) {
+		return nil, ErrManagerClosed
+	}
+	go ss.run()
+
+	return s, nil
+}
+
+// Unsubscribe ends the subscription. It returns immediately;
+// `OnState` reports `SubscriptionStatusTerminated` when it is done.
+func (s *Subscription) Unsubscribe() {
+	s.unsubscribe.Do(func() {
+		select {
+		case s.doUnsubscribe <- struct{}{}:
+		case <-s.done:
+		}
+	})
+}
+
+// Send the first SUBSCRIBE, then handle NOTIFYs, refreshes and unsubscription until done
+func (ss *subscriberState) run() {
+	defer ss.cleanup()
+	ss.transition(SubscriptionStatusSubscribing)
+	ss.subscribe(ss.expires)
+
+	for ss.state != SubscriptionStatusTerminated {
+		select {
+		case r := <-ss.responseChan:
+			ss.handleResponse(r.tx, r.msg)
+		case r := <-ss.requestChan:
+			ss.handleRequest(r.tx, r.msg)
+		case <-ss.timer:
+			ss.timer = nil
+			ss.handleTimer()
+		case <-ss.unsubscribeChan:
+			ss.unsubscribeChan = nil
+			ss.unsubscribe()
+		}
+	}
+}
+
+// Start a new dialog for the subscription, with a new Call-ID and tag
+func (ss *subscriberState) newDialog() {
+	ss.callID = sip.CallID(util.GenerateCallID())
+	ss.localAddr = ss.from.Copy().Tag()
+	ss.remoteAddr = &sip.Addr{Uri: ss.target}
+	ss.remoteTarget = ss.target
+	ss.routeSet = nil
+	ss.lSeq = util.GenerateCSeq()
+	ss.rSeq = 0
+	ss.established = false
+}
+
+// Build and send a new SUBSCRIBE, asking for the subscription to last `expires` (zero to end it)
+func (ss *subscriberState) subscribe(expires time.Duration) {
+	request := ss.newRequest(sip.MethodSubscribe)
+	request.Event = ss.pkg.Name()
+	request.Accept = ss.pkg.Accept()
+	request.Expires = int(expires / time.Second)
+	ss.sendRequest(request)
+}
+
+// Start a transaction for a SUBSCRIBE
+func (ss *subscriberState) sendRequest(request *sip.Msg) {
+	ss.request = request
+	if err := ss.send(request); err != nil {
+		ss.terminate(err)
+	}
+}
+
+// The refresh timer fired, or the time to wait before subscribing again is over
+func (ss *subscriberState) handleTimer() {
+	switch {
+	case ss.unsubscribing:
+		// The notifier never sent its final NOTIFY
+		ss.transition(SubscriptionStatusTerminated)
+	case ss.established:
+		ss.subscribe(ss.expires)
+	default:
+		ss.resubscribe()
+	}
+}
+
+// Make the subscription again in a new dialog, after the notifier ended the previous one
+func (ss *subscriberState) resubscribe() {
+	ss.manager.removeSubscription(ss.subscriptionDialog)
+	ss.newDialog()
+	if !ss.manager.addSubscription(ss.subscriptionDialog) {
+		ss.transition(SubscriptionStatusTerminated)
+		return
+	}
+	ss.transition(SubscriptionStatusSubscribing)
+	ss.subscribe(ss.expires)
+}
+
+func (ss *subscriberState) handleResponse(tx *transaction.Client, msg *sip.Msg) {
+	if tx.Request() != ss.request || msg.Status < sip.StatusOK {
+		// A response to a SUBSCRIBE we have already given up on, or a provisional response
+		return
+	}
+
+	switch {
+	case msg.Status < sip.StatusMultipleChoices:
+		ss.request = nil
+		if !ss.established {
+			// RFC 6665 section 4.1.2.1: the 2xx creates the dialog, unless a NOTIFY already did
+			ss.established = true
+			ss.remoteAddr = msg.To
+			ss.routeSet = msg.RecordRoute.Reversed()
+			if msg.Contact != nil {
+				ss.remoteTarget = msg.Contact.Uri
+			}
+		}
+		if ss.unsubscribing {
+			if tx.Request().Expires > 0 {
+				// We were asked to unsubscribe before the dialog existed
+				ss.subscribe(0)
+				return
+			}
+			// Wait a little for the final NOTIFY
+			ss.timer = time.After(64 * ss.manager.transactions.Timers().T1)
+			return
+		}
+		granted := time.Duration(msg.Expires) * time.Second
+		if granted <= 0 || granted > ss.expires {
+			granted = ss.expires
+		}
+		ss.refreshIn(granted)
+	case msg.Status == sip.StatusUnauthorized, msg.Status == sip.StatusProxyAuthenticationRequired:
+		provider := ss.credentials
+		if provider == nil {
+			provider = ss.manager.credentials
+		}
+		if ss.nonceCounts == nil {
+			ss.nonceCounts = make(map[string]int)
+		}
+		request, err := ss.manager.authorize(tx.Request(), msg, provider, ss.nonceCounts)
+		if err != nil {
+			ss.terminate(err)
+			return
+		}
+		// The new request is a new transaction, so it needs a new CSeq and branch.
+		request.Via = &sip.Via{Host: ss.manager.PublicAddress().String(), Port: ss.manager.PublicPort()}
+		ss.lSeq++
+		request.CSeq = ss.lSeq
+		ss.sendRequest(request)
+	case msg.Status == sip.StatusIntervalTooBrief && !ss.unsubscribing:
+		// RFC 6665 section 4.1.2.1: try again with the notifier's minimum
+		minExpires := time.Duration(msg.MinExpires) * time.Second
+		if minExpires <= ss.expires {
+			ss.terminate(&sip.ResponseError{Msg: msg})
+			return
+		}
+		ss.expires = minExpires
+		ss.subscribe(ss.expires)
+	case ss.unsubscribing:
+		ss.transition(SubscriptionStatusTerminated)
+	default:
+		ss.terminate(&sip.ResponseError{Msg: msg})
+	}
+}
+
+// Schedule the refresh of a subscription that lasts `granted`
+func (ss *subscriberState) refreshIn(granted time.Duration) {
+	ss.timer = time.After(granted - min(granted/2, subscribeRefreshMargin))
+}
+
+func (ss *subscriberState) handleRequest(tx *transaction.Server, msg *sip.Msg) {
+	if msg.Method != sip.MethodNotify {
+		ss.reply(tx, msg, sip.StatusMethodNotAllowed)
+		return
+	}
+	if !ss.checkSequence(tx, msg) {
+		return
+	}
+	if ss.established && tagOf(msg.From) != tagOf(ss.remoteAddr) {
+		// A NOTIFY from another notifier, after the request forked
+		ss.reply(tx, msg, sip.StatusCallTransactionDoesNotExist)
+		return
+	}
+	if eventPackage(msg.Event) != eventPackage(ss.pkg.Name()) {
+		ss.reply(tx, msg, sip.StatusBadEvent)
+		return
+	}
+	if msg.SubscriptionState == nil {
+		ss.reply(tx, msg, sip.StatusBadRequest)
+		return
+	}
+	if !ss.established {
+		// RFC 6665 section 4.1.2.4: the NOTIFY creates the dialog, if it arrives before the 2xx
+		ss.established = true
+		ss.remoteAddr = msg.From
+		ss.routeSet = msg.RecordRoute
+		if msg.Contact != nil {
+			ss.remoteTarget = msg.Contact.Uri
+		}
+	}
+	ss.respond(tx, ss.newResponse(msg, sip.StatusOK))
+
+	n := &Notification{State: msg.SubscriptionState, Msg: msg}
+	if msg.Payload != nil {
+		body, err := ss.pkg.Parse(msg.Payload)
+		if err != nil {
+			ss.report(errors.Join(ErrSubscriptionNotifyBody, err))
+		}
+		n.Body = body
+	}
+	select {
+	case ss.notifyChan <- n:
+	default:
+		ss.manager.logger.Warn(
+			"dropping NOTIFY, because the application is not reading them",
+			slog.String("event", ss.pkg.Name()),
+			slog.String("target", ss.target.String()),
+		)
+	}
+	ss.handleSubscriptionState(msg.SubscriptionState)
+}
+
+// Follow the state of the subscription reported by the notifier (RFC 6665 section 4.1.3)
+func (ss *subscriberState) handleSubscriptionState(state *sip.SubscriptionState) {
+	switch state.State {
+	case sip.SubscriptionActive, sip.SubscriptionPending:
+		if ss.unsubscribing {
+			return
+		}
+		if state.State == sip.SubscriptionActive {
+			ss.transition(SubscriptionStatusActive)
+		} else {
+			ss.transition(SubscriptionStatusPending)
+		}
+		if state.Expires > 0 && ss.request == nil {
+			ss.refreshIn(min(time.Duration(state.Expires)*time.Second, ss.expires))
+		}
+	case sip.SubscriptionTerminated:
+		if ss.unsubscribing {
+			ss.transition(SubscriptionStatusTerminated)
+			return
+		}
+		retry := time.Duration(state.RetryAfter) * time.Second
+		switch state.Reason {
+		case "deactivated", "timeout":
+			// The subscription can be made again straight away
+			ss.resubscribe()
+		case "probation", "giveup":
+			if retry <= 0 {
+				retry = ss.retry
+			}
+			ss.established = false
+			ss.request = nil
+			ss.transition(SubscriptionStatusSubscribing)
+			ss.timer = time.After(retry)
+		default:
+			ss.terminate(ErrSubscriptionRejected)
+		}
+	}
+}
+
+// End the subscription, if we might have one
+func (ss *subscriberState) unsubscribe() {
+	ss.unsubscribing = true
+	ss.timer = nil
+	switch {
+	case ss.established && ss.request == nil:
+		ss.subscribe(0)
+	case ss.request == nil:
+		// We are waiting to subscribe again, so there is nothing to end
+		ss.transition(SubscriptionStatusTerminated)
+	}
+	// Otherwise, our SUBSCRIBE is still in progress: its response decides what to do
+}
+
+// Report an error that ends the subscription
+func (ss *subscriberState) terminate(err error) {
+	ss.report(err)
+	ss.transition(SubscriptionStatusTerminated)
+}
+
+func (ss *subscriberState) transition(state SubscriptionStatus) {
+	if ss.state == state {
+		return
+	}
+	ss.state = state
+	select {
+	case ss.stateChan <- state:
+	default:
+		ss.manager.logger.Warn(
+			"dropping subscription state change, because the application is not reading them",
+			slog.String("event", ss.pkg.Name()),
+			slog.String("target", ss.target.String()),
+		)
+	}
+}
+
+func (ss *subscriberState) report(err error) {
+	ss.manager.logger.Error(
+		"subscription failed",
+		util.SlogError(err),
+		slog.String("event", ss.pkg.Name()),
+		slog.String("target", ss.target.String()),
+	)
+	select {
+	case ss.errChan <- err:
+	default:
+	}
+}
+
+func (ss *subscriberState) cleanup() {
+	close(ss.doneChan)
+	close(ss.errChan)
+	close(ss.stateChan)
+	close(ss.notifyChan)
+	ss.manager.removeSubscription(ss.subscriptionDialog)
+}
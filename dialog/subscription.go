@@ -0,0 +1,214 @@
+package dialog
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/safermobility/sipmanager/event"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+type SubscriptionStatus int
+
+const (
+	SubscriptionStatusSubscribing SubscriptionStatus = iota + 1 // Our SUBSCRIBE has not been answered with a NOTIFY yet
+	SubscriptionStatusPending                                   // The notifier has not authorized the subscription yet
+	SubscriptionStatusActive                                    // Notifications are being sent
+	SubscriptionStatusTerminated                                // The subscription is over
+)
+
+const subscriptionEventQueue = 16 // Events buffered for the application before they are dropped
+
+var ErrSubscriptionNoTarget = errors.New("a subscription needs a target with a host")
+
+// EventPackage is an RFC 6665 event package, such as `message-summary` or `dialog`,
+// that can be subscribed to with `Manager.Subscribe`
+type EventPackage interface {
+	Name() string   // The `Event` header value
+	Accept() string // The `Accept` header value: the body types we understand in NOTIFYs
+
+	// Parse decodes the body of a NOTIFY, for `Notification.Body`
+	Parse(payload sip.Payload) (any, error)
+}
+
+// BasicEventPackage is an event package whose NOTIFY bodies are delivered as they are
+func BasicEventPackage(name string, accept ...string) EventPackage {
+	return &basicEventPackage{name: name, accept: strings.Join(accept, ", ")}
+}
+
+// Event packages whose NOTIFY bodies are parsed by the `event` package, so that
+// `Notification.Body` is an `*event.MessageSummary` or an `*event.DialogInfo`
+// (or a `*sip.MiscPayload`, if the notifier sent something we could not parse)
+var (
+	MessageSummaryEventPackage = BasicEventPackage("message-summary", event.ContentTypeMessageSummary)
+	DialogEventPackage         = BasicEventPackage("dialog", event.ContentTypeDialogInfo)
+)
+
+type basicEventPackage struct {
+	name   string
+	accept string
+}
+
+func (p *basicEventPackage) Name() string   { return p.name }
+func (p *basicEventPackage) Accept() string { return p.accept }
+
+func (p *basicEventPackage) Parse(payload sip.Payload) (any, error) {
+	return payload, nil
+}
+
+// The dialog created by a subscription (RFC 6665 section 4.4), used by both
+// the subscriber and the notifier. It is only used by the goroutine of its owner.
+type subscriptionDialog struct {
+	manager      *Manager
+	responseChan chan *clientResponse // Responses received by our client transactions.
+	requestChan  chan *serverRequest  // Requests received from the remote UA.
+	doneChan     chan struct{}        // Closed when the subscription ends.
+	stop         func()               // Ends the subscription, when the manager is closed.
+	callID       sip.CallID
+	localAddr    *sip.Addr // Our address in this dialog, including our tag.
+	remoteAddr   *sip.Addr // The remote address in this dialog, including the remote tag once known.
+	remoteTarget *sip.URI  // Where to send requests within this dialog.
+	routeSet     *sip.Addr // The Route headers for requests within this dialog.
+	lSeq         int       // Local CSeq value.
+	rSeq         int       // Remote CSeq value.
+}
+
+func (m *Manager) newSubscriptionDialog() *subscriptionDialog {
+	return &subscriptionDialog{
+		manager:      m,
+		responseChan: make(chan *clientResponse),
+		requestChan:  make(chan *serverRequest),
+		doneChan:     make(chan struct{}),
+	}
+}
+
+// Route requests with the dialog's Call-ID to it.
+// Returns false if the manager has been closed.
+func (m *Manager) addSubscription(sd *subscriptionDialog) bool {
+	m.subscriptionsMu.Lock()
+	defer m.subscriptionsMu.Unlock()
+	if m.subscriptions == nil {
+		return false
+	}
+	m.subscriptions[sd.callID] = sd
+	return true
+}
+
+func (m *Manager) removeSubscription(sd *subscriptionDialog) {
+	m.subscriptionsMu.Lock()
+	defer m.subscriptionsMu.Unlock()
+	if m.subscriptions[sd.callID] == sd {
+		delete(m.subscriptions, sd.callID)
+	}
+}
+
+func (m *Manager) findSubscription(callID sip.CallID) *subscriptionDialog {
+	m.subscriptionsMu.Lock()
+	defer m.subscriptionsMu.Unlock()
+	return m.subscriptions[callID]
+}
+
+// End every subscription, in either direction, and wait for them to finish
+func (m *Manager) closeSubscriptions() {
+	m.subscriptionsMu.Lock()
+	subscriptions := m.subscriptions
+	m.subscriptions = nil
+	m.subscriptionsMu.Unlock()
+
+	for _, sd := range subscriptions {
+		sd.stop()
+	}
+	for _, sd := range subscriptions {
+		<-sd.doneChan
+	}
+}
+
+// Pass a response from one of our client transactions to the subscription's goroutine
+func (sd *subscriptionDialog) receiveResponse(tx *transaction.Client, msg *sip.Msg) {
+	select {
+	case sd.responseChan <- &clientResponse{tx, msg}:
+	case <-sd.doneChan:
+	}
+}
+
+// Pass a request from the remote UA to the subscription's goroutine
+func (sd *subscriptionDialog) receiveRequest(tx *transaction.Server, msg *sip.Msg) {
+	if tx == nil {
+		// A stray ACK
+		return
+	}
+	select {
+	case sd.requestChan <- &serverRequest{tx, msg}:
+	case <-sd.doneChan:
+		sd.reply(tx, msg, sip.StatusCallTransactionDoesNotExist)
+	}
+}
+
+// Build a new request within this dialog
+func (sd *subscriptionDialog) newRequest(method string) *sip.Msg {
+	sd.lSeq++
+	contact := sd.manager.contact.Copy()
+	contact.Uri.Scheme = "sip"
+	return &sip.Msg{
+		Method:     method,
+		Request:    sd.remoteTarget,
+		Via:        &sip.Via{Host: sd.manager.PublicAddress().String(), Port: sd.manager.PublicPort()},
+		From:       sd.localAddr,
+		To:         sd.remoteAddr,
+		CallID:     sd.callID,
+		CSeq:       sd.lSeq,
+		CSeqMethod: method,
+		Route:      sd.routeSet,
+		Contact:    contact,
+	}
+}
+
+// Start a client transaction for a request within this dialog
+func (sd *subscriptionDialog) send(request *sip.Msg) error {
+	if _, err := sd.manager.transactions.Request(request, sd.receiveResponse); err != nil {
+		sd.manager.logger.Error(
+			fmt.Sprintf("unable to send '%s' message", request.Method),
+			util.SlogError(err),
+			slog.String("packet", request.String()),
+		)
+		return err
+	}
+	return nil
+}
+
+// Check the CSeq of a request from the remote UA. Returns false if it was refused.
+func (sd *subscriptionDialog) checkSequence(tx *transaction.Server, msg *sip.Msg) bool {
+	if sd.rSeq != 0 && msg.CSeq < sd.rSeq {
+		// RFC 3261 mandates a 500 response for out of order requests.
+		sd.reply(tx, msg, sip.StatusInternalServerError)
+		return false
+	}
+	sd.rSeq = msg.CSeq
+	return true
+}
+
+// Build a response to a request within this dialog
+func (sd *subscriptionDialog) newResponse(msg *sip.Msg, status int) *sip.Msg {
+	response := sd.manager.NewResponse(msg, status)
+	response.To = sd.localAddr
+	return response
+}
+
+// Reply to a request with just a status code
+func (sd *subscriptionDialog) reply(tx *transaction.Server, msg *sip.Msg, status int) {
+	sd.respond(tx, sd.manager.NewResponse(msg, status))
+}
+
+func (sd *subscriptionDialog) respond(tx *transaction.Server, response *sip.Msg) {
+	if err := tx.Respond(response); err != nil {
+		sd.manager.logger.Error(
+			fmt.Sprintf("unable to send '%d %s' reply to incoming '%s' message", response.Status, response.Phrase, response.CSeqMethod),
+			util.SlogError(err),
+			slog.String("packet", response.String()),
+		)
+	}
+}
@@ -0,0 +1,180 @@
+package dialog_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/event"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testEventPackage = dialog.MessageSummaryEventPackage
+
+func newTestSummary(waiting int) *event.MessageSummary {
+	return &event.MessageSummary{
+		MessagesWaiting: waiting > 0,
+		Messages:        map[string]event.MessageCounts{event.MessageClassVoice: {New: waiting}},
+	}
+}
+
+// Create a notifier for `testEventPackage`, and subscribe to it
+func newTestSubscription(t *testing.T, opts ...dialog.SubscriptionOption) (*dialog.Subscription, <-chan *dialog.IncomingSubscription) {
+	t.Helper()
+	subscriptions := make(chan *dialog.IncomingSubscription, 1)
+	notifier := newTestManager(t, dialog.WithNotifier("message-summary", func(s *dialog.IncomingSubscription) {
+		subscriptions <- s
+	}))
+	subscriber := newTestManager(t)
+
+	s, err := subscriber.Subscribe(newTestInvite(notifier).Request, testEventPackage, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, dialog.SubscriptionStatusSubscribing, nextSubscriptionState(t, s.OnState))
+	return s, subscriptions
+}
+
+func nextSubscriptionState(t *testing.T, states <-chan dialog.SubscriptionStatus) dialog.SubscriptionStatus {
+	t.Helper()
+	select {
+	case state, ok := <-states:
+		require.True(t, ok, "subscription ended unexpectedly")
+		return state
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for subscription state")
+		return 0
+	}
+}
+
+func nextIncomingSubscription(t *testing.T, subscriptions <-chan *dialog.IncomingSubscription) *dialog.IncomingSubscription {
+	t.Helper()
+	select {
+	case s := <-subscriptions:
+		return s
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for SUBSCRIBE")
+		return nil
+	}
+}
+
+func nextNotification(t *testing.T, s *dialog.Subscription) *dialog.Notification {
+	t.Helper()
+	select {
+	case n, ok := <-s.OnNotify:
+		require.True(t, ok, "subscription ended without a NOTIFY")
+		return n
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for NOTIFY")
+		return nil
+	}
+}
+
+func TestSubscribeAndNotify(t *testing.T) {
+	s, subscriptions := newTestSubscription(t, dialog.WithSubscriptionExpires(2*time.Second))
+
+	in := nextIncomingSubscription(t, subscriptions)
+	assert.Equal(t, "message-summary", in.Event)
+	assert.Equal(t, 2*time.Second, in.Expires)
+	assert.Equal(t, testEventPackage.Accept(), in.Msg.Accept)
+	n, err := in.Accept(newTestSummary(0))
+	require.NoError(t, err)
+	assert.Equal(t, dialog.SubscriptionStatusActive, nextSubscriptionState(t, n.OnState))
+
+	notification := nextNotification(t, s)
+	assert.Equal(t, sip.SubscriptionActive, notification.State.State)
+	assert.Equal(t, newTestSummary(0), notification.Body)
+	assert.Equal(t, dialog.SubscriptionStatusActive, nextSubscriptionState(t, s.OnState))
+
+	require.NoError(t, n.Notify(newTestSummary(2)))
+	assert.Equal(t, newTestSummary(2), nextNotification(t, s).Body)
+
+	// The subscription is refreshed before it expires, and the notifier sends the current state again
+	start := time.Now()
+	notification = nextNotification(t, s)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, newTestSummary(2), notification.Body)
+
+	s.Unsubscribe()
+	notification = nextNotification(t, s)
+	assert.Equal(t, sip.SubscriptionTerminated, notification.State.State)
+	assert.Equal(t, dialog.SubscriptionStatusTerminated, nextSubscriptionState(t, s.OnState))
+	assert.Equal(t, dialog.SubscriptionStatusTerminated, nextSubscriptionState(t, n.OnState))
+	assert.ErrorIs(t, n.Notify(newTestSummary(0)), dialog.ErrSubscriptionTerminated)
+}
+
+func TestSubscribeAgainWhenDeactivated(t *testing.T) {
+	s, subscriptions := newTestSubscription(t)
+
+	first := nextIncomingSubscription(t, subscriptions)
+	n, err := first.Accept(newTestSummary(0))
+	require.NoError(t, err)
+	nextNotification(t, s)
+	assert.Equal(t, dialog.SubscriptionStatusActive, nextSubscriptionState(t, s.OnState))
+
+	require.NoError(t, n.Terminate("deactivated"))
+	notification := nextNotification(t, s)
+	assert.Equal(t, sip.SubscriptionTerminated, notification.State.State)
+	assert.Equal(t, "deactivated", notification.State.Reason)
+	assert.Equal(t, dialog.SubscriptionStatusSubscribing, nextSubscriptionState(t, s.OnState))
+
+	// The subscription is made again, in a new dialog
+	second := nextIncomingSubscription(t, subscriptions)
+	assert.NotEqual(t, first.Msg.CallID, second.Msg.CallID)
+	// Only one of two concurrent answers is sent
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- second.Reject(sip.StatusForbidden) }()
+	}
+	assert.ElementsMatch(t, []error{nil, dialog.ErrSubscriptionAlreadyAnswered}, []error{<-errs, <-errs})
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, <-s.OnErr, &rerr)
+	assert.Equal(t, sip.StatusForbidden, rerr.Msg.Status)
+	assert.Equal(t, dialog.SubscriptionStatusTerminated, nextSubscriptionState(t, s.OnState))
+}
+
+func TestSubscribeUnknownEvent(t *testing.T) {
+	notifier := newTestManager(t, dialog.WithNotifier("presence", func(s *dialog.IncomingSubscription) {
+		s.Reject(sip.StatusForbidden)
+	}))
+	subscriber := newTestManager(t)
+
+	s, err := subscriber.Subscribe(newTestInvite(notifier).Request, testEventPackage)
+	require.NoError(t, err)
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, <-s.OnErr, &rerr)
+	assert.Equal(t, sip.StatusBadEvent, rerr.Msg.Status)
+	assert.Equal(t, "presence", rerr.Msg.AllowEvents)
+}
+
+func TestSubscribeExpiresDefault(t *testing.T) {
+	subscriptions := make(chan *dialog.IncomingSubscription, 1)
+	notifier := newTestManager(t, dialog.WithNotifier("message-summary", func(s *dialog.IncomingSubscription) {
+		subscriptions <- s
+	}))
+	subscriber := newFakePeer(t)
+
+	subscribe := func(callID sip.CallID, expires string) *dialog.IncomingSubscription {
+		target := newTestInvite(notifier).Request
+		msg := subscriber.fill(&sip.Msg{
+			Method:  sip.MethodSubscribe,
+			Request: target,
+			From:    &sip.Addr{Uri: subscriber.uri(), Param: &sip.Param{Name: "tag", Value: "subscriber"}},
+			To:      &sip.Addr{Uri: target},
+			CallID:  callID,
+			CSeq:    1,
+			Event:   "message-summary",
+		})
+		var b bytes.Buffer
+		msg.Append(&b)
+		subscriber.write(t, notifier, []byte(strings.Replace(b.String(), "Expires: 0\r\n", expires, 1)))
+		return nextIncomingSubscription(t, subscriptions)
+	}
+
+	// Without `Expires`, the subscription lasts for the default duration rather than ending at once
+	assert.Equal(t, time.Hour, subscribe("no-expires", "").Expires)
+	assert.Equal(t, time.Duration(0), subscribe("fetch", "Expires: 0\r\n").Expires)
+	assert.Equal(t, 24*time.Hour, subscribe("long-expires", "Expires: 4294967296\r\n").Expires)
+}
@@ -0,0 +1,196 @@
+package dialog
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+const (
+	optionTagTimer = "timer"          // The RFC 4028 option tag for session timers
+	defaultMinSE   = 90 * time.Second // The smallest session interval allowed by RFC 4028 section 4
+)
+
+var ErrSessionExpired = errors.New("the session expired without being refreshed")
+
+// Lower the smallest session interval we accept below the RFC 4028 minimum,
+// so that tests do not have to wait for minutes. Only tests may use this.
+func withMinSE(minSE time.Duration) ManagerOption {
+	return func(m *Manager) error {
+		m.minSE = minSE
+		return nil
+	}
+}
+
+// Set the session interval to ask for in a new dialog
+func (dls *dialogState) initSessionTimer() {
+	dls.sessionRequest = dls.manager.sessionTimer
+	dls.minSE = dls.manager.minSE
+}
+
+// Add the RFC 4028 headers to an INVITE we are sending, if session timers are enabled
+func (dls *dialogState) addSessionTimer(msg *sip.Msg) {
+	if dls.manager.sessionTimer == 0 {
+		return
+	}
+	msg.Supported = addOptionTag(msg.Supported, optionTagTimer)
+
+	interval := dls.sessionRequest
+	if dls.sessionInterval > 0 {
+		interval = dls.sessionInterval
+	}
+	msg.SessionExpires = &sip.SessionExpires{Delta: seconds(interval)}
+	if dls.sessionInterval > 0 {
+		// Keep the roles we already agreed on (RFC 4028 section 7.4)
+		msg.SessionExpires.Refresher = sip.RefresherUAS
+		if dls.sessionRefresher {
+			msg.SessionExpires.Refresher = sip.RefresherUAC
+		}
+	}
+	msg.MinSE = seconds(dls.minSE)
+}
+
+// Reject an INVITE whose session interval is shorter than we allow (RFC 4028 section 9).
+// Returns false if the request was rejected.
+func (m *Manager) checkSessionInterval(tx *transaction.Server, msg *sip.Msg, minSE time.Duration) bool {
+	if m.sessionTimer == 0 || msg.SessionExpires == nil || msg.SessionExpires.Delta >= seconds(minSE) {
+		return true
+	}
+	response := m.NewResponse(msg, sip.StatusSessionIntervalTooSmall)
+	response.MinSE = seconds(minSE)
+	if err := tx.Respond(response); err != nil {
+		m.logger.Error(
+			fmt.Sprintf("unable to send '422 Session Interval Too Small' reply to incoming '%s' message", msg.Method),
+			util.SlogError(err),
+			slog.String("packet", msg.String()),
+		)
+	}
+	return false
+}
+
+// Choose the session interval and refresher for our 2xx response to an INVITE (RFC 4028 section 9)
+func (dls *dialogState) answerSessionTimer(request, response *sip.Msg) {
+	if dls.manager.sessionTimer == 0 {
+		return
+	}
+	response.Supported = addOptionTag(response.Supported, optionTagTimer)
+	uacSupports := hasOptionTag(request.Supported, optionTagTimer)
+
+	se := &sip.SessionExpires{Delta: seconds(dls.manager.sessionTimer)}
+	if request.SessionExpires != nil {
+		se.Delta = min(se.Delta, request.SessionExpires.Delta)
+		se.Delta = max(se.Delta, seconds(dls.minSE), request.MinSE)
+		se.Refresher = request.SessionExpires.Refresher
+	}
+	if se.Refresher == "" || !uacSupports {
+		// A UAC that doesn't support session timers can't be the refresher
+		se.Refresher = sip.RefresherUAS
+		if uacSupports {
+			se.Refresher = sip.RefresherUAC
+		}
+	}
+	response.SessionExpires = se
+	if uacSupports {
+		response.Require = addOptionTag(response.Require, optionTagTimer)
+	}
+}
+
+// Start (or restart) the session timer after a successful INVITE transaction.
+// `uac` is true if we sent the INVITE, and `msg` is the 2xx response.
+func (dls *dialogState) startSessionTimer(msg *sip.Msg, uac bool) {
+	dls.sessionRefresh = nil
+	dls.sessionExpire = nil
+	if dls.manager.sessionTimer == 0 || msg.SessionExpires == nil {
+		dls.sessionInterval = 0
+		return
+	}
+
+	dls.sessionInterval = time.Duration(msg.SessionExpires.Delta) * time.Second
+	dls.sessionRefresher = (msg.SessionExpires.Refresher == sip.RefresherUAC) == uac
+	if dls.sessionRefresher {
+		dls.sessionRefresh = time.After(dls.sessionInterval / 2)
+	}
+	// RFC 4028 section 10: the session expires a little before the interval is over
+	dls.sessionExpire = time.After(dls.sessionInterval - min(32*time.Second, dls.sessionInterval/3))
+
+	dls.manager.logger.Debug(
+		"session timer started",
+		slog.Duration("interval", dls.sessionInterval),
+		slog.Bool("refresher", dls.sessionRefresher),
+	)
+}
+
+// It is time for us to refresh the session, with an UPDATE if the remote UA
+// allows it (RFC 4028 section 7.4), or otherwise with a re-INVITE
+func (dls *dialogState) refreshSession() bool {
+	dls.sessionRefresh = nil
+	if dls.state != StatusAnswered {
+		return true
+	}
+	if hasOptionTag(dls.remote.Allow, sip.MethodUpdate) {
+		if dls.update != nil {
+			dls.sessionRefresh = time.After(dls.manager.transactions.Timers().T2)
+			return true
+		}
+		return dls.sendUpdate(nil)
+	}
+	if dls.localSDP == nil {
+		return true
+	}
+	if dls.reinvite != nil || dls.reinviteOffer != nil || dls.response != nil || dls.reinviteServer != nil {
+		// Another INVITE transaction is in progress, and will refresh the session when it succeeds
+		dls.sessionRefresh = time.After(dls.manager.transactions.Timers().T2)
+		return true
+	}
+	// RFC 4028 section 7.4: a refresh repeats the current session description
+	dls.reinviteOffer = dls.localSDP
+	return dls.sendReinvite()
+}
+
+// The session was not refreshed in time
+func (dls *dialogState) expireSession() bool {
+	dls.sessionExpire = nil
+	dls.manager.logger.Warn(
+		"session expired without being refreshed",
+		slog.String("call-id", string(dls.callID)),
+	)
+	dls.reportError(ErrSessionExpired)
+	dls.hangupCause = CauseSessionExpired
+	return dls.hangup()
+}
+
+// The remote UA needs a longer session interval (RFC 4028 section 7.3)
+func (dls *dialogState) handleIntervalTooSmall(tx *transaction.Client, msg *sip.Msg) bool {
+	minSE := time.Duration(msg.MinSE) * time.Second
+	if dls.manager.sessionTimer == 0 || minSE <= dls.sessionRequest {
+		dls.reportError(&sip.ResponseError{Msg: msg})
+		return false
+	}
+	dls.sessionRequest = minSE
+	dls.minSE = max(dls.minSE, minSE)
+	dls.sessionInterval = 0
+
+	request := tx.Request().Copy()
+	request.Via = nil
+	dls.lSeq++
+	request.CSeq = dls.lSeq
+	switch tx.Request() {
+	case dls.invite:
+		dls.invite = request
+	case dls.reinvite:
+		dls.reinvite = request
+	case dls.update:
+		dls.update = request
+		return dls.sendUpdateRequest(request)
+	}
+	return dls.sendRequest(request)
+}
+
+func seconds(d time.Duration) int {
+	return int(d / time.Second)
+}
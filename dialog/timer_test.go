@@ -0,0 +1,99 @@
+package dialog_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTimerRefreshAndExpiry(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t, dialog.WithMinSE(2*time.Second), dialog.WithSessionTimer(2*time.Second))
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	seen := map[string]bool{}
+	nextInvite := func() (*sip.Msg, *net.UDPAddr) {
+		for {
+			req, addr := callee.receive(t, seen)
+			if req.Method != sip.MethodAck {
+				return req, addr
+			}
+		}
+	}
+
+	invite, addr := nextInvite()
+	assert.Contains(t, invite.Supported, "timer")
+	assert.Equal(t, &sip.SessionExpires{Delta: 2}, invite.SessionExpires)
+	assert.Equal(t, 2, invite.MinSE)
+	callee.respond(t, addr, invite, sip.StatusSessionIntervalTooSmall, func(msg *sip.Msg) {
+		msg.MinSE = 3
+	})
+
+	// The INVITE is retried with the interval the callee asked for
+	invite, addr = nextInvite()
+	require.Equal(t, sip.MethodInvite, invite.Method)
+	assert.Equal(t, 3, invite.SessionExpires.Delta)
+	to := invite.To.Copy().Tag()
+	answer := func(refresher string) func(*sip.Msg) {
+		return func(msg *sip.Msg) {
+			msg.To = to
+			msg.Contact = &sip.Addr{Uri: callee.uri()}
+			msg.Require = "timer"
+			msg.SessionExpires = &sip.SessionExpires{Delta: 3, Refresher: refresher}
+			msg.Payload = newTestSDP(5000)
+		}
+	}
+	callee.respond(t, addr, invite, sip.StatusOK, answer(sip.RefresherUAC))
+	w.waitState(t, dialog.StatusAnswered)
+	w.nextPeer(t)
+
+	// As the refresher, the caller sends a re-INVITE halfway through the interval
+	start := time.Now()
+	ack, _ := callee.receive(t, seen)
+	assert.Equal(t, sip.MethodAck, ack.Method)
+	refresh, addr := callee.receive(t, seen)
+	require.Equal(t, sip.MethodInvite, refresh.Method)
+	assert.InDelta(t, 1500*time.Millisecond, time.Since(start), float64(500*time.Millisecond))
+	assert.Equal(t, &sip.SessionExpires{Delta: 3, Refresher: sip.RefresherUAC}, refresh.SessionExpires)
+	assert.NotNil(t, refresh.Payload)
+
+	// The callee takes over refreshing, but never does, so the caller hangs up
+	callee.respond(t, addr, refresh, sip.StatusOK, answer(sip.RefresherUAS))
+	w.nextPeer(t)
+	ack, _ = callee.receive(t, seen)
+	assert.Equal(t, sip.MethodAck, ack.Method)
+
+	bye, addr := callee.receive(t, seen)
+	require.Equal(t, sip.MethodBye, bye.Method)
+	assert.ErrorIs(t, w.nextErr(t), dialog.ErrSessionExpired)
+	callee.respond(t, addr, bye, sip.StatusOK, func(msg *sip.Msg) { msg.To = to })
+	w.waitState(t, dialog.StatusHangup)
+}
+
+func TestSessionTimerMinimum(t *testing.T) {
+	_, err := dialog.NewManager(dialog.WithSessionTimer(30 * time.Second))
+	assert.ErrorIs(t, err, dialog.ErrSessionTimerNotValid)
+
+	// Min-SE stays at the RFC 4028 minimum of 90 seconds
+	callee := newFakePeer(t)
+	caller := newTestManager(t, dialog.WithSessionTimer(90*time.Second))
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	watch(d)
+	defer d.Hangup()
+	invite, _ := callee.receive(t, map[string]bool{})
+	assert.Equal(t, 90, invite.MinSE)
+	assert.Equal(t, 90, invite.SessionExpires.Delta)
+}
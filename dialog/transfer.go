@@ -0,0 +1,221 @@
+package dialog
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/safermobility/sipmanager/util"
+)
+
+type TransferStatus int
+
+const (
+	TransferStatusTrying    TransferStatus = iota + 1 // The remote UA accepted the REFER, and is trying the target
+	TransferStatusRinging                             // The target is ringing
+	TransferStatusSucceeded                           // The target answered
+	TransferStatusFailed                              // The REFER was rejected, or the target did not answer
+)
+
+const transferEventQueue = 8 // Events buffered for the application before they are dropped
+
+var (
+	ErrTransferNoTarget = errors.New("a transfer needs a target")
+	ErrTransferPending  = errors.New("another transfer is already in progress for this call")
+	ErrTransferNoResult = errors.New("the remote UA ended the transfer subscription without a final result")
+)
+
+// The "public" interface of a transfer started with `Dialog.Transfer`.
+// Events are buffered, and both channels are closed when the transfer is over.
+type Transfer struct {
+	OnErr   <-chan error
+	OnState <-chan TransferStatus
+}
+
+// The "internal" interface of a transfer, owned by the dialog's goroutine
+type transferState struct {
+	errChan   chan<- error
+	stateChan chan<- TransferStatus
+	state     TransferStatus // Most recently reported state.
+	refer     *sip.Msg       // Our REFER, until it has a final response.
+	hangup    bool           // Whether to hang up this dialog when the transfer succeeds.
+}
+
+// A transfer requested by the application
+type transferRequest struct {
+	transfer *transferState
+	referTo  string // The `Refer-To` header value
+	result   chan error
+}
+
+// Transfer asks the remote UA to call `target` instead (a "blind" transfer),
+// by sending a REFER within this dialog (RFC 3515). Its progress is reported
+// on the returned `Transfer` as the remote UA sends NOTIFYs.
+func (d *Dialog) Transfer(target *sip.URI, opts ...TransferOption) (*Transfer, error) {
+	if target == nil {
+		return nil, ErrTransferNoTarget
+	}
+	return d.transfer("<"+target.String()+">", opts)
+}
+
+func (d *Dialog) transfer(referTo string, opts []TransferOption) (*Transfer, error) {
+	errChan := make(chan error, transferEventQueue)
+	stateChan := make(chan TransferStatus, transferEventQueue)
+	ts := &transferState{
+		errChan:   errChan,
+		stateChan: stateChan,
+	}
+	for _, opt := range opts {
+		if err := opt(ts); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &transferRequest{transfer: ts, referTo: referTo, result: make(chan error, 1)}
+	select {
+	case d.doTransfer <- r:
+	case <-d.done:
+		return nil, ErrCallEnded
+	}
+	if err := <-r.result; err != nil {
+		return nil, err
+	}
+	return &Transfer{OnErr: errChan, OnState: stateChan}, nil
+}
+
+// Start a transfer requested by the application, if the dialog is able to
+func (dls *dialogState) startTransfer(r *transferRequest) bool {
+	if dls.state != StatusAnswered {
+		r.result <- ErrCallNotAnswered
+		return true
+	}
+	if dls.transfer != nil {
+		r.result <- ErrTransferPending
+		return true
+	}
+	r.result <- nil
+
+	refer := dls.newRequest(sip.MethodRefer)
+	refer.ReferTo = r.referTo
+	refer.ReferredBy = "<" + dls.localAddr.Uri.String() + ">"
+	dls.transfer = r.transfer
+	dls.transfer.refer = refer
+	return dls.sendRefer()
+}
+
+// Start a transaction for our REFER (a new one after an authentication challenge)
+func (dls *dialogState) sendRefer() bool {
+	if err := dls.sendInDialog(dls.transfer.refer); err != nil {
+		dls.finishTransfer(TransferStatusFailed, err)
+	}
+	return true
+}
+
+// Our REFER that is waiting for a final response, if any
+func (dls *dialogState) pendingRefer() *sip.Msg {
+	if dls.transfer == nil {
+		return nil
+	}
+	return dls.transfer.refer
+}
+
+// Handle a response to our REFER
+func (dls *dialogState) handleReferResponse(tx *transaction.Client, msg *sip.Msg) bool {
+	if msg.Status < sip.StatusOK || tx.Request() != dls.pendingRefer() {
+		return true
+	}
+	if msg.Status == sip.StatusUnauthorized || msg.Status == sip.StatusProxyAuthenticationRequired {
+		return dls.handleAuthChallenge(tx, msg)
+	}
+	dls.transfer.refer = nil
+	if msg.Status >= sip.StatusMultipleChoices {
+		dls.finishTransfer(TransferStatusFailed, &sip.ResponseError{Msg: msg})
+		return true
+	}
+	dls.transfer.transition(TransferStatusTrying)
+	return true
+}
+
+// Handle a NOTIFY from the remote UA. The only subscription we know about is
+// the implicit one created by our REFER (RFC 3515 section 2.4.4).
+func (dls *dialogState) handleNotify(tx *transaction.Server, msg *sip.Msg) bool {
+	if eventPackage(msg.Event) != "refer" {
+		return dls.reply(tx, msg, sip.StatusBadEvent)
+	}
+	if !dls.reply(tx, msg, sip.StatusOK) {
+		return false
+	}
+	if dls.transfer == nil {
+		// A late NOTIFY for a transfer that is already over
+		return true
+	}
+
+	if payload, ok := msg.Payload.(*sip.MiscPayload); ok && strings.HasPrefix(payload.ContentType(), sip.ContentTypeSipFrag) {
+		frag, err := sip.ParseSipFrag(payload.Data())
+		switch {
+		case err != nil || !frag.IsResponse():
+			dls.manager.logger.Warn(
+				"ignoring unusable 'message/sipfrag' body in 'NOTIFY'",
+				slog.String("packet", msg.String()),
+			)
+		case frag.Status < sip.StatusRinging:
+			dls.transfer.transition(TransferStatusTrying)
+		case frag.Status < sip.StatusOK:
+			dls.transfer.transition(TransferStatusRinging)
+		case frag.Status < sip.StatusMultipleChoices:
+			hangup := dls.transfer.hangup
+			dls.finishTransfer(TransferStatusSucceeded, nil)
+			if hangup {
+				return dls.hangup()
+			}
+			return true
+		default:
+			dls.finishTransfer(TransferStatusFailed, &sip.ResponseError{Msg: frag})
+			return true
+		}
+	}
+
+	if msg.SubscriptionState != nil && msg.SubscriptionState.State == sip.SubscriptionTerminated {
+		dls.finishTransfer(TransferStatusFailed, ErrTransferNoResult)
+	}
+	return true
+}
+
+// Report the outcome of the transfer, and forget about it
+func (dls *dialogState) finishTransfer(state TransferStatus, err error) {
+	ts := dls.transfer
+	dls.transfer = nil
+	if err != nil {
+		dls.manager.logger.Warn(
+			"transfer failed",
+			util.SlogError(err),
+			slog.String("call-id", string(dls.callID)),
+		)
+		select {
+		case ts.errChan <- err:
+		default:
+		}
+	}
+	ts.transition(state)
+	close(ts.errChan)
+	close(ts.stateChan)
+}
+
+func (ts *transferState) transition(state TransferStatus) {
+	if ts.state == state {
+		return
+	}
+	ts.state = state
+	select {
+	case ts.stateChan <- state:
+	default:
+	}
+}
+
+// The event package named by an `Event` header, without its parameters
+func eventPackage(event string) string {
+	name, _, _ := strings.Cut(event, ";")
+	return strings.ToLower(strings.TrimSpace(name))
+}
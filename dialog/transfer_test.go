@@ -0,0 +1,273 @@
+package dialog_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nextTransferState(t *testing.T, tr *dialog.Transfer) dialog.TransferStatus {
+	t.Helper()
+	select {
+	case state, ok := <-tr.OnState:
+		require.True(t, ok, "transfer ended unexpectedly")
+		return state
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for transfer state")
+		return 0
+	}
+}
+
+func TestBlindTransfer(t *testing.T) {
+	transferee := newFakePeer(t)
+	m := newTestManager(t)
+
+	target := transferee.uri()
+	target.User = "bob"
+	d, err := m.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	seen := map[string]bool{}
+	invite, addr := transferee.receive(t, seen)
+	to := invite.To.Copy().Tag()
+	transferee.respond(t, addr, invite, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = to
+		msg.Contact = &sip.Addr{Uri: transferee.uri()}
+		msg.Payload = newTestSDP(5000)
+	})
+	w.waitState(t, dialog.StatusAnswered)
+	w.nextPeer(t)
+
+	carol := &sip.URI{Scheme: "sip", User: "carol", Host: "example.test"}
+	tr, err := d.Transfer(carol, dialog.WithTransferHangup(true))
+	require.NoError(t, err)
+	_, err = d.Transfer(carol)
+	assert.ErrorIs(t, err, dialog.ErrTransferPending)
+
+	ack, _ := transferee.receive(t, seen)
+	assert.Equal(t, sip.MethodAck, ack.Method)
+	refer, addr := transferee.receive(t, seen)
+	require.Equal(t, sip.MethodRefer, refer.Method)
+	assert.Equal(t, "<sip:carol@example.test>", refer.ReferTo)
+	transferee.respond(t, addr, refer, sip.StatusAccepted, func(msg *sip.Msg) { msg.To = to })
+	assert.Equal(t, dialog.TransferStatusTrying, nextTransferState(t, tr))
+
+	cseq := 100
+	notify := func(frag string, state *sip.SubscriptionState) {
+		cseq++
+		transferee.send(t, m, &sip.Msg{
+			Method:            sip.MethodNotify,
+			Request:           invite.Contact.Uri,
+			From:              to,
+			To:                invite.From,
+			CallID:            invite.CallID,
+			CSeq:              cseq,
+			Event:             "refer",
+			SubscriptionState: state,
+			Payload:           &sip.MiscPayload{T: sip.ContentTypeSipFrag, D: []byte(frag)},
+		})
+		assert.Equal(t, sip.StatusOK, transferee.response(t).Status)
+	}
+	notify("SIP/2.0 180 Ringing\r\n", &sip.SubscriptionState{State: sip.SubscriptionActive, Expires: 60})
+	assert.Equal(t, dialog.TransferStatusRinging, nextTransferState(t, tr))
+	notify("SIP/2.0 200 OK\r\n", &sip.SubscriptionState{State: sip.SubscriptionTerminated, Reason: "noresource"})
+	assert.Equal(t, dialog.TransferStatusSucceeded, nextTransferState(t, tr))
+	_, ok := <-tr.OnState
+	assert.False(t, ok)
+
+	// The original call is hung up once the transfer has succeeded
+	bye, addr := transferee.receive(t, seen)
+	require.Equal(t, sip.MethodBye, bye.Method)
+	transferee.respond(t, addr, bye, sip.StatusOK, func(msg *sip.Msg) { msg.To = to })
+	w.waitState(t, dialog.StatusHangup)
+}
+
+func TestBlindTransferRejected(t *testing.T) {
+	_, _, d := newTestCall(t, nil, nil)
+
+	tr, err := d.Transfer(&sip.URI{Scheme: "sip", User: "carol", Host: "example.test"})
+	require.NoError(t, err)
+	assert.Equal(t, dialog.TransferStatusFailed, nextTransferState(t, tr))
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, <-tr.OnErr, &rerr)
+	assert.Equal(t, sip.StatusMethodNotAllowed, rerr.Msg.Status)
+	// The remote UA can still transfer us, so it accepts the NOTIFYs of our REFERs
+	assert.NotContains(t, rerr.Msg.Allow, sip.MethodRefer)
+	assert.Contains(t, rerr.Msg.Allow, sip.MethodNotify)
+}
+
+func TestAttendedTransfer(t *testing.T) {
+	calls := make(chan *dialog.IncomingCall, 1)
+	target := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		calls <- call
+	}))
+	nextCall := func() *dialog.IncomingCall {
+		select {
+		case call := <-calls:
+			return call
+		case <-time.After(testTimeout):
+			require.FailNow(t, "timeout waiting for incoming call")
+			return nil
+		}
+	}
+	transferee := newFakePeer(t)
+	transferor := newTestManager(t)
+
+	// The consultation call with the transfer target
+	consult, err := transferor.NewDialog(newTestInvite(target))
+	require.NoError(t, err)
+	consultOut := watch(consult)
+	call := nextCall()
+	consultIn := watch(call.Dialog)
+	require.NoError(t, call.Accept(newTestSDP(5000)))
+	consultOut.waitState(t, dialog.StatusAnswered)
+	consultIn.waitState(t, dialog.StatusAnswered)
+
+	// The call with the transferee
+	bob := transferee.uri()
+	bob.User = "bob"
+	d, err := transferor.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: bob, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+	seen := map[string]bool{}
+	invite, addr := transferee.receive(t, seen)
+	to := invite.To.Copy().Tag()
+	transferee.respond(t, addr, invite, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = to
+		msg.Contact = &sip.Addr{Uri: transferee.uri()}
+		msg.Payload = newTestSDP(5002)
+	})
+	w.waitState(t, dialog.StatusAnswered)
+
+	tr, err := d.TransferTo(consult)
+	require.NoError(t, err)
+	transferee.receive(t, seen) // ACK
+	refer, addr := transferee.receive(t, seen)
+	require.Equal(t, sip.MethodRefer, refer.Method)
+	transferee.respond(t, addr, refer, sip.StatusAccepted, func(msg *sip.Msg) { msg.To = to })
+	assert.Equal(t, dialog.TransferStatusTrying, nextTransferState(t, tr))
+
+	// The transferee calls the target, replacing the consultation call
+	referTo, err := sip.ParseURI([]byte(strings.Trim(refer.ReferTo, "<>")))
+	require.NoError(t, err)
+	replaces, err := sip.ParseReplaces(referTo.Header.Get("Replaces").Value)
+	require.NoError(t, err)
+	referTo.Header = nil
+	from := &sip.Addr{Uri: transferee.uri()}
+	transferee.send(t, target, &sip.Msg{
+		Method:   sip.MethodInvite,
+		Request:  referTo,
+		From:     from.Tag(),
+		To:       &sip.Addr{Uri: referTo},
+		CallID:   "replacement",
+		CSeq:     1,
+		Replaces: replaces,
+		Payload:  newTestSDP(5004),
+	})
+	replacement := nextCall()
+	require.NotNil(t, replacement.Replaces)
+	assert.Same(t, call.Dialog, replacement.Replaces)
+	watch(replacement.Dialog)
+	require.NoError(t, replacement.Accept(newTestSDP(5006)))
+	ok := transferee.response(t)
+	require.Equal(t, sip.StatusOK, ok.Status)
+	transferee.send(t, target, &sip.Msg{
+		Method:  sip.MethodAck,
+		Request: ok.Contact.Uri,
+		From:    ok.From,
+		To:      ok.To,
+		CallID:  ok.CallID,
+		CSeq:    ok.CSeq,
+	})
+
+	// The consultation call is hung up by the target
+	consultIn.waitState(t, dialog.StatusHangup)
+	consultOut.waitState(t, dialog.StatusHangup)
+}
+
+func TestReplacesUnknownDialog(t *testing.T) {
+	target := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		t.Error("unexpected incoming call")
+	}))
+	peer := newFakePeer(t)
+	from := &sip.Addr{Uri: peer.uri()}
+	peer.send(t, target, &sip.Msg{
+		Method:   sip.MethodInvite,
+		Request:  peer.uri(),
+		From:     from.Tag(),
+		To:       &sip.Addr{Uri: peer.uri()},
+		CallID:   "replacement",
+		CSeq:     1,
+		Replaces: &sip.Replaces{CallID: "unknown", ToTag: "a", FromTag: "b"},
+	})
+	assert.Equal(t, sip.StatusCallTransactionDoesNotExist, peer.response(t).Status)
+}
+
+func TestTransferee(t *testing.T) {
+	calls := make(chan *dialog.IncomingCall, 1)
+	target := newTestManager(t, dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+		calls <- call
+	}))
+	transferred := make(chan *dialog.Dialog, 1)
+	out, in, d := newTestCall(t, nil, []dialog.ManagerOption{
+		dialog.WithReferHandler(func(r *dialog.IncomingRefer) {
+			assert.Equal(t, "carol", r.Target.User)
+			assert.Nil(t, r.Replaces)
+			// Only one of two concurrent answers is sent
+			rejected := make(chan error, 1)
+			go func() { rejected <- r.Reject(sip.StatusDecline) }()
+			d, err := r.Accept(newTestSDP(6000))
+			if err == nil {
+				assert.ErrorIs(t, <-rejected, dialog.ErrCallAlreadyAnswered)
+			} else {
+				assert.ErrorIs(t, err, dialog.ErrCallAlreadyAnswered)
+				assert.NoError(t, <-rejected)
+			}
+			transferred <- d
+		}),
+	})
+
+	carol := newTestInvite(target).Request
+	carol.User = "carol"
+	tr, err := d.Transfer(carol, dialog.WithTransferHangup(true))
+	require.NoError(t, err)
+	state := nextTransferState(t, tr)
+
+	var newCall *dialog.Dialog
+	select {
+	case newCall = <-transferred:
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for transferred call")
+	}
+	if newCall == nil {
+		// The REFER was rejected
+		assert.Equal(t, dialog.TransferStatusFailed, state)
+		return
+	}
+	assert.Equal(t, dialog.TransferStatusTrying, state)
+	w := watch(newCall)
+
+	var call *dialog.IncomingCall
+	select {
+	case call = <-calls:
+	case <-time.After(testTimeout):
+		require.FailNow(t, "timeout waiting for incoming call")
+	}
+	assert.Contains(t, call.Invite.ReferredBy, "sip:")
+	watch(call.Dialog)
+	require.NoError(t, call.Ring(nil))
+	assert.Equal(t, dialog.TransferStatusRinging, nextTransferState(t, tr))
+	require.NoError(t, call.Accept(newTestSDP(7000)))
+	w.waitState(t, dialog.StatusAnswered)
+	assert.Equal(t, dialog.TransferStatusSucceeded, nextTransferState(t, tr))
+
+	// The transferor hangs up once the transfer has succeeded
+	out.waitState(t, dialog.StatusHangup)
+	in.waitState(t, dialog.StatusHangup)
+}
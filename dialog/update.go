@@ -0,0 +1,259 @@
+package dialog
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/safermobility/sipmanager/sdp"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+)
+
+var (
+	ErrUpdatePending = errors.New("another UPDATE is already in progress for this call")
+	ErrNoEarlyDialog = errors.New("the remote UA has not created an early dialog yet")
+)
+
+// An UPDATE requested by the application
+type updateRequest struct {
+	offer  *sdp.SDP // The new offer, or nil to only refresh the session
+	result chan error
+}
+
+// Update sends an RFC 3311 UPDATE to the remote UA, with a new SDP offer or
+// (if `offer` is nil) only to refresh the session. Unlike a re-INVITE, it can be
+// sent before the call is answered, once the remote UA has created an early dialog.
+// The answer is delivered as an `EventSDP` event; if the offer is rejected, an
+// `EventError` is delivered and the previous session remains in place.
+func (d *Dialog) Update(offer *sdp.SDP) error {
+	r := &updateRequest{offer: offer, result: make(chan error, 1)}
+	select {
+	case d.doUpdate <- r:
+	case <-d.done:
+		return ErrCallEnded
+	}
+	return <-r.result
+}
+
+// Start an UPDATE requested by the application, if the dialog is able to
+func (dls *dialogState) startUpdate(r *updateRequest) bool {
+	switch {
+	case dls.state < StatusAnswered && !dls.incoming && dls.early == nil:
+		r.result <- ErrNoEarlyDialog
+		return true
+	case dls.update != nil:
+		r.result <- ErrUpdatePending
+		return true
+	case r.offer != nil && (dls.reinvite != nil || dls.reinviteOffer != nil || dls.reinviteServer != nil):
+		// RFC 3311 section 5.1: only one offer at a time, in either direction
+		r.result <- ErrReinvitePending
+		return true
+	}
+	if r.offer != nil {
+		nextVersion(r.offer, dls.localSDP)
+	}
+	r.result <- nil
+	return dls.sendUpdate(r.offer)
+}
+
+// Send an UPDATE, with an offer or (if nil) only to refresh the session
+func (dls *dialogState) sendUpdate(offer *sdp.SDP) bool {
+	var request *sip.Msg
+	if dls.state < StatusAnswered && !dls.incoming {
+		request = dls.earlyRequest(sip.MethodUpdate, dls.early)
+	} else {
+		request = dls.newRequest(sip.MethodUpdate)
+	}
+	if offer != nil {
+		request.Payload = offer
+	}
+	dls.update = request
+	dls.updateOffer = offer
+	return dls.sendUpdateRequest(request)
+}
+
+// Start a transaction for our UPDATE (a new one after an authentication
+// challenge or a `422 Session Interval Too Small`)
+func (dls *dialogState) sendUpdateRequest(request *sip.Msg) bool {
+	if err := dls.sendInDialog(request); err != nil {
+		dls.update = nil
+		dls.updateOffer = nil
+		dls.reportError(err)
+	}
+	return true
+}
+
+// Handle a response to an UPDATE we sent
+func (dls *dialogState) handleUpdateResponse(tx *transaction.Client, msg *sip.Msg) bool {
+	if msg.Status < sip.StatusOK || tx.Request() != dls.update {
+		return true
+	}
+	switch msg.Status {
+	case sip.StatusUnauthorized, sip.StatusProxyAuthenticationRequired:
+		return dls.handleAuthChallenge(tx, msg)
+	case sip.StatusSessionIntervalTooSmall:
+		if dls.manager.sessionTimer > 0 && msg.MinSE > seconds(dls.sessionRequest) {
+			return dls.handleIntervalTooSmall(tx, msg)
+		}
+	}
+	offer := dls.updateOffer
+	dls.update = nil
+	dls.updateOffer = nil
+
+	switch {
+	case msg.Status < sip.StatusMultipleChoices:
+		if offer != nil {
+			dls.localSDP = offer
+		}
+		if dls.state == StatusAnswered {
+			if msg.Contact != nil {
+				dls.remoteTarget = msg.Contact.Uri
+			}
+			dls.startSessionTimer(msg, true)
+		}
+		dls.checkSDP(msg)
+		return true
+	case msg.Status == sip.StatusCallTransactionDoesNotExist:
+		// RFC 3261 section 12.2.1.2: the dialog is gone
+		dls.reportError(&sip.ResponseError{Msg: msg})
+		dls.hangupCause = CauseRemoteHangup
+		dls.transition(StatusHangup, msg)
+		return false
+	case msg.Status == sip.StatusRequestTimeout && dls.state == StatusAnswered:
+		dls.reportError(&sip.ResponseError{Msg: msg})
+		return dls.hangup()
+	default:
+		// The offer was rejected, so the previous session remains in place
+		dls.reportError(&sip.ResponseError{Msg: msg})
+		return true
+	}
+}
+
+// UpdateHandler is called (in a new goroutine) for every UPDATE with an SDP offer
+// received from the remote UA. The handler must eventually call `Accept` or `Reject`.
+type UpdateHandler func(*IncomingUpdate)
+
+// IncomingUpdate is a new offer from the remote UA in an UPDATE request
+type IncomingUpdate struct {
+	Dialog *Dialog
+	Msg    *sip.Msg // The UPDATE received from the remote UA
+	Offer  *sdp.SDP // The new offer
+
+	respond  chan<- *uasResponse
+	mu       sync.Mutex // Held while sending the response, so only one gets through
+	answered bool
+}
+
+// Accept sends `200 OK` with our answer to the offer
+func (u *IncomingUpdate) Accept(answer *sdp.SDP) error {
+	if answer == nil {
+		return ErrReinviteNoPayload
+	}
+	return u.sendResponse(sip.StatusOK, answer)
+}
+
+// Reject refuses the new offer, leaving the session unchanged. The status is usually
+// `488 Not Acceptable Here`, or `491 Request Pending` to make the remote UA try again later.
+func (u *IncomingUpdate) Reject(status int) error {
+	if status < sip.StatusMultipleChoices {
+		return ErrInvalidFinalStatus
+	}
+	return u.sendResponse(status, nil)
+}
+
+func (u *IncomingUpdate) sendResponse(status int, payload *sdp.SDP) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.answered {
+		return ErrCallAlreadyAnswered
+	}
+	select {
+	case u.respond <- &uasResponse{status: status, payload: payload}:
+		u.answered = true
+		return nil
+	case <-u.Dialog.done:
+		return ErrCallEnded
+	}
+}
+
+// Handle an UPDATE from the remote UA
+func (dls *dialogState) handleUpdate(tx *transaction.Server, msg *sip.Msg) bool {
+	if !dls.manager.allowUpdate {
+		return dls.reply(tx, msg, sip.StatusMethodNotAllowed)
+	}
+	offer, _ := msg.Payload.(*sdp.SDP)
+	if offer != nil {
+		// RFC 3311 section 5.2: only one offer at a time, in either direction
+		switch {
+		case dls.update != nil && dls.updateOffer != nil, dls.reinvite != nil, dls.reinviteOffer != nil:
+			return dls.reply(tx, msg, sip.StatusRequestPending)
+		case dls.updateServer != nil, dls.reinviteServer != nil, dls.incoming && dls.state < StatusAnswered:
+			// We have not answered the remote UA's previous offer yet
+			return dls.replyRetryLater(tx, msg)
+		}
+	}
+	if dls.state == StatusAnswered && !dls.manager.checkSessionInterval(tx, msg, dls.minSE) {
+		return true
+	}
+
+	if offer == nil {
+		return dls.respondUpdate(tx, &uasResponse{status: sip.StatusOK})
+	}
+	// The offer only takes effect if we accept it
+	dls.reportSDP(msg)
+
+	handler := dls.manager.updateHandler
+	if handler == nil {
+		// Keep the current session, agreeing to whatever direction the remote UA asked for
+		if dls.localSDP == nil {
+			return dls.respondUpdate(tx, &uasResponse{status: sip.StatusNotAcceptableHere})
+		}
+		payload := withDirection(dls.localSDP, answerDirection(offer))
+		nextVersion(payload, dls.localSDP)
+		return dls.respondUpdate(tx, &uasResponse{status: sip.StatusOK, payload: payload})
+	}
+
+	respond := make(chan *uasResponse)
+	dls.updateServer = tx
+	dls.updateRespond = respond
+	go handler(&IncomingUpdate{
+		Dialog:  dls.dialog,
+		Msg:     msg,
+		Offer:   offer,
+		respond: respond,
+	})
+	return true
+}
+
+// Send the application's answer to the remote UA's UPDATE
+func (dls *dialogState) answerUpdate(r *uasResponse) bool {
+	tx := dls.updateServer
+	dls.updateServer = nil
+	dls.updateRespond = nil
+	return dls.respondUpdate(tx, r)
+}
+
+// Send the final response to an UPDATE from the remote UA
+func (dls *dialogState) respondUpdate(tx *transaction.Server, r *uasResponse) bool {
+	request := tx.Request()
+	msg := dls.manager.NewResponse(request, r.status)
+	if r.status < sip.StatusMultipleChoices {
+		msg.Contact = dls.manager.contact
+		if offer, ok := request.Payload.(*sdp.SDP); ok {
+			dls.remoteSDP = offer
+		}
+		if dls.state == StatusAnswered {
+			if request.Contact != nil {
+				dls.remoteTarget = request.Contact.Uri
+			}
+			dls.answerSessionTimer(request, msg)
+			dls.startSessionTimer(msg, false)
+		}
+	}
+	if r.payload != nil {
+		msg.Payload = r.payload
+		dls.populateSDP(msg)
+		dls.localSDP = r.payload
+	}
+	return dls.sendResponse(tx, msg)
+}
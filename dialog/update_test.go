@@ -0,0 +1,160 @@
+package dialog_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/dialog"
+	"github.com/safermobility/sipmanager/sdp"
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateInEarlyDialog(t *testing.T) {
+	callee := newFakePeer(t)
+	caller := newTestManager(t)
+
+	target := callee.uri()
+	target.User = "bob"
+	d, err := caller.NewDialog(&sip.Msg{Method: sip.MethodInvite, Request: target, Payload: newTestSDP(4000)})
+	require.NoError(t, err)
+	w := watch(d)
+
+	// There is no early dialog until the callee sends a provisional response with a tag
+	assert.ErrorIs(t, d.Update(newTestSDP(4002)), dialog.ErrNoEarlyDialog)
+
+	seen := map[string]bool{}
+	invite, addr := callee.receive(t, seen)
+	to := invite.To.Copy().Tag()
+	contact := callee.uri()
+	contact.User = "early"
+	callee.respond(t, addr, invite, sip.StatusRinging, func(msg *sip.Msg) {
+		msg.To = to
+		msg.Contact = &sip.Addr{Uri: contact}
+	})
+	w.waitState(t, dialog.StatusRinging)
+
+	require.NoError(t, d.Update(newTestSDP(4002)))
+	update, addr := callee.receive(t, seen)
+	require.Equal(t, sip.MethodUpdate, update.Method)
+	assert.Equal(t, "early", update.Request.User)
+	assert.Equal(t, to.Param.Get("tag"), update.To.Param.Get("tag"))
+	assert.Greater(t, update.CSeq, invite.CSeq)
+	offer, ok := update.Payload.(*sdp.SDP)
+	require.True(t, ok)
+	assert.Equal(t, uint16(4002), offer.Media[0].Port)
+
+	callee.respond(t, addr, update, sip.StatusOK, func(msg *sip.Msg) {
+		msg.To = to
+		msg.Contact = &sip.Addr{Uri: contact}
+		msg.Payload = newTestSDP(5002)
+	})
+	peer := w.nextPeer(t)
+	assert.Equal(t, sip.MethodUpdate, peer.Msg.CSeqMethod)
+	assert.Equal(t, uint16(5002), peer.Payload.Media[0].Port)
+}
+
+func TestUpdateAnsweredByApplication(t *testing.T) {
+	updates := make(chan *dialog.IncomingUpdate, 1)
+	out, in, d := newTestCall(t, nil, []dialog.ManagerOption{
+		dialog.WithUpdateHandler(func(u *dialog.IncomingUpdate) {
+			updates <- u
+		}),
+	})
+
+	// A rejected offer does not change the session
+	require.NoError(t, d.Update(newTestSDP(4001)))
+	u := <-updates
+	in.nextPeer(t)
+	// Only one of two concurrent responses is sent
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- u.Reject(sip.StatusNotAcceptableHere) }()
+	}
+	assert.ElementsMatch(t, []error{nil, dialog.ErrCallAlreadyAnswered}, []error{<-errs, <-errs})
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, out.nextErr(t), &rerr)
+	assert.Equal(t, sip.StatusNotAcceptableHere, rerr.Msg.Status)
+	assert.Equal(t, uint16(4000), u.Dialog.RemoteSDP().Media[0].Port)
+
+	require.NoError(t, d.Update(newTestSDP(4002)))
+	u = <-updates
+	require.NotNil(t, u.Offer)
+	assert.Equal(t, uint16(4002), u.Offer.Media[0].Port)
+	in.nextPeer(t)
+	require.NoError(t, u.Accept(newTestSDP(5002)))
+	peer := out.nextPeer(t)
+	assert.Equal(t, sip.StatusOK, peer.Msg.Status)
+	assert.Equal(t, uint16(5002), peer.Payload.Media[0].Port)
+	assert.Eventually(t, func() bool {
+		return u.Dialog.RemoteSDP().Media[0].Port == 4002
+	}, testTimeout, 10*time.Millisecond)
+}
+
+func TestUpdateRefusedWhenNotAllowed(t *testing.T) {
+	out, _, d := newTestCall(t, nil, nil)
+
+	require.NoError(t, d.Update(newTestSDP(4002)))
+	var rerr *sip.ResponseError
+	require.ErrorAs(t, out.nextErr(t), &rerr)
+	assert.Equal(t, sip.StatusMethodNotAllowed, rerr.Msg.Status)
+	assert.NotContains(t, rerr.Msg.Allow, sip.MethodUpdate)
+}
+
+func TestRejectedUpdateKeepsTarget(t *testing.T) {
+	caller := newFakePeer(t)
+	calls := make(chan *dialog.IncomingCall, 1)
+	callee := newTestManager(t,
+		dialog.WithAllowUpdate(true),
+		dialog.WithIncomingCallHandler(func(call *dialog.IncomingCall) {
+			calls <- call
+		}),
+		dialog.WithUpdateHandler(func(u *dialog.IncomingUpdate) {
+			u.Reject(sip.StatusNotAcceptableHere)
+		}),
+	)
+
+	target := &sip.URI{Scheme: "sip", User: "bob", Host: callee.PublicAddress().String(), Port: callee.PublicPort()}
+	from := &sip.Addr{Uri: caller.uri(), Param: &sip.Param{Name: "tag", Value: "caller"}}
+	invite := &sip.Msg{
+		Method:  sip.MethodInvite,
+		Request: target,
+		From:    from,
+		To:      &sip.Addr{Uri: target},
+		CallID:  "rejected-update-test",
+		CSeq:    1,
+		Payload: newTestSDP(4000),
+	}
+	caller.send(t, callee, invite)
+
+	call := <-calls
+	in := watch(call.Dialog)
+	require.NoError(t, call.Accept(newTestSDP(5000)))
+	ok := caller.response(t)
+	require.Equal(t, sip.StatusOK, ok.Status)
+	caller.send(t, callee, &sip.Msg{Method: sip.MethodAck, Request: ok.Contact.Uri, From: from, To: ok.To, CallID: invite.CallID, CSeq: 1})
+	in.waitState(t, dialog.StatusAnswered)
+
+	// The UPDATE is refused, so its new Contact is not our next target
+	moved := caller.uri()
+	moved.User = "moved"
+	caller.send(t, callee, &sip.Msg{
+		Method:  sip.MethodUpdate,
+		Request: ok.Contact.Uri,
+		From:    from,
+		To:      ok.To,
+		Contact: &sip.Addr{Uri: moved},
+		CallID:  invite.CallID,
+		CSeq:    2,
+		Payload: newTestSDP(6000),
+	})
+	assert.Equal(t, sip.StatusNotAcceptableHere, caller.response(t).Status)
+
+	call.Dialog.Hangup()
+	bye, addr := caller.receive(t, map[string]bool{})
+	require.Equal(t, sip.MethodBye, bye.Method)
+	assert.Empty(t, bye.Request.User)
+	caller.respond(t, addr, bye, sip.StatusOK, nil)
+	in.waitState(t, dialog.StatusHangup)
+}
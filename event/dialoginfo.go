@@ -0,0 +1,124 @@
+// Package event parses and builds the bodies of NOTIFYs for common event packages.
+package event
+
+import (
+	"encoding/xml"
+)
+
+const ContentTypeDialogInfo = "application/dialog-info+xml"
+
+// The `state` attribute of a dialog-info document
+const (
+	DialogInfoFull    = "full"    // The document lists every dialog
+	DialogInfoPartial = "partial" // The document only lists the dialogs that changed
+)
+
+// The state of a dialog (RFC 4235 section 3.7.1)
+const (
+	DialogStateTrying     = "trying"
+	DialogStateProceeding = "proceeding"
+	DialogStateEarly      = "early"
+	DialogStateConfirmed  = "confirmed"
+	DialogStateTerminated = "terminated"
+)
+
+// Why a dialog changed state, in the `event` attribute of its state
+const (
+	DialogEventCancelled = "cancelled"
+	DialogEventRejected  = "rejected"
+	DialogEventReplaced  = "replaced"
+	DialogEventLocalBye  = "local-bye"
+	DialogEventRemoteBye = "remote-bye"
+	DialogEventError     = "error"
+	DialogEventTimeout   = "timeout"
+)
+
+// Which side of a dialog sent the INVITE that created it
+const (
+	DirectionInitiator = "initiator"
+	DirectionRecipient = "recipient"
+)
+
+// DialogInfo is an RFC 4235 `application/dialog-info+xml` document, describing
+// the dialogs of an entity (the `dialog` event package, used for busy lamp fields).
+// It is a `sip.Payload`, so it can be sent as the body of a NOTIFY.
+type DialogInfo struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:dialog-info dialog-info"`
+	Version int      `xml:"version,attr"`
+	State   string   `xml:"state,attr"` // `DialogInfoFull` or `DialogInfoPartial`
+	Entity  string   `xml:"entity,attr"`
+	Dialogs []Dialog `xml:"dialog"`
+}
+
+// Dialog describes one dialog of the entity
+type Dialog struct {
+	ID         string       `xml:"id,attr"`
+	CallID     string       `xml:"call-id,attr,omitempty"`
+	LocalTag   string       `xml:"local-tag,attr,omitempty"`
+	RemoteTag  string       `xml:"remote-tag,attr,omitempty"`
+	Direction  string       `xml:"direction,attr,omitempty"` // `DirectionInitiator` or `DirectionRecipient`
+	State      DialogState  `xml:"state"`
+	Duration   int          `xml:"duration,omitempty"` // Seconds since the dialog was confirmed
+	Replaces   *DialogRef   `xml:"replaces"`
+	ReferredBy *Identity    `xml:"referred-by"`
+	Local      *Participant `xml:"local"`
+	Remote     *Participant `xml:"remote"`
+}
+
+// DialogState is the state of a dialog, and why it changed
+type DialogState struct {
+	State string `xml:",chardata"`            // One of the `DialogState` constants
+	Event string `xml:"event,attr,omitempty"` // One of the `DialogEvent` constants, if known
+	Code  int    `xml:"code,attr,omitempty"`  // The response code that caused the change, if any
+}
+
+// DialogRef identifies another dialog, like the one this dialog replaces
+type DialogRef struct {
+	CallID    string `xml:"call-id,attr"`
+	LocalTag  string `xml:"local-tag,attr"`
+	RemoteTag string `xml:"remote-tag,attr"`
+}
+
+// Participant describes one side of a dialog
+type Participant struct {
+	Identity *Identity `xml:"identity"`
+	Target   *Target   `xml:"target"`
+}
+
+// Identity is the address of a participant, with an optional display name
+type Identity struct {
+	Display string `xml:"display,attr,omitempty"`
+	URI     string `xml:",chardata"`
+}
+
+// Target is the contact URI of a participant
+type Target struct {
+	URI    string        `xml:"uri,attr"`
+	Params []TargetParam `xml:"param"`
+}
+
+type TargetParam struct {
+	Name  string `xml:"pname,attr"`
+	Value string `xml:"pval,attr"`
+}
+
+// ParseDialogInfo parses an `application/dialog-info+xml` body
+func ParseDialogInfo(data []byte) (*DialogInfo, error) {
+	info := new(DialogInfo)
+	if err := xml.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (info *DialogInfo) ContentType() string {
+	return ContentTypeDialogInfo
+}
+
+func (info *DialogInfo) Data() []byte {
+	data, err := xml.Marshal(info)
+	if err != nil {
+		return nil
+	}
+	return append([]byte(xml.Header), data...)
+}
@@ -0,0 +1,87 @@
+package event_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/safermobility/sipmanager/event"
+)
+
+// Based on RFC 4235 section 5.2
+const dialogInfo = `<?xml version="1.0"?>
+<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info"
+             version="1" state="full"
+             entity="sip:alice@example.com">
+  <dialog id="as7d900as8" call-id="a84b4c76e66710"
+          local-tag="1928301774" remote-tag="456887766"
+          direction="initiator">
+    <state event="replaced" code="200">confirmed</state>
+    <duration>274</duration>
+    <replaces call-id="hg287s98s89" local-tag="6762h7" remote-tag="09278hsb"/>
+    <local>
+      <identity display="Alice">sip:alice@example.com</identity>
+      <target uri="sip:alice@pc33.example.com">
+        <param pname="+sip.rendering" pval="yes"/>
+      </target>
+    </local>
+    <remote>
+      <identity display="Bob">sip:bob@example.org</identity>
+      <target uri="sip:bobster@phone21.example.org"/>
+    </remote>
+  </dialog>
+  <dialog id="7jh26d87">
+    <state>early</state>
+  </dialog>
+</dialog-info>
+`
+
+func TestParseDialogInfo(t *testing.T) {
+	info, err := event.ParseDialogInfo([]byte(dialogInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 1 || info.State != event.DialogInfoFull || info.Entity != "sip:alice@example.com" {
+		t.Errorf("%d %s %s", info.Version, info.State, info.Entity)
+	}
+	if len(info.Dialogs) != 2 {
+		t.Fatalf("%d dialogs", len(info.Dialogs))
+	}
+
+	d := info.Dialogs[0]
+	if d.CallID != "a84b4c76e66710" || d.LocalTag != "1928301774" || d.RemoteTag != "456887766" || d.Direction != event.DirectionInitiator {
+		t.Errorf("dialog: %#v", d)
+	}
+	wantState := event.DialogState{State: event.DialogStateConfirmed, Event: event.DialogEventReplaced, Code: 200}
+	if d.State != wantState || d.Duration != 274 {
+		t.Errorf("state: %#v, duration: %d", d.State, d.Duration)
+	}
+	wantReplaces := &event.DialogRef{CallID: "hg287s98s89", LocalTag: "6762h7", RemoteTag: "09278hsb"}
+	if !reflect.DeepEqual(wantReplaces, d.Replaces) {
+		t.Errorf("replaces: %#v", d.Replaces)
+	}
+	wantRemote := &event.Participant{
+		Identity: &event.Identity{Display: "Bob", URI: "sip:bob@example.org"},
+		Target:   &event.Target{URI: "sip:bobster@phone21.example.org"},
+	}
+	if !reflect.DeepEqual(wantRemote, d.Remote) {
+		t.Errorf("remote: %#v", d.Remote)
+	}
+	if len(d.Local.Target.Params) != 1 || d.Local.Target.Params[0] != (event.TargetParam{Name: "+sip.rendering", Value: "yes"}) {
+		t.Errorf("local target: %#v", d.Local.Target)
+	}
+	if info.Dialogs[1].State.State != event.DialogStateEarly {
+		t.Errorf("second dialog: %#v", info.Dialogs[1])
+	}
+
+	again, err := event.ParseDialogInfo(info.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, again) {
+		t.Errorf("%s did not survive a round trip", info.Data())
+	}
+
+	if _, err := event.ParseDialogInfo([]byte(`<presence xmlns="urn:ietf:params:xml:ns:pidf"/>`)); err == nil {
+		t.Error("a presence document is not dialog-info")
+	}
+}
@@ -0,0 +1,179 @@
+package event
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const ContentTypeMessageSummary = "application/simple-message-summary"
+
+// The message context classes of RFC 3458, used to count messages by type
+const (
+	MessageClassVoice      = "voice-message"
+	MessageClassFax        = "fax-message"
+	MessageClassPager      = "pager-message"
+	MessageClassMultimedia = "multimedia-message"
+	MessageClassText       = "text-message"
+	MessageClassNone       = "none"
+)
+
+var ErrMessageSummaryInvalid = errors.New("not a valid message summary")
+
+// MessageSummary is an RFC 3842 `application/simple-message-summary` body,
+// telling a user agent about waiting messages (the `message-summary` event package).
+// It is a `sip.Payload`, so it can be sent as the body of a NOTIFY.
+type MessageSummary struct {
+	MessagesWaiting bool                     // Whether there are new messages
+	Account         string                   // The account the messages are for, if given
+	Messages        map[string]MessageCounts // Message counts by class, like `MessageClassVoice`
+}
+
+// MessageCounts are the number of messages of one class
+type MessageCounts struct {
+	New       int
+	Old       int
+	NewUrgent int // Included in `New`
+	OldUrgent int // Included in `Old`
+}
+
+// ParseMessageSummary parses an `application/simple-message-summary` body.
+// The optional message headers after the summary are ignored.
+func ParseMessageSummary(data []byte) (*MessageSummary, error) {
+	summary := &MessageSummary{Messages: make(map[string]MessageCounts)}
+	waiting := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if waiting {
+				break
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, ErrMessageSummaryInvalid
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		switch name {
+		case "messages-waiting":
+			switch strings.ToLower(value) {
+			case "yes":
+				summary.MessagesWaiting = true
+			case "no":
+				summary.MessagesWaiting = false
+			default:
+				return nil, ErrMessageSummaryInvalid
+			}
+			waiting = true
+		case "message-account":
+			summary.Account = value
+		default:
+			if !strings.HasSuffix(name, "-message") && name != MessageClassNone {
+				// An extension header
+				continue
+			}
+			counts, err := parseMessageCounts(value)
+			if err != nil {
+				return nil, err
+			}
+			summary.Messages[name] = counts
+		}
+	}
+	if !waiting {
+		return nil, ErrMessageSummaryInvalid
+	}
+	return summary, nil
+}
+
+// Parse `new/old` with optional urgent counts, like `4/8 (1/2)`
+func parseMessageCounts(s string) (MessageCounts, error) {
+	var counts MessageCounts
+	total, urgent, hasUrgent := strings.Cut(s, "(")
+	var err error
+	if counts.New, counts.Old, err = parsePair(total); err != nil {
+		return counts, err
+	}
+	if hasUrgent {
+		urgent, ok := strings.CutSuffix(strings.TrimSpace(urgent), ")")
+		if !ok {
+			return counts, ErrMessageSummaryInvalid
+		}
+		if counts.NewUrgent, counts.OldUrgent, err = parsePair(urgent); err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+func parsePair(s string) (int, int, error) {
+	a, b, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, ErrMessageSummaryInvalid
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(a))
+	if err != nil || first < 0 {
+		return 0, 0, ErrMessageSummaryInvalid
+	}
+	second, err := strconv.Atoi(strings.TrimSpace(b))
+	if err != nil || second < 0 {
+		return 0, 0, ErrMessageSummaryInvalid
+	}
+	return first, second, nil
+}
+
+func (summary *MessageSummary) ContentType() string {
+	return ContentTypeMessageSummary
+}
+
+func (summary *MessageSummary) Data() []byte {
+	var b bytes.Buffer
+	b.WriteString("Messages-Waiting: ")
+	if summary.MessagesWaiting {
+		b.WriteString("yes\r\n")
+	} else {
+		b.WriteString("no\r\n")
+	}
+	if summary.Account != "" {
+		b.WriteString("Message-Account: ")
+		b.WriteString(summary.Account)
+		b.WriteString("\r\n")
+	}
+
+	classes := make([]string, 0, len(summary.Messages))
+	for class := range summary.Messages {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		counts := summary.Messages[class]
+		b.WriteString(headerName(class))
+		b.WriteString(": ")
+		b.WriteString(strconv.Itoa(counts.New))
+		b.WriteString("/")
+		b.WriteString(strconv.Itoa(counts.Old))
+		if counts.NewUrgent > 0 || counts.OldUrgent > 0 {
+			b.WriteString(" (")
+			b.WriteString(strconv.Itoa(counts.NewUrgent))
+			b.WriteString("/")
+			b.WriteString(strconv.Itoa(counts.OldUrgent))
+			b.WriteString(")")
+		}
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+// The usual capitalization of a message class header, like `Voice-Message`
+func headerName(class string) string {
+	words := strings.Split(class, "-")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, "-")
+}
@@ -0,0 +1,54 @@
+package event_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/safermobility/sipmanager/event"
+)
+
+// RFC 3842 section 7
+const messageSummary = "Messages-Waiting: yes\r\n" +
+	"Message-Account: sip:alice@vmail.example.com\r\n" +
+	"Voice-Message: 4/8 (1/2)\r\n" +
+	"Fax-Message: 0/1\r\n" +
+	"\r\n" +
+	"To: <alice@atlanta.example.com>\r\n" +
+	"From: <bob@biloxi.example.com>\r\n"
+
+func TestParseMessageSummary(t *testing.T) {
+	summary, err := event.ParseMessageSummary([]byte(messageSummary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &event.MessageSummary{
+		MessagesWaiting: true,
+		Account:         "sip:alice@vmail.example.com",
+		Messages: map[string]event.MessageCounts{
+			event.MessageClassVoice: {New: 4, Old: 8, NewUrgent: 1, OldUrgent: 2},
+			event.MessageClassFax:   {New: 0, Old: 1},
+		},
+	}
+	if !reflect.DeepEqual(want, summary) {
+		t.Errorf("%#v != %#v", want, summary)
+	}
+
+	again, err := event.ParseMessageSummary(summary.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(summary, again) {
+		t.Errorf("%q did not survive a round trip: %#v", summary.Data(), again)
+	}
+
+	for _, bad := range []string{
+		"Voice-Message: 1/0\r\n",
+		"Messages-Waiting: maybe\r\n",
+		"Messages-Waiting: yes\r\nVoice-Message: 1\r\n",
+		"Messages-Waiting: yes\r\nVoice-Message: 1/0 (1/0\r\n",
+	} {
+		if _, err := event.ParseMessageSummary([]byte(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The content types used to relay DTMF digits in INFO requests, for UAs that
+// cannot send them as RFC 4733 telephone events in the media stream
+const (
+	ContentTypeDTMFRelay = "application/dtmf-relay"
+	ContentTypeDTMF      = "application/dtmf"
+)
+
+var ErrDTMFInvalid = errors.New("not a valid DTMF body")
+
+// DTMF is a single digit relayed in an INFO request. It is a `Payload`, so it
+// can be sent as the body of a message.
+type DTMF struct {
+	Signal   string // `0`-`9`, `*`, `#`, `A`-`D`, or `16` for a hook flash
+	Duration int    // In milliseconds, or zero if not known
+	Type     string // `ContentTypeDTMFRelay` (used if empty) or `ContentTypeDTMF`
+}
+
+func (d *DTMF) ContentType() string {
+	if d.Type == "" {
+		return ContentTypeDTMFRelay
+	}
+	return d.Type
+}
+
+func (d *DTMF) Data() []byte {
+	if d.ContentType() == ContentTypeDTMF {
+		// Just the signal, without any duration
+		return []byte(d.Signal)
+	}
+	var b bytes.Buffer
+	b.WriteString("Signal=")
+	b.WriteString(d.Signal)
+	b.WriteString("\r\n")
+	if d.Duration > 0 {
+		b.WriteString("Duration=")
+		b.WriteString(strconv.Itoa(d.Duration))
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+// ParseDTMF decodes an `application/dtmf-relay` or `application/dtmf` body.
+// Digits sent as telephone event codes (`10` for `*`, `11` for `#`, and so on) are
+// converted back to their characters.
+func ParseDTMF(p Payload) (*DTMF, error) {
+	ctype, _, _ := strings.Cut(p.ContentType(), ";")
+	ctype = strings.ToLower(strings.TrimSpace(ctype))
+	d := &DTMF{Type: ctype}
+	switch ctype {
+	case ContentTypeDTMF:
+		d.Signal = strings.TrimSpace(string(p.Data()))
+	case ContentTypeDTMFRelay:
+		for _, line := range strings.Split(string(p.Data()), "\n") {
+			name, value, _ := strings.Cut(line, "=")
+			value = strings.TrimSpace(value)
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "signal":
+				d.Signal = value
+			case "duration":
+				duration, err := strconv.Atoi(value)
+				if err != nil || duration < 0 {
+					return nil, ErrDTMFInvalid
+				}
+				d.Duration = duration
+			}
+		}
+	default:
+		return nil, ErrDTMFInvalid
+	}
+
+	d.Signal = dtmfSignal(d.Signal)
+	if d.Signal == "" {
+		return nil, ErrDTMFInvalid
+	}
+	return d, nil
+}
+
+// Returns the signal in its usual form, or an empty string if it is not a DTMF signal
+func dtmfSignal(s string) string {
+	if len(s) == 1 && strings.Contains("0123456789*#ABCDabcd", s) {
+		return strings.ToUpper(s)
+	}
+	switch event, _ := strconv.Atoi(s); {
+	case s == "16":
+		return s
+	case event >= 10 && event <= 15 && len(s) == 2:
+		return string("*#ABCD"[event-10])
+	}
+	return ""
+}
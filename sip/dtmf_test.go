@@ -0,0 +1,64 @@
+package sip_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/safermobility/sipmanager/sip"
+)
+
+func TestParseDTMF(t *testing.T) {
+	tests := []struct {
+		payload *sip.MiscPayload
+		want    *sip.DTMF
+	}{
+		{
+			&sip.MiscPayload{T: sip.ContentTypeDTMFRelay, D: []byte("Signal=5\r\nDuration=160\r\n")},
+			&sip.DTMF{Signal: "5", Duration: 160, Type: sip.ContentTypeDTMFRelay},
+		},
+		{
+			&sip.MiscPayload{T: "Application/DTMF-Relay", D: []byte("signal= *\nduration= 250")},
+			&sip.DTMF{Signal: "*", Duration: 250, Type: sip.ContentTypeDTMFRelay},
+		},
+		{
+			&sip.MiscPayload{T: sip.ContentTypeDTMF, D: []byte("11\r\n")},
+			&sip.DTMF{Signal: "#", Type: sip.ContentTypeDTMF},
+		},
+		{
+			&sip.MiscPayload{T: sip.ContentTypeDTMF, D: []byte("d")},
+			&sip.DTMF{Signal: "D", Type: sip.ContentTypeDTMF},
+		},
+	}
+	for _, test := range tests {
+		got, err := sip.ParseDTMF(test.payload)
+		if err != nil {
+			t.Errorf("%q: %s", test.payload.D, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%q: %#v != %#v", test.payload.D, test.want, got)
+		}
+	}
+
+	for _, payload := range []*sip.MiscPayload{
+		{T: sip.ContentTypeDTMFRelay, D: []byte("Signal=X\r\n")},
+		{T: sip.ContentTypeDTMFRelay, D: []byte("Duration=160\r\n")},
+		{T: sip.ContentTypeDTMF, D: []byte("99")},
+		{T: "text/plain", D: []byte("5")},
+	} {
+		if _, err := sip.ParseDTMF(payload); err == nil {
+			t.Errorf("%s %q: expected an error", payload.T, payload.D)
+		}
+	}
+}
+
+func TestDTMFData(t *testing.T) {
+	relay := &sip.DTMF{Signal: "#", Duration: 100}
+	if relay.ContentType() != sip.ContentTypeDTMFRelay || string(relay.Data()) != "Signal=#\r\nDuration=100\r\n" {
+		t.Errorf("%s: %q", relay.ContentType(), relay.Data())
+	}
+	plain := &sip.DTMF{Signal: "7", Duration: 100, Type: sip.ContentTypeDTMF}
+	if string(plain.Data()) != "7" {
+		t.Errorf("%s: %q", plain.ContentType(), plain.Data())
+	}
+}
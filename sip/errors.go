@@ -26,3 +26,13 @@ type ResponseError struct {
 func (err *ResponseError) Error() string {
 	return fmt.Sprintf("%d: %s", err.Msg.Status, err.Msg.Phrase)
 }
+
+// HeaderError reports a header whose value could not be parsed
+type HeaderError struct {
+	Name  string
+	Value string
+}
+
+func (err *HeaderError) Error() string {
+	return fmt.Sprintf("invalid %s header: %q", err.Name, err.Value)
+}
@@ -0,0 +1,421 @@
+package sip
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// RAck is the value of an RFC 3262 `RAck` header
+type RAck struct {
+	RSeq   int    // The RSeq of the reliable provisional response
+	CSeq   int    // The CSeq of the request it was a response to
+	Method string // The method of the request it was a response to
+}
+
+func (rack *RAck) Append(b *bytes.Buffer) {
+	b.WriteString(strconv.Itoa(rack.RSeq))
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa(rack.CSeq))
+	b.WriteString(" ")
+	b.WriteString(rack.Method)
+}
+
+func (rack *RAck) String() string {
+	var b bytes.Buffer
+	rack.Append(&b)
+	return b.String()
+}
+
+// ParseRAck parses the value of a `RAck` header
+func ParseRAck(s string) (*RAck, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return nil, &HeaderError{Name: "RAck", Value: s}
+	}
+	rseq, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, &HeaderError{Name: "RAck", Value: s}
+	}
+	cseq, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, &HeaderError{Name: "RAck", Value: s}
+	}
+	return &RAck{RSeq: rseq, CSeq: cseq, Method: fields[2]}, nil
+}
+
+// Values of the `refresher` parameter of a `Session-Expires` header
+const (
+	RefresherUAC = "uac"
+	RefresherUAS = "uas"
+)
+
+// SessionExpires is the value of an RFC 4028 `Session-Expires` header
+type SessionExpires struct {
+	Delta     int    // The session interval, in seconds
+	Refresher string // `RefresherUAC`, `RefresherUAS`, or empty if not chosen yet
+}
+
+func (se *SessionExpires) Append(b *bytes.Buffer) {
+	b.WriteString(strconv.Itoa(se.Delta))
+	if se.Refresher != "" {
+		b.WriteString(";refresher=")
+		b.WriteString(se.Refresher)
+	}
+}
+
+func (se *SessionExpires) String() string {
+	var b bytes.Buffer
+	se.Append(&b)
+	return b.String()
+}
+
+// ParseSessionExpires parses the value of a `Session-Expires` header
+func ParseSessionExpires(s string) (*SessionExpires, error) {
+	params := strings.Split(s, ";")
+	delta, err := strconv.Atoi(strings.TrimSpace(params[0]))
+	if err != nil || delta <= 0 {
+		return nil, &HeaderError{Name: "Session-Expires", Value: s}
+	}
+	se := &SessionExpires{Delta: delta}
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(strings.TrimSpace(name), "refresher") {
+			se.Refresher = strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return se, nil
+}
+
+// Values of a `Subscription-State` header
+const (
+	SubscriptionActive     = "active"
+	SubscriptionPending    = "pending"
+	SubscriptionTerminated = "terminated"
+)
+
+// SubscriptionState is the value of an RFC 6665 `Subscription-State` header
+type SubscriptionState struct {
+	State      string // `SubscriptionActive`, `SubscriptionPending` or `SubscriptionTerminated`
+	Expires    int    // Seconds until an active or pending subscription expires, if set
+	Reason     string // Why a subscription was terminated, if given
+	RetryAfter int    // Seconds to wait before subscribing again, if set
+}
+
+func (ss *SubscriptionState) Append(b *bytes.Buffer) {
+	b.WriteString(ss.State)
+	if ss.Reason != "" {
+		b.WriteString(";reason=")
+		b.WriteString(ss.Reason)
+	}
+	if ss.Expires > 0 {
+		b.WriteString(";expires=")
+		b.WriteString(strconv.Itoa(ss.Expires))
+	}
+	if ss.RetryAfter > 0 {
+		b.WriteString(";retry-after=")
+		b.WriteString(strconv.Itoa(ss.RetryAfter))
+	}
+}
+
+func (ss *SubscriptionState) String() string {
+	var b bytes.Buffer
+	ss.Append(&b)
+	return b.String()
+}
+
+// ParseSubscriptionState parses the value of a `Subscription-State` header
+func ParseSubscriptionState(s string) (*SubscriptionState, error) {
+	params := strings.Split(s, ";")
+	ss := &SubscriptionState{State: strings.ToLower(strings.TrimSpace(params[0]))}
+	if ss.State == "" {
+		return nil, &HeaderError{Name: "Subscription-State", Value: s}
+	}
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		value = strings.TrimSpace(value)
+		var err error
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "expires":
+			ss.Expires, err = strconv.Atoi(value)
+		case "reason":
+			ss.Reason = strings.ToLower(value)
+		case "retry-after":
+			ss.RetryAfter, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return nil, &HeaderError{Name: "Subscription-State", Value: s}
+		}
+	}
+	return ss, nil
+}
+
+// Replaces is the value of an RFC 3891 `Replaces` header. The tags are from
+// the point of view of the UA receiving it: `ToTag` is its local tag.
+type Replaces struct {
+	CallID    CallID
+	ToTag     string
+	FromTag   string
+	EarlyOnly bool // Only replace the dialog if it has not been answered yet
+}
+
+func (r *Replaces) Append(b *bytes.Buffer) {
+	b.WriteString(string(r.CallID))
+	b.WriteString(";to-tag=")
+	b.WriteString(r.ToTag)
+	b.WriteString(";from-tag=")
+	b.WriteString(r.FromTag)
+	if r.EarlyOnly {
+		b.WriteString(";early-only")
+	}
+}
+
+func (r *Replaces) String() string {
+	var b bytes.Buffer
+	r.Append(&b)
+	return b.String()
+}
+
+// ParseReplaces parses the value of a `Replaces` header, which is also
+// how it appears (unescaped) as a header in a `Refer-To` URI
+func ParseReplaces(s string) (*Replaces, error) {
+	params := strings.Split(s, ";")
+	r := &Replaces{CallID: CallID(strings.TrimSpace(params[0]))}
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "to-tag":
+			r.ToTag = strings.TrimSpace(value)
+		case "from-tag":
+			r.FromTag = strings.TrimSpace(value)
+		case "early-only":
+			r.EarlyOnly = true
+		}
+	}
+	if r.CallID == "" || r.ToTag == "" || r.FromTag == "" {
+		return nil, &HeaderError{Name: "Replaces", Value: s}
+	}
+	return r, nil
+}
+
+// Protocols of a `Reason` header
+const (
+	ReasonSIP  = "SIP"   // The cause is a SIP status code
+	ReasonQ850 = "Q.850" // The cause is an ITU-T Q.850 cause value, as used in the PSTN
+)
+
+// Reason is the value of an RFC 3326 `Reason` header, telling the remote UA
+// why a request (usually a BYE or CANCEL) was sent
+type Reason struct {
+	Protocol string // `ReasonSIP` or `ReasonQ850`
+	Cause    int    // A status code or cause value, depending on `Protocol`
+	Text     string // A description for humans, if given
+}
+
+func (r *Reason) Append(b *bytes.Buffer) {
+	b.WriteString(r.Protocol)
+	if r.Cause > 0 {
+		b.WriteString(";cause=")
+		b.WriteString(strconv.Itoa(r.Cause))
+	}
+	if r.Text != "" {
+		b.WriteString(";text=")
+		appendQuoteQuoted(b, []byte(r.Text))
+	}
+}
+
+func (r *Reason) String() string {
+	var b bytes.Buffer
+	r.Append(&b)
+	return b.String()
+}
+
+// ParseReason parses the value of a `Reason` header. Only the first reason of
+// a list is kept.
+func ParseReason(s string) (*Reason, error) {
+	params := splitUnquoted(splitUnquoted(s, ',')[0], ';')
+	r := &Reason{Protocol: strings.TrimSpace(params[0])}
+	if r.Protocol == "" {
+		return nil, &HeaderError{Name: "Reason", Value: s}
+	}
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "cause":
+			cause, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, &HeaderError{Name: "Reason", Value: s}
+			}
+			r.Cause = cause
+		case "text":
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			r.Text = value
+		}
+	}
+	return r, nil
+}
+
+// Split `s` at every `sep` that is not inside a quoted string
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// The content type of an RFC 3420 SIP message fragment, used to report
+// the progress of a REFER
+const ContentTypeSipFrag = "message/sipfrag"
+
+// ParseSipFrag parses a `message/sipfrag` body. The fragment is usually
+// just a status line, like `SIP/2.0 180 Ringing`.
+func ParseSipFrag(data []byte) (*Msg, error) {
+	frag := string(data)
+	if !strings.HasSuffix(frag, "\r\n\r\n") {
+		frag = strings.TrimRight(frag, "\r\n") + "\r\n\r\n"
+	}
+	return ParseMsg([]byte(frag))
+}
+
+// Move the headers from SIP extensions that have their own `Msg` fields out of
+// the XHeader list. A header that cannot be parsed is left in the list.
+func (msg *Msg) parseExtensions() {
+	var kept, last *XHeader
+	for h := msg.XHeader; h != nil; h = h.Next {
+		if !msg.parseExtension(h.Name, strings.TrimSpace(string(h.Value))) {
+			copied := &XHeader{Name: h.Name, Value: h.Value}
+			if last == nil {
+				kept = copied
+			} else {
+				last.Next = copied
+			}
+			last = copied
+		}
+	}
+	msg.XHeader = kept
+}
+
+// Returns true if the header was stored in its own field
+func (msg *Msg) parseExtension(name, value string) bool {
+	switch strings.ToLower(name) {
+	case "rseq":
+		rseq, err := strconv.Atoi(value)
+		if err != nil {
+			return false
+		}
+		msg.RSeq = rseq
+	case "rack":
+		rack, err := ParseRAck(value)
+		if err != nil {
+			return false
+		}
+		msg.RAck = rack
+	case "session-expires", "x":
+		se, err := ParseSessionExpires(value)
+		if err != nil {
+			return false
+		}
+		msg.SessionExpires = se
+	case "min-se":
+		minSE, err := strconv.Atoi(strings.SplitN(value, ";", 2)[0])
+		if err != nil {
+			return false
+		}
+		msg.MinSE = minSE
+	case "subscription-state":
+		ss, err := ParseSubscriptionState(value)
+		if err != nil {
+			return false
+		}
+		msg.SubscriptionState = ss
+	case "replaces":
+		r, err := ParseReplaces(value)
+		if err != nil {
+			return false
+		}
+		msg.Replaces = r
+	case "reason":
+		r, err := ParseReason(value)
+		if err != nil {
+			return false
+		}
+		msg.Reason = r
+	case "recv-info":
+		msg.RecvInfo = value
+	case "info-package":
+		msg.InfoPackage = value
+	default:
+		return false
+	}
+	return true
+}
+
+// Write the headers from SIP extensions that have their own `Msg` fields
+func (msg *Msg) appendExtensions(b *bytes.Buffer) {
+	if msg.RSeq > 0 {
+		b.WriteString("RSeq: ")
+		b.WriteString(strconv.Itoa(msg.RSeq))
+		b.WriteString("\r\n")
+	}
+
+	if msg.RAck != nil {
+		b.WriteString("RAck: ")
+		msg.RAck.Append(b)
+		b.WriteString("\r\n")
+	}
+
+	if msg.SessionExpires != nil {
+		b.WriteString("Session-Expires: ")
+		msg.SessionExpires.Append(b)
+		b.WriteString("\r\n")
+	}
+
+	if msg.MinSE > 0 {
+		b.WriteString("Min-SE: ")
+		b.WriteString(strconv.Itoa(msg.MinSE))
+		b.WriteString("\r\n")
+	}
+
+	if msg.SubscriptionState != nil {
+		b.WriteString("Subscription-State: ")
+		msg.SubscriptionState.Append(b)
+		b.WriteString("\r\n")
+	}
+
+	if msg.Replaces != nil {
+		b.WriteString("Replaces: ")
+		msg.Replaces.Append(b)
+		b.WriteString("\r\n")
+	}
+
+	if msg.Reason != nil {
+		b.WriteString("Reason: ")
+		msg.Reason.Append(b)
+		b.WriteString("\r\n")
+	}
+
+	if msg.RecvInfo != "" {
+		b.WriteString("Recv-Info: ")
+		b.WriteString(msg.RecvInfo)
+		b.WriteString("\r\n")
+	}
+
+	if msg.InfoPackage != "" {
+		b.WriteString("Info-Package: ")
+		b.WriteString(msg.InfoPackage)
+		b.WriteString("\r\n")
+	}
+}
@@ -0,0 +1,135 @@
+package sip_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/safermobility/sipmanager/sip"
+)
+
+const extensionHeaders = "PRACK sip:bob@192.0.2.4 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK-prack\r\n" +
+	"From: <sip:alice@example.com>;tag=a\r\n" +
+	"To: <sip:bob@example.com>;tag=b\r\n" +
+	"Call-ID: prack-test\r\n" +
+	"CSeq: 2 PRACK\r\n" +
+	"RAck: 776656 1 INVITE\r\n" +
+	"RSeq: bogus\r\n" +
+	"x: 1800 ; refresher=UAS\r\n" +
+	"Min-SE: 90\r\n" +
+	"Subscription-State: terminated;reason=noresource;retry-after=30\r\n" +
+	"Replaces: 98732@sip.example.com ;from-tag=r33th4x0r;to-tag=ff87ff;early-only\r\n" +
+	"Recv-Info: infoDtmf, foo\r\n" +
+	"Info-Package: infoDtmf\r\n" +
+	"X-Other: kept\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+func TestParseExtensionHeaders(t *testing.T) {
+	msg, err := sip.ParseMsg([]byte(extensionHeaders))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &sip.RAck{RSeq: 776656, CSeq: 1, Method: sip.MethodInvite}
+	if !reflect.DeepEqual(want, msg.RAck) {
+		t.Errorf("RAck: %#v != %#v", want, msg.RAck)
+	}
+
+	wantSE := &sip.SessionExpires{Delta: 1800, Refresher: sip.RefresherUAS}
+	if !reflect.DeepEqual(wantSE, msg.SessionExpires) {
+		t.Errorf("Session-Expires: %#v != %#v", wantSE, msg.SessionExpires)
+	}
+	if msg.MinSE != 90 {
+		t.Errorf("Min-SE: %d != 90", msg.MinSE)
+	}
+	wantSS := &sip.SubscriptionState{State: sip.SubscriptionTerminated, Reason: "noresource", RetryAfter: 30}
+	if !reflect.DeepEqual(wantSS, msg.SubscriptionState) {
+		t.Errorf("Subscription-State: %#v != %#v", wantSS, msg.SubscriptionState)
+	}
+	wantReplaces := &sip.Replaces{CallID: "98732@sip.example.com", ToTag: "ff87ff", FromTag: "r33th4x0r", EarlyOnly: true}
+	if !reflect.DeepEqual(wantReplaces, msg.Replaces) {
+		t.Errorf("Replaces: %#v != %#v", wantReplaces, msg.Replaces)
+	}
+
+	if msg.RecvInfo != "infoDtmf, foo" || msg.InfoPackage != "infoDtmf" {
+		t.Errorf("Recv-Info: %q, Info-Package: %q", msg.RecvInfo, msg.InfoPackage)
+	}
+
+	// Headers that can't be parsed stay with the other extension headers
+	if msg.RSeq != 0 {
+		t.Errorf("RSeq: %d != 0", msg.RSeq)
+	}
+	if h := msg.XHeader.Get("RSeq"); h == nil || string(h.Value) != "bogus" {
+		t.Errorf("RSeq should be left in XHeader: %s", msg.XHeader)
+	}
+	if msg.XHeader.Get("RAck") != nil {
+		t.Errorf("RAck should be removed from XHeader: %s", msg.XHeader)
+	}
+	if h := msg.XHeader.Get("X-Other"); h == nil || string(h.Value) != "kept" {
+		t.Errorf("X-Other should be left in XHeader: %s", msg.XHeader)
+	}
+}
+
+func TestAppendExtensionHeaders(t *testing.T) {
+	msg := &sip.Msg{
+		Status:     sip.StatusSessionProgress,
+		CSeq:       1,
+		CSeqMethod: sip.MethodInvite,
+		RSeq:       42,
+	}
+	if s := msg.String(); !strings.Contains(s, "\r\nRSeq: 42\r\n") {
+		t.Errorf("RSeq missing from:\n%s", s)
+	}
+
+	msg = &sip.Msg{
+		Method: sip.MethodPrack,
+		RAck:   &sip.RAck{RSeq: 42, CSeq: 1, Method: sip.MethodInvite},
+	}
+	if s := msg.String(); !strings.Contains(s, "\r\nRAck: 42 1 INVITE\r\n") {
+		t.Errorf("RAck missing from:\n%s", s)
+	}
+
+	msg = &sip.Msg{
+		Method:         sip.MethodInvite,
+		SessionExpires: &sip.SessionExpires{Delta: 1800, Refresher: sip.RefresherUAC},
+		MinSE:          90,
+	}
+	s := msg.String()
+	if !strings.Contains(s, "\r\nSession-Expires: 1800;refresher=uac\r\n") || !strings.Contains(s, "\r\nMin-SE: 90\r\n") {
+		t.Errorf("session timer headers missing from:\n%s", s)
+	}
+}
+
+func TestReason(t *testing.T) {
+	r, err := sip.ParseReason(`Q.850 ;cause=16 ;text="Normal; call clearing", SIP;cause=200`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &sip.Reason{Protocol: sip.ReasonQ850, Cause: 16, Text: "Normal; call clearing"}
+	if !reflect.DeepEqual(want, r) {
+		t.Errorf("%#v != %#v", want, r)
+	}
+
+	msg := &sip.Msg{Method: sip.MethodBye, Reason: &sip.Reason{Protocol: sip.ReasonSIP, Cause: 200, Text: "Call completed elsewhere"}}
+	if s := msg.String(); !strings.Contains(s, "\r\nReason: SIP;cause=200;text=\"Call completed elsewhere\"\r\n") {
+		t.Errorf("Reason missing from:\n%s", s)
+	}
+
+	if _, err := sip.ParseReason(" ;cause=16"); err == nil {
+		t.Error("a reason without a protocol should not parse")
+	}
+}
+
+func TestParseSipFrag(t *testing.T) {
+	for _, frag := range []string{"SIP/2.0 486 Busy Here", "SIP/2.0 486 Busy Here\r\n", "SIP/2.0 486 Busy Here\r\nRetry-After: 60\r\n\r\n"} {
+		msg, err := sip.ParseSipFrag([]byte(frag))
+		if err != nil {
+			t.Errorf("%q: %s", frag, err)
+			continue
+		}
+		if msg.Status != sip.StatusBusyHere || msg.Phrase != "Busy Here" {
+			t.Errorf("%q: %d %s", frag, msg.Status, msg.Phrase)
+		}
+	}
+}
@@ -69,7 +69,8 @@ type Msg struct {
 	Date               string
 	ErrorInfo          string
 	Event              string
-	Expires            int // Seconds registration should expire.
+	Expires            int  // Seconds registration should expire.
+	HasExpires         bool // Whether the message has an Expires header, which is needed to tell it apart from zero
 	InReplyTo          string
 	MIMEVersion        string
 	MinExpires         int // Registrars need this when responding
@@ -93,6 +94,17 @@ type Msg struct {
 	WWWAuthenticate    string
 	Warning            string
 
+	// Headers from SIP extensions, which are moved out of XHeader after parsing.
+	RSeq              int                // RFC 3262: sequence number of a reliable provisional response
+	RAck              *RAck              // RFC 3262: the reliable provisional response acknowledged by a PRACK
+	SessionExpires    *SessionExpires    // RFC 4028: the session interval, and who refreshes the session
+	MinSE             int                // RFC 4028: the smallest session interval allowed, in seconds
+	SubscriptionState *SubscriptionState // RFC 6665: the state of the subscription a NOTIFY belongs to
+	Replaces          *Replaces          // RFC 3891: the dialog that a new INVITE replaces
+	Reason            *Reason            // RFC 3326: why a BYE or CANCEL was sent
+	RecvInfo          string             // RFC 6086: the Info Packages a UA is willing to receive
+	InfoPackage       string             // RFC 6086: the Info Package an INFO request belongs to
+
 	// Extension headers.
 	XHeader *XHeader
 }
@@ -124,6 +136,26 @@ func (msg *Msg) Copy() *Msg {
 	res.Route = msg.Route.Copy()
 	res.Contact = msg.Contact.Copy()
 	res.RecordRoute = msg.RecordRoute.Copy()
+	if msg.RAck != nil {
+		rack := *msg.RAck
+		res.RAck = &rack
+	}
+	if msg.SessionExpires != nil {
+		se := *msg.SessionExpires
+		res.SessionExpires = &se
+	}
+	if msg.SubscriptionState != nil {
+		ss := *msg.SubscriptionState
+		res.SubscriptionState = &ss
+	}
+	if msg.Replaces != nil {
+		r := *msg.Replaces
+		res.Replaces = &r
+	}
+	if msg.Reason != nil {
+		r := *msg.Reason
+		res.Reason = &r
+	}
 	res.XHeader = msg.XHeader
 	return res
 }
@@ -309,8 +341,9 @@ func (msg *Msg) Append(b *bytes.Buffer) {
 		b.WriteString("\r\n")
 	}
 
-	// Expires is allowed to be 0 for for REGISTER stuff.
-	if msg.Expires > 0 || msg.Method == "REGISTER" || msg.CSeqMethod == "REGISTER" {
+	// Expires is allowed to be 0 for for REGISTER stuff, and to end a subscription.
+	if msg.Expires > 0 || msg.HasExpires || msg.Method == "REGISTER" || msg.CSeqMethod == "REGISTER" ||
+		msg.Method == MethodSubscribe || msg.CSeqMethod == MethodSubscribe {
 		b.WriteString("Expires: ")
 		b.WriteString(strconv.Itoa(msg.Expires))
 		b.WriteString("\r\n")
@@ -401,7 +434,7 @@ func (msg *Msg) Append(b *bytes.Buffer) {
 	}
 
 	if msg.RetryAfter != "" {
-		b.WriteString("RetryAfter: ")
+		b.WriteString("Retry-After: ")
 		b.WriteString(msg.RetryAfter)
 		b.WriteString("\r\n")
 	}
@@ -448,6 +481,7 @@ func (msg *Msg) Append(b *bytes.Buffer) {
 		b.WriteString("\r\n")
 	}
 
+	msg.appendExtensions(b)
 	msg.XHeader.Append(b)
 
 	if msg.Payload != nil {
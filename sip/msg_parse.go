@@ -22,8 +22,6 @@ package sip
 import (
 	"errors"
 	"fmt"
-
-	"github.com/safermobility/sipmanager/sdp"
 )
 
 //line msg_parse.rl:12
@@ -13468,6 +13466,7 @@ func ParseMsg(data []byte) (msg *Msg, err error) {
 	tr678:
 //line sip.rl:482
 		msg.Expires = 0
+		msg.HasExpires = true
 //line sip.rl:227
 
 		msg.Expires = msg.Expires*10 + (int(data[p]) - 0x30)
@@ -13800,6 +13799,7 @@ func ParseMsg(data []byte) (msg *Msg, err error) {
 
 //line sip.rl:482
 		msg.Expires = 0
+		msg.HasExpires = true
 //line sip.rl:227
 
 		msg.Expires = msg.Expires*10 + (int(data[p]) - 0x30)
@@ -19520,18 +19520,15 @@ func ParseMsg(data []byte) (msg *Msg, err error) {
 		}
 	}
 
+	msg.parseExtensions()
+
 	if clen > 0 {
 		if clen != len(data)-p {
 			return nil, errors.New(fmt.Sprintf("Content-Length incorrect: %d != %d", clen, len(data)-p))
 		}
-		if ctype == sdp.ContentType {
-			ms, err := sdp.Parse(string(data[p:len(data)]), true)
-			if err != nil {
-				return nil, err
-			}
-			msg.Payload = ms
-		} else {
-			msg.Payload = &MiscPayload{T: ctype, D: data[p:len(data)]}
+		msg.Payload, err = parsePayload(ctype, data[p:len(data)])
+		if err != nil {
+			return nil, err
 		}
 	}
 	return msg, nil
@@ -20,7 +20,6 @@ package sip
 import (
 	"errors"
 	"fmt"
-	"github.com/safermobility/sipmanager/sdp"
 )
 
 %% machine msg;
@@ -62,18 +61,15 @@ func ParseMsg(data []byte) (msg *Msg, err error) {
 		}
 	}
 
+	msg.parseExtensions()
+
 	if clen > 0 {
 		if clen != len(data) - p {
 			return nil, errors.New(fmt.Sprintf("Content-Length incorrect: %d != %d", clen, len(data) - p))
 		}
-		if ctype == sdp.ContentType {
-			ms, err := sdp.Parse(string(data[p:len(data)]), true)
-			if err != nil {
-				return nil, err
-			}
-			msg.Payload = ms
-		} else {
-			msg.Payload = &MiscPayload{T: ctype, D: data[p:len(data)]}
+		msg.Payload, err = parsePayload(ctype, data[p:len(data)])
+		if err != nil {
+			return nil, err
 		}
 	}
 	return msg, nil
@@ -90,6 +90,20 @@ var msgTests = []msgTest{
 			Status:       200,
 			Phrase:       "OK",
 			Expires:      666,
+			HasExpires:   true,
+		},
+	},
+
+	{
+		name: "Zero Expires",
+		s: "SIP/2.0 200 OK\r\n" +
+			"Expires: 0\r\n" +
+			"\r\n",
+		msg: sip.Msg{
+			VersionMajor: 2,
+			Status:       200,
+			Phrase:       "OK",
+			HasExpires:   true,
 		},
 	},
 
@@ -14,6 +14,13 @@
 
 package sip
 
+import (
+	"strings"
+
+	"github.com/safermobility/sipmanager/event"
+	"github.com/safermobility/sipmanager/sdp"
+)
+
 type Payload interface {
 	ContentType() string
 	Data() []byte
@@ -31,3 +38,23 @@ func (p *MiscPayload) ContentType() string {
 func (p *MiscPayload) Data() []byte {
 	return p.D
 }
+
+// Turn a message body into a typed payload, if we know its content type.
+// Bodies for event packages fall back to a `MiscPayload` if they are malformed,
+// so that a broken NOTIFY body does not make the whole message unreadable.
+func parsePayload(ctype string, data []byte) (Payload, error) {
+	mediaType, _, _ := strings.Cut(ctype, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case sdp.ContentType:
+		return sdp.Parse(string(data), true)
+	case event.ContentTypeDialogInfo:
+		if info, err := event.ParseDialogInfo(data); err == nil {
+			return info, nil
+		}
+	case event.ContentTypeMessageSummary:
+		if summary, err := event.ParseMessageSummary(data); err == nil {
+			return summary, nil
+		}
+	}
+	return &MiscPayload{T: ctype, D: data}, nil
+}
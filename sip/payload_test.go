@@ -0,0 +1,55 @@
+package sip_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/safermobility/sipmanager/event"
+	"github.com/safermobility/sipmanager/sip"
+)
+
+func notifyWithBody(ctype, body string) []byte {
+	return []byte("NOTIFY sip:alice@192.0.2.1 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.0.2.4:5060;branch=z9hG4bK-notify\r\n" +
+		"From: <sip:alice@vmail.example.com>;tag=n\r\n" +
+		"To: <sip:alice@example.com>;tag=s\r\n" +
+		"Call-ID: payload-test\r\n" +
+		"CSeq: 2 NOTIFY\r\n" +
+		"Event: message-summary\r\n" +
+		"Subscription-State: active;expires=3600\r\n" +
+		"Content-Type: " + ctype + "\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n", len(body)) +
+		"\r\n" +
+		body)
+}
+
+func TestParseEventPayloads(t *testing.T) {
+	msg, err := sip.ParseMsg(notifyWithBody(event.ContentTypeMessageSummary, "Messages-Waiting: yes\r\nVoice-Message: 2/0\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, ok := msg.Payload.(*event.MessageSummary)
+	if !ok {
+		t.Fatalf("payload is a %T", msg.Payload)
+	}
+	if !summary.MessagesWaiting || summary.Messages[event.MessageClassVoice].New != 2 {
+		t.Errorf("%#v", summary)
+	}
+
+	msg, err = sip.ParseMsg(notifyWithBody(event.ContentTypeDialogInfo+";charset=UTF-8", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="3" state="partial" entity="sip:bob@example.com"/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := msg.Payload.(*event.DialogInfo); !ok || info.Version != 3 {
+		t.Errorf("payload is %#v", msg.Payload)
+	}
+
+	// A malformed body is still delivered, as it is
+	msg, err = sip.ParseMsg(notifyWithBody(event.ContentTypeDialogInfo, "<dialog-info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, ok := msg.Payload.(*sip.MiscPayload); !ok || string(payload.D) != "<dialog-info" {
+		t.Errorf("payload is %#v", msg.Payload)
+	}
+}
@@ -73,6 +73,7 @@ const (
 	StatusInvalidIdentityHeader        = 438 // [RFC4474]
 	StatusFirstHopLacksOutboundSupport = 439 // [RFC5626]
 	StatusMaxBreadthExceeded           = 440 // [RFC5393]
+	StatusBadInfoPackage               = 469 // [RFC6086]
 	StatusConsentNeeded                = 470 // [RFC5360]
 	StatusTemporarilyUnavailable       = 480 // fast busy or soft fail
 	StatusCallTransactionDoesNotExist  = 481 // Bad news
@@ -160,6 +161,7 @@ var phrases = map[int]string{
 	StatusInvalidIdentityHeader:        "Invalid Identity Header",
 	StatusFirstHopLacksOutboundSupport: "First Hop Lacks Outbound Support",
 	StatusMaxBreadthExceeded:           "Max-Breadth Exceeded",
+	StatusBadInfoPackage:               "Bad Info Package",
 	StatusConsentNeeded:                "Consent Needed",
 	StatusTemporarilyUnavailable:       "Temporarily Unavailable",
 	StatusCallTransactionDoesNotExist:  "Call/Transaction Does Not Exist",
@@ -0,0 +1,217 @@
+package transaction
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+)
+
+// ResponseHandler receives the responses to a client transaction's request.
+// It is called from the goroutine that received the response (or fired the timer),
+// never while the transaction is locked.
+type ResponseHandler func(tx *Client, msg *sip.Msg)
+
+// Client is an INVITE or non-INVITE client transaction (RFC 3261 section 17.1)
+type Client struct {
+	layer   *Layer
+	key     Key
+	request *sip.Msg
+	handler ResponseHandler
+	invite  bool
+
+	mu         sync.Mutex
+	state      State
+	ack        *sip.Msg      // ACK for a non-2xx final response to INVITE
+	interval   time.Duration // Current retransmit interval
+	retransmit *time.Timer   // Timer A (INVITE) or E (non-INVITE)
+	timeout    *time.Timer   // Timer B (INVITE) or F (non-INVITE)
+	linger     *time.Timer   // Timer D (INVITE), K (non-INVITE), or M (INVITE, RFC 6026)
+}
+
+func newClient(l *Layer, key Key, req *sip.Msg, handler ResponseHandler) *Client {
+	tx := &Client{
+		layer:    l,
+		key:      key,
+		request:  req,
+		handler:  handler,
+		invite:   req.Method == sip.MethodInvite,
+		state:    StateTrying,
+		interval: l.timers.T1,
+	}
+	if tx.invite {
+		tx.state = StateCalling
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.retransmit = time.AfterFunc(tx.interval, tx.fireRetransmit)
+	tx.timeout = time.AfterFunc(l.timers.requestTimeout(), tx.fireTimeout)
+	return tx
+}
+
+// Request returns the request that started this transaction
+func (tx *Client) Request() *sip.Msg {
+	return tx.request
+}
+
+// State returns the current state of the transaction
+func (tx *Client) State() State {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.state
+}
+
+// Handle a response from the network
+func (tx *Client) receive(msg *sip.Msg) {
+	tx.mu.Lock()
+	deliver := false
+	switch tx.state {
+	case StateCalling, StateTrying, StateProceeding:
+		deliver = true
+		switch {
+		case msg.Status < sip.StatusOK:
+			if tx.invite {
+				// Once a provisional response arrives, an INVITE is neither
+				// retransmitted nor timed out by the transaction layer.
+				stop(tx.retransmit)
+				stop(tx.timeout)
+			}
+			tx.state = StateProceeding
+		case msg.Status < sip.StatusMultipleChoices && tx.invite:
+			stop(tx.retransmit)
+			stop(tx.timeout)
+			tx.state = StateAccepted
+			tx.linger = time.AfterFunc(64*tx.layer.timers.T1, tx.terminate)
+		case tx.invite:
+			stop(tx.retransmit)
+			stop(tx.timeout)
+			tx.state = StateCompleted
+			tx.ack = newErrorAck(tx.request, msg)
+			tx.sendAck()
+			tx.linger = time.AfterFunc(32*time.Second, tx.terminate)
+		default:
+			stop(tx.retransmit)
+			stop(tx.timeout)
+			tx.state = StateCompleted
+			tx.linger = time.AfterFunc(tx.layer.timers.T4, tx.terminate)
+		}
+	case StateAccepted:
+		// Retransmissions of the 2xx (or 2xx from other forks) go to the dialog,
+		// which is responsible for ACK'ing each of them.
+		deliver = msg.Status >= sip.StatusOK && msg.Status < sip.StatusMultipleChoices
+	case StateCompleted:
+		// The final response was retransmitted, so our ACK must have been lost
+		if tx.invite && msg.Status >= sip.StatusMultipleChoices {
+			tx.sendAck()
+		}
+	}
+	tx.mu.Unlock()
+
+	if deliver {
+		tx.handler(tx, msg)
+	}
+}
+
+// Send the ACK for a non-2xx final response; must be called with the lock held
+func (tx *Client) sendAck() {
+	if err := tx.layer.transport.Send(tx.ack); err != nil {
+		tx.layer.logger.Error(
+			"unable to send ACK for non-2xx response",
+			slog.String("error", err.Error()),
+			slog.String("packet", tx.ack.String()),
+		)
+	}
+}
+
+// Timer A or E fired: retransmit the request
+func (tx *Client) fireRetransmit() {
+	tx.mu.Lock()
+	switch tx.state {
+	case StateCalling:
+		tx.interval *= 2
+	case StateTrying:
+		tx.interval = min(2*tx.interval, tx.layer.timers.T2)
+	case StateProceeding:
+		if tx.invite {
+			tx.mu.Unlock()
+			return
+		}
+		tx.interval = tx.layer.timers.T2
+	default:
+		tx.mu.Unlock()
+		return
+	}
+
+	if err := tx.layer.transport.Send(tx.request); err != nil {
+		tx.layer.logger.Error(
+			"unable to retransmit request",
+			slog.String("error", err.Error()),
+			slog.String("packet", tx.request.String()),
+		)
+		// RFC 3261 section 8.1.3.1: a transport error is treated like a 503
+		tx.mu.Unlock()
+		tx.fail(sip.StatusServiceUnavailable)
+		return
+	}
+	tx.retransmit = time.AfterFunc(tx.interval, tx.fireRetransmit)
+	tx.mu.Unlock()
+}
+
+// Timer B or F fired: give up on the request
+func (tx *Client) fireTimeout() {
+	tx.layer.logger.Debug(
+		"client transaction timed out",
+		slog.String("method", tx.request.Method),
+		slog.String("branch", tx.key.Branch),
+	)
+	tx.fail(sip.StatusRequestTimeout)
+}
+
+// End the transaction without a final response from the network
+func (tx *Client) fail(status int) {
+	tx.mu.Lock()
+	if tx.state != StateCalling && tx.state != StateTrying && tx.state != StateProceeding {
+		tx.mu.Unlock()
+		return
+	}
+	tx.state = StateTerminated
+	stop(tx.retransmit)
+	stop(tx.timeout)
+	tx.mu.Unlock()
+
+	tx.layer.removeClient(tx)
+	tx.handler(tx, synthesize(tx.request, status))
+}
+
+// Timer D, K, or M fired (or the transaction otherwise ended)
+func (tx *Client) terminate() {
+	tx.mu.Lock()
+	tx.state = StateTerminated
+	stop(tx.retransmit)
+	stop(tx.timeout)
+	stop(tx.linger)
+	tx.mu.Unlock()
+
+	tx.layer.removeClient(tx)
+}
+
+// http://tools.ietf.org/html/rfc3261#section-17.1.1.3
+// The ACK for a non-2xx final response is part of the INVITE transaction,
+// so it is sent to the same place as the INVITE, with the same branch.
+func newErrorAck(invite, msg *sip.Msg) *sip.Msg {
+	return &sip.Msg{
+		Method:             sip.MethodAck,
+		Request:            invite.Request,
+		From:               invite.From,
+		To:                 msg.To,
+		Via:                invite.Via.Detach(),
+		CallID:             invite.CallID,
+		CSeq:               invite.CSeq,
+		CSeqMethod:         sip.MethodAck,
+		Route:              invite.Route,
+		Authorization:      invite.Authorization,
+		ProxyAuthorization: invite.ProxyAuthorization,
+	}
+}
@@ -0,0 +1,172 @@
+package transaction
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+)
+
+// Server is an INVITE or non-INVITE server transaction (RFC 3261 section 17.2)
+type Server struct {
+	layer   *Layer
+	key     Key
+	request *sip.Msg
+	invite  bool
+
+	mu         sync.Mutex
+	state      State
+	last       *sip.Msg      // Most recent response, replayed when the request is retransmitted
+	interval   time.Duration // Current retransmit interval
+	retransmit *time.Timer   // Timer G (INVITE)
+	timeout    *time.Timer   // Timer H (INVITE)
+	linger     *time.Timer   // Timer I (INVITE), J (non-INVITE), or L (INVITE, RFC 6026)
+}
+
+func newServer(l *Layer, key Key, req *sip.Msg) *Server {
+	tx := &Server{
+		layer:    l,
+		key:      key,
+		request:  req,
+		invite:   req.Method == sip.MethodInvite,
+		state:    StateTrying,
+		interval: l.timers.T1,
+	}
+	if tx.invite {
+		tx.state = StateProceeding
+	}
+	return tx
+}
+
+// Request returns the request that started this transaction
+func (tx *Server) Request() *sip.Msg {
+	return tx.request
+}
+
+// State returns the current state of the transaction
+func (tx *Server) State() State {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.state
+}
+
+// Respond sends a response to the request.
+// A 2xx response to INVITE must be retransmitted by the caller until it is ACK'ed
+// (RFC 3261 section 13.3.1.4); all other retransmissions are handled here.
+func (tx *Server) Respond(msg *sip.Msg) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	switch tx.state {
+	case StateTrying, StateProceeding:
+	case StateAccepted:
+		if msg.Status < sip.StatusOK || msg.Status >= sip.StatusMultipleChoices {
+			return ErrTerminated
+		}
+	default:
+		return ErrTerminated
+	}
+
+	if err := tx.layer.transport.Send(msg); err != nil {
+		return err
+	}
+	tx.last = msg
+
+	switch {
+	case tx.state == StateAccepted:
+	case msg.Status < sip.StatusOK:
+		tx.state = StateProceeding
+	case msg.Status < sip.StatusMultipleChoices && tx.invite:
+		tx.state = StateAccepted
+		tx.linger = time.AfterFunc(64*tx.layer.timers.T1, tx.terminate)
+	case tx.invite:
+		tx.state = StateCompleted
+		tx.retransmit = time.AfterFunc(tx.interval, tx.fireRetransmit)
+		tx.timeout = time.AfterFunc(64*tx.layer.timers.T1, tx.fireTimeout)
+	default:
+		tx.state = StateCompleted
+		tx.linger = time.AfterFunc(64*tx.layer.timers.T1, tx.terminate)
+	}
+	return nil
+}
+
+// The request was retransmitted, so replay our most recent response
+func (tx *Server) receiveRetransmission(msg *sip.Msg) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	// RFC 6026: retransmissions in the Accepted state are absorbed,
+	// because the 2xx is being retransmitted by the dialog anyway.
+	if tx.last == nil || tx.state == StateAccepted || tx.state == StateTerminated {
+		return
+	}
+	if err := tx.layer.transport.Send(tx.last); err != nil {
+		tx.layer.logger.Error(
+			"unable to resend response to retransmitted request",
+			slog.String("error", err.Error()),
+			slog.String("packet", tx.last.String()),
+		)
+	}
+}
+
+// Handle an ACK with the same branch as this transaction.
+// Returns true if the ACK was absorbed by the transaction.
+func (tx *Server) receiveAck(msg *sip.Msg) bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	switch tx.state {
+	case StateCompleted:
+		stop(tx.retransmit)
+		stop(tx.timeout)
+		tx.state = StateConfirmed
+		tx.linger = time.AfterFunc(tx.layer.timers.T4, tx.terminate)
+		return true
+	case StateConfirmed:
+		return true
+	default:
+		// An ACK for a 2xx response belongs to the dialog
+		return false
+	}
+}
+
+// Timer G fired: retransmit the non-2xx final response
+func (tx *Server) fireRetransmit() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.state != StateCompleted {
+		return
+	}
+	if err := tx.layer.transport.Send(tx.last); err != nil {
+		tx.layer.logger.Error(
+			"unable to retransmit response",
+			slog.String("error", err.Error()),
+			slog.String("packet", tx.last.String()),
+		)
+	}
+	tx.interval = min(2*tx.interval, tx.layer.timers.T2)
+	tx.retransmit = time.AfterFunc(tx.interval, tx.fireRetransmit)
+}
+
+// Timer H fired: the ACK never arrived
+func (tx *Server) fireTimeout() {
+	tx.layer.logger.Warn(
+		"timeout waiting for ACK of non-2xx response",
+		slog.String("branch", tx.key.Branch),
+	)
+	tx.terminate()
+}
+
+// Timer H, I, J, or L fired
+func (tx *Server) terminate() {
+	tx.mu.Lock()
+	tx.state = StateTerminated
+	stop(tx.retransmit)
+	stop(tx.timeout)
+	stop(tx.linger)
+	tx.mu.Unlock()
+
+	tx.layer.removeServer(tx)
+}
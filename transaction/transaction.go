@@ -0,0 +1,284 @@
+// Package transaction implements the RFC 3261 section 17 transaction layer
+// (with the RFC 6026 "Accepted" state for INVITE transactions).
+//
+// Client transactions retransmit requests until a response arrives, and
+// synthesize a `408 Request Timeout` if none does. Server transactions
+// absorb retransmitted requests by replaying the most recent response,
+// and retransmit non-2xx final responses to INVITE until they are ACK'ed.
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+)
+
+// Default timer values from RFC 3261 section 17.1.1.1
+const (
+	DefaultT1 = 500 * time.Millisecond // Estimated round-trip time
+	DefaultT2 = 4 * time.Second        // Maximum retransmit interval for non-INVITE requests and INVITE responses
+	DefaultT4 = 5 * time.Second        // Maximum duration a message will remain in the network
+)
+
+// The magic cookie that starts every RFC 3261 Via branch
+const branchCookie = "z9hG4bK"
+
+var (
+	ErrAckNotTransaction = errors.New("ACK for a 2xx response is not sent in a transaction")
+	ErrNotRequest        = errors.New("transactions can only be started by requests")
+	ErrTerminated        = errors.New("transaction has already completed")
+	ErrNoBranch          = errors.New("request was sent without a Via branch")
+)
+
+// Transport sends messages to the network.
+// Send must fill in any missing headers, including the Via branch of requests.
+type Transport interface {
+	Send(msg *sip.Msg) error
+}
+
+// Timers holds the RFC 3261 timer values that all other timers are derived from
+type Timers struct {
+	T1 time.Duration
+	T2 time.Duration
+	T4 time.Duration
+
+	// Timer B (INVITE) and F (non-INVITE): how long a client transaction
+	// waits for a final response before it times out; 64*T1 if zero
+	Timeout time.Duration
+}
+
+func (t Timers) requestTimeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return 64 * t.T1
+}
+
+// DefaultTimers returns the timer values recommended by RFC 3261
+func DefaultTimers() Timers {
+	return Timers{
+		T1: DefaultT1,
+		T2: DefaultT2,
+		T4: DefaultT4,
+	}
+}
+
+// State is the state of a transaction's state machine
+type State int
+
+const (
+	StateCalling    State = iota + 1 // INVITE client: request sent, no response yet
+	StateTrying                      // Non-INVITE: no provisional response yet
+	StateProceeding                  // Provisional response sent or received
+	StateCompleted                   // Non-2xx (or non-INVITE) final response sent or received
+	StateAccepted                    // INVITE: 2xx response sent or received (RFC 6026)
+	StateConfirmed                   // INVITE server: ACK for non-2xx response received
+	StateTerminated
+)
+
+func (s State) String() string {
+	switch s {
+	case StateCalling:
+		return "Calling"
+	case StateTrying:
+		return "Trying"
+	case StateProceeding:
+		return "Proceeding"
+	case StateCompleted:
+		return "Completed"
+	case StateAccepted:
+		return "Accepted"
+	case StateConfirmed:
+		return "Confirmed"
+	case StateTerminated:
+		return "Terminated"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Key identifies a transaction (RFC 3261 sections 17.1.3 and 17.2.3)
+type Key struct {
+	Branch string
+	Method string
+}
+
+// Build the key for a request, or for the response to a request
+func newKey(msg *sip.Msg, method string) Key {
+	var branch string
+	if msg.Via != nil {
+		if b := msg.Via.Param.Get("branch"); b != nil {
+			branch = b.Value
+		}
+	}
+	if !strings.HasPrefix(branch, branchCookie) {
+		// RFC 2543 clients do not send unique branches, so fall back on
+		// the fields that identify a request in the older specification.
+		var tag string
+		if msg.From != nil {
+			if t := msg.From.Param.Get("tag"); t != nil {
+				tag = t.Value
+			}
+		}
+		branch = fmt.Sprintf("%s;%d;%s;%s", msg.CallID, msg.CSeq, tag, branch)
+	}
+	if method == sip.MethodAck {
+		// ACK for a non-2xx response is part of the INVITE transaction
+		method = sip.MethodInvite
+	}
+	return Key{Branch: branch, Method: method}
+}
+
+// Layer keeps track of every active transaction
+type Layer struct {
+	transport Transport
+	timers    Timers
+	logger    *slog.Logger
+
+	mu      sync.Mutex
+	clients map[Key]*Client
+	servers map[Key]*Server
+}
+
+// NewLayer creates a transaction layer that sends messages with `transport`
+func NewLayer(transport Transport, timers Timers, logger *slog.Logger) *Layer {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Layer{
+		transport: transport,
+		timers:    timers,
+		logger:    logger,
+		clients:   make(map[Key]*Client),
+		servers:   make(map[Key]*Server),
+	}
+}
+
+// Timers returns the timer values used by this transaction layer
+func (l *Layer) Timers() Timers {
+	return l.timers
+}
+
+// HandleResponse passes a response to the client transaction it belongs to.
+// It returns false if there is no matching transaction.
+func (l *Layer) HandleResponse(msg *sip.Msg) bool {
+	key := newKey(msg, msg.CSeqMethod)
+	l.mu.Lock()
+	tx := l.clients[key]
+	l.mu.Unlock()
+	if tx == nil || !msg.Via.CompareHostPort(tx.request.Via) {
+		return false
+	}
+	tx.receive(msg)
+	return true
+}
+
+// HandleRequest passes a request to the server transaction it belongs to,
+// creating a new transaction if this request is not a retransmission.
+//
+// If `forward` is false, the request was absorbed by the transaction layer
+// and must not be processed any further.
+// ACK requests that are forwarded never have a transaction, because an ACK for
+// a 2xx response is handled by the dialog rather than the transaction layer.
+func (l *Layer) HandleRequest(msg *sip.Msg) (tx *Server, forward bool) {
+	key := newKey(msg, msg.Method)
+
+	l.mu.Lock()
+	tx = l.servers[key]
+	if tx == nil && msg.Method != sip.MethodAck {
+		tx = newServer(l, key, msg)
+		l.servers[key] = tx
+		l.mu.Unlock()
+		return tx, true
+	}
+	l.mu.Unlock()
+
+	if msg.Method == sip.MethodAck {
+		if tx != nil && tx.receiveAck(msg) {
+			return nil, false
+		}
+		return nil, true
+	}
+
+	tx.receiveRetransmission(msg)
+	return tx, false
+}
+
+// MatchCancel returns the INVITE server transaction that a CANCEL request
+// applies to (RFC 3261 section 9.2), or nil if there is none.
+func (l *Layer) MatchCancel(cancel *sip.Msg) *Server {
+	key := newKey(cancel, sip.MethodInvite)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.servers[key]
+}
+
+// Request starts a new client transaction by sending `req`.
+// Every response (including a `408 Request Timeout` synthesized when no response arrives,
+// or a `503 Service Unavailable` synthesized on a transport error) is passed to `handler`.
+func (l *Layer) Request(req *sip.Msg, handler ResponseHandler) (*Client, error) {
+	if req.IsResponse() {
+		return nil, ErrNotRequest
+	}
+	if req.Method == sip.MethodAck {
+		return nil, ErrAckNotTransaction
+	}
+
+	// Hold the lock while sending, so a quick response cannot arrive before
+	// the transaction has been registered.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.transport.Send(req); err != nil {
+		return nil, err
+	}
+	if req.Via.Param.Get("branch") == nil {
+		return nil, ErrNoBranch
+	}
+
+	tx := newClient(l, newKey(req, req.Method), req, handler)
+	l.clients[tx.key] = tx
+	return tx, nil
+}
+
+func (l *Layer) removeClient(tx *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[tx.key] == tx {
+		delete(l.clients, tx.key)
+	}
+}
+
+func (l *Layer) removeServer(tx *Server) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.servers[tx.key] == tx {
+		delete(l.servers, tx.key)
+	}
+}
+
+// Build a response to a request that never received one from the network
+func synthesize(req *sip.Msg, status int) *sip.Msg {
+	return &sip.Msg{
+		Status:     status,
+		Phrase:     sip.Phrase(status),
+		Via:        req.Via,
+		From:       req.From,
+		To:         req.To,
+		CallID:     req.CallID,
+		CSeq:       req.CSeq,
+		CSeqMethod: req.Method,
+	}
+}
+
+// Stop a timer, if it was started
+func stop(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
@@ -0,0 +1,217 @@
+package transaction_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safermobility/sipmanager/sip"
+	"github.com/safermobility/sipmanager/transaction"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTimers = transaction.Timers{
+	T1: 10 * time.Millisecond,
+	T2: 40 * time.Millisecond,
+	T4: 50 * time.Millisecond,
+}
+
+// Records every message "sent" to the network
+type fakeTransport struct {
+	mu   sync.Mutex
+	sent []*sip.Msg
+	at   []time.Time
+}
+
+func (t *fakeTransport) Send(msg *sip.Msg) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, msg)
+	t.at = append(t.at, time.Now())
+	return nil
+}
+
+func (t *fakeTransport) count(method string, status int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, msg := range t.sent {
+		if msg.Method == method && msg.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+func newRequest(method string) *sip.Msg {
+	return &sip.Msg{
+		Method:  method,
+		Request: &sip.URI{Scheme: "sip", Host: "example.test"},
+		Via: &sip.Via{
+			Host:  "192.0.2.10",
+			Port:  5060,
+			Param: &sip.Param{Name: "branch", Value: "z9hG4bK-" + method},
+		},
+		From:       &sip.Addr{Uri: &sip.URI{Scheme: "sip", Host: "192.0.2.10"}, Param: &sip.Param{Name: "tag", Value: "a"}},
+		To:         &sip.Addr{Uri: &sip.URI{Scheme: "sip", Host: "example.test"}},
+		CallID:     "test-call-id",
+		CSeq:       1,
+		CSeqMethod: method,
+	}
+}
+
+func newResponse(req *sip.Msg, status int) *sip.Msg {
+	return &sip.Msg{
+		Status:     status,
+		Phrase:     sip.Phrase(status),
+		Via:        req.Via,
+		From:       req.From,
+		To:         req.To,
+		CallID:     req.CallID,
+		CSeq:       req.CSeq,
+		CSeqMethod: req.Method,
+	}
+}
+
+type responses struct {
+	mu   sync.Mutex
+	msgs []*sip.Msg
+}
+
+func (r *responses) handle(tx *transaction.Client, msg *sip.Msg) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msg)
+}
+
+func (r *responses) statuses() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var res []int
+	for _, msg := range r.msgs {
+		res = append(res, msg.Status)
+	}
+	return res
+}
+
+func TestNonInviteClientBackoffAndTimeout(t *testing.T) {
+	transport := &fakeTransport{}
+	layer := transaction.NewLayer(transport, testTimers, nil)
+	var got responses
+
+	_, err := layer.Request(newRequest(sip.MethodOptions), got.handle)
+	require.NoError(t, err)
+
+	// Timer F fires after 64*T1, and a 408 is synthesized
+	require.Eventually(t, func() bool { return len(got.statuses()) > 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int{sip.StatusRequestTimeout}, got.statuses())
+
+	// Timer E doubles from T1 but never exceeds T2
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	require.Greater(t, len(transport.at), 4)
+	for i := 2; i < len(transport.at); i++ {
+		gap := transport.at[i].Sub(transport.at[i-1])
+		assert.Less(t, gap, testTimers.T2+testTimers.T1, "retransmission %d", i)
+	}
+}
+
+func TestClientTimeoutOverride(t *testing.T) {
+	transport := &fakeTransport{}
+	timers := testTimers
+	timers.Timeout = 4 * timers.T1
+	layer := transaction.NewLayer(transport, timers, nil)
+	var got responses
+
+	start := time.Now()
+	_, err := layer.Request(newRequest(sip.MethodInvite), got.handle)
+	require.NoError(t, err)
+
+	// Timer B fires after the two resends that fit in 4*T1, long before 64*T1
+	require.Eventually(t, func() bool { return len(got.statuses()) > 0 }, time.Second, time.Millisecond)
+	assert.Less(t, time.Since(start), 32*timers.T1)
+	assert.Equal(t, []int{sip.StatusRequestTimeout}, got.statuses())
+	assert.Equal(t, 3, transport.count(sip.MethodInvite, 0))
+}
+
+func TestInviteClientErrorResponseIsAcked(t *testing.T) {
+	transport := &fakeTransport{}
+	layer := transaction.NewLayer(transport, testTimers, nil)
+	var got responses
+
+	invite := newRequest(sip.MethodInvite)
+	tx, err := layer.Request(invite, got.handle)
+	require.NoError(t, err)
+
+	require.True(t, layer.HandleResponse(newResponse(invite, sip.StatusRinging)))
+	require.True(t, layer.HandleResponse(newResponse(invite, sip.StatusBusyHere)))
+	assert.Equal(t, transaction.StateCompleted, tx.State())
+	assert.Equal(t, 1, transport.count(sip.MethodAck, 0))
+
+	// A retransmitted final response is absorbed and ACK'ed again
+	require.True(t, layer.HandleResponse(newResponse(invite, sip.StatusBusyHere)))
+	assert.Equal(t, 2, transport.count(sip.MethodAck, 0))
+	assert.Equal(t, []int{sip.StatusRinging, sip.StatusBusyHere}, got.statuses())
+}
+
+func TestInviteClientAcceptedPassesEvery2xx(t *testing.T) {
+	transport := &fakeTransport{}
+	layer := transaction.NewLayer(transport, testTimers, nil)
+	var got responses
+
+	invite := newRequest(sip.MethodInvite)
+	tx, err := layer.Request(invite, got.handle)
+	require.NoError(t, err)
+
+	require.True(t, layer.HandleResponse(newResponse(invite, sip.StatusOK)))
+	require.True(t, layer.HandleResponse(newResponse(invite, sip.StatusOK)))
+	assert.Equal(t, transaction.StateAccepted, tx.State())
+	assert.Equal(t, []int{sip.StatusOK, sip.StatusOK}, got.statuses())
+	assert.Equal(t, 0, transport.count(sip.MethodAck, 0))
+
+	// Timer M
+	require.Eventually(t, func() bool { return tx.State() == transaction.StateTerminated }, time.Second, time.Millisecond)
+	assert.False(t, layer.HandleResponse(newResponse(invite, sip.StatusOK)))
+}
+
+func TestServerAbsorbsRetransmissions(t *testing.T) {
+	transport := &fakeTransport{}
+	layer := transaction.NewLayer(transport, testTimers, nil)
+
+	req := newRequest(sip.MethodBye)
+	tx, forward := layer.HandleRequest(req)
+	require.True(t, forward)
+	require.NoError(t, tx.Respond(newResponse(req, sip.StatusOK)))
+
+	again, forward := layer.HandleRequest(newRequest(sip.MethodBye))
+	assert.False(t, forward)
+	assert.Same(t, tx, again)
+	assert.Equal(t, 2, transport.count("", sip.StatusOK))
+
+	// Timer J
+	require.Eventually(t, func() bool { return tx.State() == transaction.StateTerminated }, time.Second, time.Millisecond)
+}
+
+func TestInviteServerRetransmitsUntilAck(t *testing.T) {
+	transport := &fakeTransport{}
+	layer := transaction.NewLayer(transport, testTimers, nil)
+
+	invite := newRequest(sip.MethodInvite)
+	tx, forward := layer.HandleRequest(invite)
+	require.True(t, forward)
+	require.NoError(t, tx.Respond(newResponse(invite, sip.StatusBusyHere)))
+
+	// Timer G
+	require.Eventually(t, func() bool { return transport.count("", sip.StatusBusyHere) >= 3 }, time.Second, time.Millisecond)
+
+	ack := newRequest(sip.MethodAck)
+	ack.Via = invite.Via
+	ackTx, forward := layer.HandleRequest(ack)
+	assert.Nil(t, ackTx)
+	assert.False(t, forward)
+	assert.Equal(t, transaction.StateConfirmed, tx.State())
+
+	// A CANCEL is its own transaction, but can find the INVITE it applies to
+	assert.Same(t, tx, layer.MatchCancel(newRequest(sip.MethodInvite)))
+}